@@ -0,0 +1,87 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * assign.go
+ *
+ * => assignment of a read set to a sample from the hits in all its reads
+ *
+ */
+
+// Assignment = outcome of assigning a read set to a sample
+type Assignment int
+
+const (
+	// AssignUndetermined = no hits
+	AssignUndetermined Assignment = iota
+	// AssignSample = all hits name the same sample
+	AssignSample
+	// AssignAmbiguous = hits name more than one sample
+	AssignAmbiguous
+	// AssignRejected = cell barcode rejected by the whitelist; not written
+	AssignRejected
+)
+
+// returns the sample a hit assigns its read set to: the composite cell ID
+// for split-pool round hits, otherwise the pattern ID's sample
+func hitSample(hit Hit) string {
+	if hit.Cell != "" {
+		return hit.Cell
+	}
+	return sampleName(hit.ID)
+}
+
+// returns true if all hits name the same sample
+func sameSample(hits []Hit) bool {
+	for _, hit := range hits[1:] {
+		if hitSample(hit) != hitSample(hits[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the assignment of a read set from its hits, and the sample name if
+// assigned; verified hits naming more than one sample are tie-broken by distance
+func assignReadSet(hits []Hit) (Assignment, string) {
+	if len(hits) == 0 {
+		return AssignUndetermined, ""
+	}
+	hits = bestHits(hits)
+	if !sameSample(hits) {
+		return AssignAmbiguous, ""
+	}
+	return AssignSample, hitSample(hits[0])
+}
+
+// returns the assignment of a read set checked against the whitelist, if
+// any, and the sample name if assigned; rejected read sets aren't assigned
+func readSetAssignment(hits []Hit, rejected bool) (Assignment, string) {
+	if rejected {
+		return AssignRejected, ""
+	}
+	return assignReadSet(hits)
+}
+
+// returns the index of the hit a read set is assigned by, -1 if not assigned;
+// => the first hit in scan order with the lowest distance, ie: in the first
+// matching read if not tie-broken
+func winningHit(hits []Hit) int {
+	if assignment, _ := assignReadSet(hits); assignment != AssignSample {
+		return -1
+	}
+	best, ok := bestDistance(hits)
+	if !ok || sameSample(hits) {
+		return 0
+	}
+	for i, hit := range hits {
+		if hit.Edits.Distance() == best {
+			return i
+		}
+	}
+	return 0
+}
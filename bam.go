@@ -0,0 +1,578 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * bam.go
+ *
+ * => unaligned BAM (uBAM) input: BGZF decompression and BAM record decoding
+ * => paired records are grouped into templates and split out by read role,
+ *    with BC/QT and RX/QX tags providing I1/I2 and UMI records
+ * => BAM header / record encoding for uBAM output (see output.go)
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// BAM flag bits
+const (
+	bamFlagPaired        = 0x1
+	bamFlagReverse       = 0x10
+	bamFlagRead1         = 0x40
+	bamFlagRead2         = 0x80
+	bamFlagSecondary     = 0x100
+	bamFlagSupplementary = 0x800
+)
+
+// quality character used when a record or tag has no base qualities
+const bamDefaultQual = 'I'
+
+// largest header text, reference name or record read as a size field, so a
+// corrupt size is an error instead of an allocation of up to 2 GiB
+const bamMaxSize = 1 << 28
+
+// 4-bit encoded BAM sequence bases
+const bamSeqBases = "=ACMGRSVTWYHKDBN"
+
+// BAMRecord = the fields of a BAM record needed for demultiplexing
+type BAMRecord struct {
+	Name      string
+	Flag      uint16
+	Seq, Qual string
+	// aux tags, values formatted as strings
+	Tags map[string]string
+}
+
+// BAMReader decodes records from a BGZF-compressed BAM stream
+type BAMReader struct {
+	reader *bufio.Reader
+	Header string
+	buf    []byte
+}
+
+// returns a BAMReader positioned at the first record, after the header
+func newBAMReader(r io.Reader) (*BAMReader, error) {
+	// => BGZF is a series of gzip members, which gzip.Reader reads as one stream
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	br := &BAMReader{reader: bufio.NewReader(gzipReader)}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(br.reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != "BAM\x01" {
+		return nil, fmt.Errorf("not a BAM file (bad magic)")
+	}
+
+	// header text
+	lText, err := br.readSize("header text", 0)
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, lText)
+	if _, err := io.ReadFull(br.reader, text); err != nil {
+		return nil, err
+	}
+	br.Header = string(bytes.TrimRight(text, "\x00"))
+
+	// reference sequences; unaligned BAMs normally have none
+	nRef, err := br.readInt32()
+	if err != nil {
+		return nil, err
+	}
+	if nRef < 0 {
+		return nil, fmt.Errorf("negative reference sequence count (%d)", nRef)
+	}
+	for i := int32(0); i < nRef; i++ {
+		lName, err := br.readSize("reference name", 1)
+		if err != nil {
+			return nil, err
+		}
+		// name + l_ref
+		if _, err := br.reader.Discard(lName + 4); err != nil {
+			return nil, err
+		}
+	}
+
+	return br, nil
+}
+
+func (br *BAMReader) readInt32() (int32, error) {
+	var v int32
+	err := binary.Read(br.reader, binary.LittleEndian, &v)
+	return v, err
+}
+
+// reads a size field, of at least minSize and at most bamMaxSize bytes
+func (br *BAMReader) readSize(what string, minSize int) (int, error) {
+	size, err := br.readInt32()
+	if err != nil {
+		return 0, err
+	}
+	if int(size) < minSize || size > bamMaxSize {
+		return 0, fmt.Errorf("bad %s size (%d bytes)", what, size)
+	}
+	return int(size), nil
+}
+
+// returns the next record, or io.EOF at the end of the stream
+func (br *BAMReader) Read() (*BAMRecord, error) {
+	blockSize, err := br.readInt32()
+	if err != nil {
+		return nil, err
+	}
+	// => a record is at least its fixed fields
+	if blockSize < 32 || blockSize > bamMaxSize {
+		return nil, fmt.Errorf("bad BAM record size (%d bytes)", blockSize)
+	}
+	if cap(br.buf) < int(blockSize) {
+		br.buf = make([]byte, blockSize)
+	}
+	block := br.buf[:blockSize]
+	if _, err := io.ReadFull(br.reader, block); err != nil {
+		return nil, fmt.Errorf("truncated BAM record: %s", err)
+	}
+
+	return decodeBAMRecord(block)
+}
+
+// decodes a single BAM record block (without the leading block_size)
+func decodeBAMRecord(block []byte) (*BAMRecord, error) {
+	if len(block) < 32 {
+		return nil, fmt.Errorf("BAM record too short (%d bytes)", len(block))
+	}
+	le := binary.LittleEndian
+
+	lReadName := int(block[8])
+	nCigarOp := int(le.Uint16(block[12:14]))
+	flag := le.Uint16(block[14:16])
+	lSeq := int(int32(le.Uint32(block[16:20])))
+	// => the read name is NUL terminated; sizes are checked before they're
+	// added up, so a corrupt sequence length can't overflow the record end
+	if lReadName < 1 || lSeq < 0 || lSeq > len(block) {
+		return nil, fmt.Errorf("bad BAM record read name (%d bytes) or sequence (%d bases) length", lReadName, lSeq)
+	}
+
+	offset := 32
+	end := offset + lReadName + 4*nCigarOp + (lSeq+1)/2 + lSeq
+	if end > len(block) {
+		return nil, fmt.Errorf("BAM record fields exceed block size")
+	}
+
+	record := &BAMRecord{Flag: flag, Tags: make(map[string]string)}
+	record.Name = string(bytes.TrimRight(block[offset:offset+lReadName], "\x00"))
+	offset += lReadName + 4*nCigarOp
+
+	seq := make([]byte, lSeq)
+	for i := 0; i < lSeq; i++ {
+		b := block[offset+i/2]
+		if i%2 == 0 {
+			seq[i] = bamSeqBases[b>>4]
+		} else {
+			seq[i] = bamSeqBases[b&0x0f]
+		}
+	}
+	record.Seq = string(seq)
+	offset += (lSeq + 1) / 2
+
+	qual := make([]byte, lSeq)
+	for i := 0; i < lSeq; i++ {
+		if block[offset] == 0xff {
+			qual[i] = bamDefaultQual
+		} else {
+			qual[i] = block[offset+i] + 33
+		}
+	}
+	record.Qual = string(qual)
+	offset += lSeq
+
+	if err := decodeBAMTags(block[offset:], record.Tags); err != nil {
+		return nil, fmt.Errorf("read %s: %s", record.Name, err)
+	}
+
+	return record, nil
+}
+
+// returns the BAM encoding of a SAM header, with no reference sequences
+func encodeBAMHeader(header string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BAM\x01")
+	binary.Write(&buf, binary.LittleEndian, int32(len(header)))
+	buf.WriteString(header)
+	binary.Write(&buf, binary.LittleEndian, int32(0))
+	return buf.Bytes()
+}
+
+// returns the BAM encoding of an unmapped record, including the leading block_size
+func encodeBAMRecord(name string, flag uint16, seq, qual string, tags []SAMTag) []byte {
+	le := binary.LittleEndian
+
+	// => l_read_name is a uint8, including the NUL terminator
+	if len(name) > 254 {
+		name = name[:254]
+	}
+
+	fixed := make([]byte, 36)
+	le.PutUint32(fixed[4:8], 0xffffffff)  // refID
+	le.PutUint32(fixed[8:12], 0xffffffff) // pos
+	fixed[12] = byte(len(name) + 1)       // l_read_name
+	fixed[13] = 0                         // mapq
+	le.PutUint16(fixed[14:16], 4680)      // bin, for unmapped reads
+	le.PutUint16(fixed[16:18], 0)         // n_cigar_op
+	le.PutUint16(fixed[18:20], flag)      // flag
+	le.PutUint32(fixed[20:24], uint32(len(seq)))
+	le.PutUint32(fixed[24:28], 0xffffffff) // next_refID
+	le.PutUint32(fixed[28:32], 0xffffffff) // next_pos
+
+	var buf bytes.Buffer
+	buf.Write(fixed)
+	buf.WriteString(name)
+	buf.WriteByte(0)
+
+	packed := make([]byte, (len(seq)+1)/2)
+	for i := 0; i < len(seq); i++ {
+		code := strings.IndexByte(bamSeqBases, upperBase(seq[i]))
+		if code < 0 {
+			code = 15 // N
+		}
+		if i%2 == 0 {
+			packed[i/2] = byte(code) << 4
+		} else {
+			packed[i/2] |= byte(code)
+		}
+	}
+	buf.Write(packed)
+
+	if len(qual) == len(seq) {
+		for i := 0; i < len(qual); i++ {
+			buf.WriteByte(qual[i] - 33)
+		}
+	} else {
+		buf.Write(bytes.Repeat([]byte{0xff}, len(seq)))
+	}
+
+	for _, tag := range tags {
+		buf.WriteString(tag.Tag)
+		buf.WriteByte(tag.Type)
+		switch tag.Type {
+		case 'i':
+			v, err := strconv.Atoi(tag.Value)
+			checkErr(err, fmt.Sprintf("Bad integer value '%s' for tag %s", tag.Value, tag.Tag))
+			binary.Write(&buf, le, int32(v))
+		default:
+			buf.WriteString(tag.Value)
+			buf.WriteByte(0)
+		}
+	}
+
+	record := buf.Bytes()
+	le.PutUint32(record[0:4], uint32(len(record)-4))
+	return record
+}
+
+// returns the upper case of an ASCII base
+func upperBase(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
+
+// returns the size in bytes of a fixed-size aux tag value type
+func bamTagValueSize(valueType byte) int {
+	switch valueType {
+	case 'A', 'c', 'C':
+		return 1
+	case 's', 'S':
+		return 2
+	case 'i', 'I', 'f':
+		return 4
+	}
+	return 0
+}
+
+// decodes aux tags into tags; array ('B') values are skipped
+func decodeBAMTags(data []byte, tags map[string]string) error {
+	le := binary.LittleEndian
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return fmt.Errorf("truncated aux tag")
+		}
+		tag := string(data[:2])
+		valueType := data[2]
+		data = data[3:]
+
+		switch valueType {
+		case 'Z', 'H':
+			n := bytes.IndexByte(data, 0)
+			if n == -1 {
+				return fmt.Errorf("unterminated aux tag %s", tag)
+			}
+			tags[tag] = string(data[:n])
+			data = data[n+1:]
+			continue
+		case 'B':
+			if len(data) < 5 {
+				return fmt.Errorf("truncated aux tag %s", tag)
+			}
+			size := bamTagValueSize(data[0])
+			if size == 0 {
+				return fmt.Errorf("bad array type '%c' for aux tag %s", data[0], tag)
+			}
+			n := 5 + size*int(le.Uint32(data[1:5]))
+			if n > len(data) {
+				return fmt.Errorf("truncated aux tag %s", tag)
+			}
+			data = data[n:]
+			continue
+		}
+
+		size := bamTagValueSize(valueType)
+		if size == 0 {
+			return fmt.Errorf("bad type '%c' for aux tag %s", valueType, tag)
+		}
+		if size > len(data) {
+			return fmt.Errorf("truncated aux tag %s", tag)
+		}
+		value := data[:size]
+		switch valueType {
+		case 'A':
+			tags[tag] = string(value)
+		case 'c':
+			tags[tag] = strconv.Itoa(int(int8(value[0])))
+		case 'C':
+			tags[tag] = strconv.Itoa(int(value[0]))
+		case 's':
+			tags[tag] = strconv.Itoa(int(int16(le.Uint16(value))))
+		case 'S':
+			tags[tag] = strconv.Itoa(int(le.Uint16(value)))
+		case 'i':
+			tags[tag] = strconv.Itoa(int(int32(le.Uint32(value))))
+		case 'I':
+			tags[tag] = strconv.FormatUint(uint64(le.Uint32(value)), 10)
+		case 'f':
+			tags[tag] = strconv.FormatFloat(float64(math.Float32frombits(le.Uint32(value))), 'g', -1, 32)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// bamInput = uBAM file(s) shared by the read inputs of a read set;
+// records are read one template (records sharing a name) at a time
+type bamInput struct {
+	Files     []string
+	fileIndex int
+	file      *os.File
+	reader    *BAMReader
+	bar       *pb.ProgressBar
+	// read-ahead record belonging to the next template
+	pending *BAMRecord
+	// current template, split by read role, and the index of the file it came from
+	template          map[ReadRole]FASTQRecord
+	templateFileIndex int
+	// roles already taken from the current template
+	taken map[ReadRole]bool
+}
+
+// opens the current uBAM file for reading
+func (bam *bamInput) openFile() {
+	filename := bam.Files[bam.fileIndex]
+	log.Debug(fmt.Sprintf("Reading uBAM file: %s", filename))
+
+	var err error
+	bam.file, err = os.Open(filename)
+	checkErr(err, fmt.Sprintf("Couldn't open uBAM file '%s' for reading! %s", filename, err))
+
+	var fileReader io.Reader = bam.file
+	if bam.bar != nil {
+		fileReader = bam.bar.NewProxyReader(bam.file)
+	}
+	bam.reader, err = newBAMReader(fileReader)
+	checkErr(err, fmt.Sprintf("Couldn't read uBAM file '%s'! %s", filename, err))
+	bam.pending = nil
+}
+
+// returns the next primary record, moving through input files in order;
+// returns nil when all files are exhausted
+func (bam *bamInput) readRecord() *BAMRecord {
+	for {
+		record, err := bam.reader.Read()
+		if err == nil {
+			if record.Flag&(bamFlagSecondary|bamFlagSupplementary) != 0 {
+				continue
+			}
+			return record
+		}
+		if err != io.EOF {
+			log.Fatal(fmt.Sprintf("Couldn't read uBAM file '%s'! %s", bam.Files[bam.fileIndex], err))
+		}
+		bam.file.Close()
+		if bam.fileIndex+1 >= len(bam.Files) {
+			return nil
+		}
+		bam.fileIndex++
+		bam.openFile()
+	}
+}
+
+// reads the next template; returns false when input is exhausted
+func (bam *bamInput) nextTemplate() bool {
+	first := bam.pending
+	if first == nil {
+		first = bam.readRecord()
+	}
+	if first == nil {
+		return false
+	}
+	bam.templateFileIndex = bam.fileIndex
+	lane := getLane(bam.Files[bam.fileIndex])
+
+	records := []*BAMRecord{first}
+	bam.pending = nil
+	for {
+		record := bam.readRecord()
+		if record == nil {
+			break
+		}
+		if record.Name != first.Name {
+			bam.pending = record
+			break
+		}
+		records = append(records, record)
+	}
+
+	var err error
+	bam.template, err = splitBAMTemplate(records, lane)
+	checkErr(err, fmt.Sprintf("Couldn't read uBAM file '%s'! %s", bam.Files[bam.templateFileIndex], err))
+	bam.taken = make(map[ReadRole]bool)
+	return true
+}
+
+// returns the QNAME of the current template
+func (bam *bamInput) templateName() string {
+	for _, record := range bam.template {
+		return getReadID(record.Name)
+	}
+	return ""
+}
+
+// returns the record for role from the current template, reading a new
+// template once the role has already been taken from the current one
+func (bam *bamInput) next(role ReadRole) (FASTQRecord, bool) {
+	if bam.template == nil || bam.taken[role] {
+		if !bam.nextTemplate() {
+			return FASTQRecord{}, true
+		}
+	}
+	bam.taken[role] = true
+	record, ok := bam.template[role]
+	if !ok {
+		log.Fatal(fmt.Sprintf("uBAM template '%s' in '%s' has no %s read, as in the first template!", bam.templateName(), bam.Files[bam.templateFileIndex], role))
+	}
+	record.Role = role
+	return record, false
+}
+
+// returns the records of a template keyed by read role;
+// BC/QT tags provide I1 (and I2, for dual indexes) and RX/QX tags provide UMI.
+// secondary and supplementary records are skipped, and a template with two
+// records of a role is an error
+func splitBAMTemplate(records []*BAMRecord, lane string) (map[ReadRole]FASTQRecord, error) {
+	template := make(map[ReadRole]FASTQRecord)
+	name := "@" + records[0].Name
+
+	for _, record := range records {
+		if record.Flag&(bamFlagSecondary|bamFlagSupplementary) != 0 {
+			continue
+		}
+		seq, qual := record.Seq, record.Qual
+		// => unaligned reads shouldn't be reversed, but restore original orientation if so
+		if record.Flag&bamFlagReverse != 0 {
+			seq = reverseComplementDNA(seq)
+			qual = reverse(qual)
+		}
+
+		role := RoleR1
+		if record.Flag&bamFlagPaired != 0 && record.Flag&bamFlagRead2 != 0 {
+			role = RoleR2
+		}
+		if _, exists := template[role]; exists {
+			return nil, fmt.Errorf("template '%s' has more than one %s read", records[0].Name, role)
+		}
+		template[role] = FASTQRecord{Name: name, Seq: seq, Qual: qual, Lane: lane}
+
+		// tags are taken from the first record of the template that has them
+		if bc, ok := record.Tags["BC"]; ok {
+			if _, exists := template[RoleI1]; !exists {
+				barcodes := strings.FieldsFunc(bc, func(c rune) bool { return c == '-' || c == '+' })
+				quals := strings.Split(record.Tags["QT"], " ")
+				for i, role := range []ReadRole{RoleI1, RoleI2} {
+					if i < len(barcodes) {
+						template[role] = FASTQRecord{Name: name, Seq: barcodes[i], Qual: tagQual(barcodes[i], quals, i), Lane: lane}
+					}
+				}
+			}
+		}
+		if rx, ok := record.Tags["RX"]; ok {
+			if _, exists := template[RoleUMI]; !exists {
+				template[RoleUMI] = FASTQRecord{Name: name, Seq: rx, Qual: tagQual(rx, []string{record.Tags["QX"]}, 0), Lane: lane}
+			}
+		}
+	}
+
+	return template, nil
+}
+
+// returns the i-th tag quality string if it matches the sequence length,
+// otherwise default qualities
+func tagQual(seq string, quals []string, i int) string {
+	if i < len(quals) && len(quals[i]) == len(seq) {
+		return quals[i]
+	}
+	return strings.Repeat(string(bamDefaultQual), len(seq))
+}
+
+// returns the read roles present in the first template of a uBAM file
+func getBAMRoles(filename string) []ReadRole {
+	bam := &bamInput{Files: []string{filename}}
+	bam.openFile()
+	defer bam.file.Close()
+
+	var roles []ReadRole
+	if !bam.nextTemplate() {
+		return roles
+	}
+	for _, role := range []ReadRole{RoleR1, RoleR2, RoleI1, RoleI2, RoleUMI} {
+		if _, ok := bam.template[role]; ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// returns basename of a "*.bam" file
+func getBAMBasename(filePath string) string {
+	return filepath.Base(strings.TrimSuffix(filePath, filepath.Ext(filePath)))
+}
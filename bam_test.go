@@ -0,0 +1,192 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeBAMTags(t *testing.T) {
+	var data bytes.Buffer
+	le := binary.LittleEndian
+	data.WriteString("RXZACGT\x00")
+	data.WriteString("XAAq")
+	data.WriteString("Xcc\xfe")
+	data.WriteString("XCC\xfe")
+	data.WriteString("Xss\xfe\xff")
+	data.WriteString("XSS\xfe\xff")
+	data.WriteString("Xii")
+	binary.Write(&data, le, int32(-3))
+	data.WriteString("XII")
+	binary.Write(&data, le, uint32(math.MaxUint32))
+	data.WriteString("Xff")
+	binary.Write(&data, le, float32(1.5))
+	// => arrays are skipped
+	data.WriteString("XBBs")
+	binary.Write(&data, le, uint32(2))
+	binary.Write(&data, le, int16(1))
+	binary.Write(&data, le, int16(2))
+	data.WriteString("XHH1AE9\x00")
+
+	tags := make(map[string]string)
+	if err := decodeBAMTags(data.Bytes(), tags); err != nil {
+		t.Fatalf("decodeBAMTags: %s", err)
+	}
+	want := map[string]string{
+		"RX": "ACGT", "XA": "q", "Xc": "-2", "XC": "254", "Xs": "-2", "XS": "65534",
+		"Xi": "-3", "XI": "4294967295", "Xf": "1.5", "XH": "1AE9",
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+
+	// => truncated and unknown tags
+	for _, data := range []string{"RXZACGT", "Xii\x01\x00", "XBs\x05\x00\x00\x00\x01\x00", "Xqq\x00", "X"} {
+		if err := decodeBAMTags([]byte(data), make(map[string]string)); err == nil {
+			t.Errorf("decodeBAMTags(%q) = nil, want an error", data)
+		}
+	}
+}
+
+func TestSplitBAMTemplate(t *testing.T) {
+	records := []*BAMRecord{
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead1, Seq: "AACC", Qual: "ABCD",
+			Tags: map[string]string{"BC": "GGGG-TTTA", "QT": "1234 5678", "RX": "CATG", "QX": "!!##"}},
+		// => a reversed read is restored to its original orientation
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead2 | bamFlagReverse, Seq: "AAAC", Qual: "ABCD",
+			Tags: map[string]string{"BC": "CCCC"}},
+	}
+	template, err := splitBAMTemplate(records, "L001")
+	if err != nil {
+		t.Fatalf("splitBAMTemplate: %s", err)
+	}
+
+	want := map[ReadRole]FASTQRecord{
+		RoleR1:  {Name: "@read1", Seq: "AACC", Qual: "ABCD", Lane: "L001"},
+		RoleR2:  {Name: "@read1", Seq: "GTTT", Qual: "DCBA", Lane: "L001"},
+		RoleI1:  {Name: "@read1", Seq: "GGGG", Qual: "1234", Lane: "L001"},
+		RoleI2:  {Name: "@read1", Seq: "TTTA", Qual: "5678", Lane: "L001"},
+		RoleUMI: {Name: "@read1", Seq: "CATG", Qual: "!!##", Lane: "L001"},
+	}
+	if !reflect.DeepEqual(template, want) {
+		t.Errorf("template = %+v, want %+v", template, want)
+	}
+
+	// => unpaired reads are R1; tags without matching qualities get defaults
+	records = []*BAMRecord{{Name: "read2", Seq: "ACGT", Qual: "IIII", Tags: map[string]string{"BC": "GGC", "QT": "12"}}}
+	template, err = splitBAMTemplate(records, "")
+	if err != nil || len(template) != 2 || template[RoleR1].Seq != "ACGT" || template[RoleI1].Qual != "III" {
+		t.Errorf("unpaired template = %+v, %v", template, err)
+	}
+
+	// => secondary and supplementary records are skipped, other records of
+	// a role already in the template are an error
+	records = []*BAMRecord{
+		{Name: "read3", Flag: bamFlagPaired | bamFlagRead1, Seq: "ACGT"},
+		{Name: "read3", Flag: bamFlagPaired | bamFlagRead1 | bamFlagSecondary, Seq: "TTTT"},
+		{Name: "read3", Flag: bamFlagPaired | bamFlagRead1 | bamFlagSupplementary, Seq: "GGGG"},
+	}
+	if template, err = splitBAMTemplate(records, ""); err != nil || len(template) != 1 || template[RoleR1].Seq != "ACGT" {
+		t.Errorf("template of secondary records = %+v, %v", template, err)
+	}
+	records = append(records, &BAMRecord{Name: "read3", Flag: bamFlagPaired | bamFlagRead1, Seq: "CCCC"})
+	if template, err = splitBAMTemplate(records, ""); err == nil {
+		t.Errorf("template of two R1 reads = %+v, want an error", template)
+	}
+}
+
+func TestBAMReaderBadSizes(t *testing.T) {
+	le := binary.LittleEndian
+	bgzf := func(data []byte) *bytes.Buffer {
+		var file bytes.Buffer
+		writer := newBGZFWriter(&file)
+		writer.Write(data)
+		writer.Close()
+		return &file
+	}
+	// => headers with no text, or bad text sizes without the text
+	header := func(lText, nRef, lName int32) []byte {
+		data := le.AppendUint32([]byte("BAM\x01"), uint32(lText))
+		data = le.AppendUint32(data, uint32(nRef))
+		return le.AppendUint32(data, uint32(lName))
+	}
+
+	// => header text and reference name sizes
+	for _, data := range [][]byte{header(-1, 0, 0), header(bamMaxSize+1, 0, 0), header(0, -1, 0), header(0, 1, -4), header(0, 1, 0)} {
+		if _, err := newBAMReader(bgzf(data)); err == nil {
+			t.Errorf("newBAMReader(%q) = nil, want an error", data[:min(len(data), 20)])
+		}
+	}
+
+	// => record block sizes
+	for _, blockSize := range []int32{-1, 0, 31, bamMaxSize + 1} {
+		data := le.AppendUint32(header(0, 0, 0)[:12], uint32(blockSize))
+		reader, err := newBAMReader(bgzf(data))
+		if err != nil {
+			t.Fatalf("newBAMReader: %s", err)
+		}
+		if record, err := reader.Read(); err == nil {
+			t.Errorf("record of block size %d = %+v, want an error", blockSize, record)
+		}
+	}
+
+	// => read name and sequence lengths
+	for _, lengths := range [][2]int{{0, 4}, {6, -1}, {6, math.MaxInt32}} {
+		block := encodeBAMRecord("read1", 0, "ACGT", "IIII", nil)[4:]
+		block[8] = byte(lengths[0])
+		le.PutUint32(block[16:20], uint32(int32(lengths[1])))
+		if record, err := decodeBAMRecord(block); err == nil {
+			t.Errorf("record of read name length %d, sequence length %d = %+v, want an error", lengths[0], lengths[1], record)
+		}
+	}
+}
+
+func TestBAMRecordRoundTrip(t *testing.T) {
+	var file bytes.Buffer
+	writer := newBGZFWriter(&file)
+	header := "@HD\tVN:1.6\tSO:unsorted\n@RG\tID:S1\tSM:S1\n"
+	writer.Write(encodeBAMHeader(header))
+
+	tags := []SAMTag{{Tag: "RG", Type: 'Z', Value: "S1"}, {Tag: "XN", Type: 'i', Value: "-7"}}
+	records := []BAMRecord{
+		// => odd length, lower case and unknown bases
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead1, Seq: "ACGTnRX", Qual: "!#%I+5?"},
+		// => no qualities
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead2, Seq: "GGCA", Qual: ""},
+	}
+	for _, record := range records {
+		writer.Write(encodeBAMRecord(record.Name, record.Flag, record.Seq, record.Qual, tags))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("BGZFWriter.Close: %s", err)
+	}
+
+	reader, err := newBAMReader(&file)
+	if err != nil {
+		t.Fatalf("newBAMReader: %s", err)
+	}
+	if reader.Header != header {
+		t.Errorf("header = %q, want %q", reader.Header, header)
+	}
+	want := []BAMRecord{
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead1, Seq: "ACGTNRN", Qual: "!#%I+5?"},
+		{Name: "read1", Flag: bamFlagPaired | bamFlagRead2, Seq: "GGCA", Qual: "IIII"},
+	}
+	for _, want := range want {
+		want.Tags = map[string]string{"RG": "S1", "XN": "-7"}
+		record, err := reader.Read()
+		if err != nil || !reflect.DeepEqual(*record, want) {
+			t.Errorf("record = %+v, %v, want %+v", record, err, want)
+		}
+	}
+	if record, err := reader.Read(); err == nil {
+		t.Errorf("record after the last = %+v, want EOF", record)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * bgzf.go
+ *
+ * => BGZF block-compressed writer, as required for BAM output
+ *
+ */
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// maximum uncompressed bytes per BGZF block; leaves room for incompressible data
+const bgzfBlockSize = 0xff00
+
+// empty BGZF block marking end of file
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// BGZFWriter writes data as a series of BGZF gzip members
+type BGZFWriter struct {
+	writer     io.Writer
+	buf        []byte
+	compressed bytes.Buffer
+	flate      *flate.Writer
+}
+
+// returns a BGZFWriter writing to w
+func newBGZFWriter(w io.Writer) *BGZFWriter {
+	flateWriter, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &BGZFWriter{writer: w, flate: flateWriter}
+}
+
+func (bw *BGZFWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := bgzfBlockSize - len(bw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		bw.buf = append(bw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(bw.buf) == bgzfBlockSize {
+			if err := bw.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush writes any buffered data as a complete BGZF block
+func (bw *BGZFWriter) Flush() error {
+	if len(bw.buf) == 0 {
+		return nil
+	}
+
+	bw.compressed.Reset()
+	bw.flate.Reset(&bw.compressed)
+	if _, err := bw.flate.Write(bw.buf); err != nil {
+		return err
+	}
+	if err := bw.flate.Close(); err != nil {
+		return err
+	}
+
+	// gzip header with the 'BC' extra subfield holding total block size - 1
+	blockSize := 18 + bw.compressed.Len() + 8
+	header := []byte{
+		0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43, 0x02, 0x00,
+		byte(blockSize - 1), byte((blockSize - 1) >> 8),
+	}
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(footer[0:4], crc32.ChecksumIEEE(bw.buf))
+	binary.LittleEndian.PutUint32(footer[4:8], uint32(len(bw.buf)))
+
+	for _, b := range [][]byte{header, bw.compressed.Bytes(), footer} {
+		if _, err := bw.writer.Write(b); err != nil {
+			return err
+		}
+	}
+
+	bw.buf = bw.buf[:0]
+	return nil
+}
+
+// Close flushes buffered data and writes the BGZF EOF marker;
+// the underlying writer is not closed
+func (bw *BGZFWriter) Close() error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := bw.writer.Write(bgzfEOF)
+	return err
+}
@@ -0,0 +1,62 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestBGZFWriter(t *testing.T) {
+	// => incompressible data, over several blocks
+	data := make([]byte, 3*bgzfBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	var file bytes.Buffer
+	writer := newBGZFWriter(&file)
+	for from := 0; from < len(data); from += 1000 {
+		writer.Write(data[from:min(from+1000, len(data))])
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// => each block's 'BC' subfield holds its size - 1, and its data fits
+	blocks := file.Bytes()
+	var sizes []int
+	for len(blocks) > 0 {
+		if len(blocks) < 18 || !bytes.Equal(blocks[:4], []byte{0x1f, 0x8b, 0x08, 0x04}) || string(blocks[12:14]) != "BC" {
+			t.Fatalf("block %d has no BGZF header", len(sizes))
+		}
+		size := int(binary.LittleEndian.Uint16(blocks[16:18])) + 1
+		if size > len(blocks) || size > 0x10000 {
+			t.Fatalf("block %d size %d, with %d bytes left", len(sizes), size, len(blocks))
+		}
+		sizes = append(sizes, int(binary.LittleEndian.Uint32(blocks[size-4:size])))
+		blocks = blocks[size:]
+	}
+	if want := []int{bgzfBlockSize, bgzfBlockSize, bgzfBlockSize, 100, 0}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("block data sizes = %v, want %v", sizes, want)
+	}
+	if !bytes.HasSuffix(file.Bytes(), bgzfEOF) {
+		t.Errorf("no BGZF EOF marker")
+	}
+
+	// => read back as a gzip stream, checking CRCs
+	reader, err := gzip.NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	read, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("read %d bytes, %v, want %d bytes as written", len(read), err, len(data))
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * capture.go
+ *
+ * => second-stage sub-field extraction: the slice matched by hyperscan is
+ *    re-evaluated with a capture regex for the pattern ID, eg:
+ *
+ *	0001:/ACGT(?P<umi>.{10})TTTT/
+ *
+ * => named groups are available as '{cap:<name>}' header placeholders;
+ *    groups named like a SAM tag (eg: 'CB', 'RX') are written as BAM/SAM tags
+ *
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SAM tag name, for capture groups written as tags
+var reSAMTagName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]$`)
+
+// Capture = a named sub-field extracted from a match
+type Capture struct {
+	Name, Value string
+	// offset of the value in the read; -1 if the group didn't participate
+	// => for reverse strand hits, Value is reverse complemented, From is
+	// still where it starts in the read
+	From int
+}
+
+// captureRegexes from the '-capture' file, by pattern ID
+var captureRegexes = make(map[uint]*regexp.Regexp)
+
+// reads a capture regex file; expecting "<pattern ID>:<regex>" per line, the
+// regex optionally as "/regex/flags" where flag 'i' is honored and others
+// are ignored; blank lines and lines starting with '#' are skipped
+func readCaptureFile(filename string) map[uint]*regexp.Regexp {
+	regexes := make(map[uint]*regexp.Regexp)
+
+	file, err := os.Open(filename)
+	checkErr(err, fmt.Sprintf("Can't read capture file '%s'", filename))
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) < 2 {
+			log.Fatal(fmt.Sprintf("Expected pattern ID and capture regex at capture file line %d", lineno))
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		checkErr(err, fmt.Sprintf("Could not parse id at capture file line %d, %s", lineno, err))
+
+		expr := fields[1]
+		if strings.HasPrefix(expr, "/") && strings.LastIndex(expr, "/") > 0 {
+			end := strings.LastIndex(expr, "/")
+			if strings.Contains(expr[end+1:], "i") {
+				expr = "(?i)" + expr[1:end]
+			} else {
+				expr = expr[1:end]
+			}
+		}
+
+		regex, err := regexp.Compile(expr)
+		checkErr(err, fmt.Sprintf("Could not parse capture regex at capture file line %d, %s", lineno, err))
+		if len(regex.SubexpNames()) < 2 {
+			log.Fatal(fmt.Sprintf("Capture regex at capture file line %d has no groups", lineno))
+		}
+
+		regexes[uint(id)] = regex
+	}
+	checkErr(scanner.Err(), fmt.Sprintf("Can't read capture file '%s'", filename))
+
+	return regexes
+}
+
+// returns the sub-fields captured from a match at offset in a read by the
+// capture regex of a pattern ID; unnamed groups are named by number; ok is
+// false if the ID has a capture regex that doesn't match; if reverse, match
+// is the reverse complement of the read at offset, and capture offsets are
+// mapped back to the read
+func captureFields(id uint, match string, offset int, reverse bool) (captures []Capture, ok bool) {
+	regex, exists := captureRegexes[id]
+	if !exists {
+		return nil, true
+	}
+
+	m := regex.FindStringSubmatchIndex(match)
+	if m == nil {
+		return nil, false
+	}
+	for i, name := range regex.SubexpNames()[1:] {
+		if name == "" {
+			name = fmt.Sprint(i + 1)
+		}
+		capture := Capture{Name: name, From: -1}
+		if start, end := m[2*i+2], m[2*i+3]; start >= 0 {
+			capture.Value, capture.From = match[start:end], offset+start
+			if reverse {
+				capture.From = offset + len(match) - end
+			}
+		}
+		captures = append(captures, capture)
+	}
+	return captures, true
+}
+
+// returns the value of a named capture, or "" if there is none
+func captureValue(captures []Capture, name string) string {
+	for _, capture := range captures {
+		if capture.Name == name {
+			return capture.Value
+		}
+	}
+	return ""
+}
+
+// returns captures as "name=value" pairs, ';' separated
+func formatCaptures(captures []Capture) string {
+	var pairs []string
+	for _, capture := range captures {
+		pairs = append(pairs, capture.Name+"="+capture.Value)
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,99 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestReadCaptureFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.txt")
+	text := "# id:regex\n\n1:/acgt(?P<umi>.{4})/i\n2:T(?P<CB>A+)(C)\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	regexes := readCaptureFile(filename)
+	if len(regexes) != 2 {
+		t.Fatalf("read %d capture regexes, want 2", len(regexes))
+	}
+	if got := regexes[1].String(); got != "(?i)acgt(?P<umi>.{4})" {
+		t.Errorf("regex 1 = %q, want the 'i' flag as (?i)", got)
+	}
+	if got := regexes[2].String(); got != "T(?P<CB>A+)(C)" {
+		t.Errorf("regex 2 = %q, want it unchanged", got)
+	}
+
+	for _, bad := range []string{"1\n", "x:A(C)\n", "1:A(C\n", "1:ACGT\n"} {
+		if err := os.WriteFile(filename, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expectFatal(t, "capture file "+bad, func() { readCaptureFile(filename) })
+	}
+}
+
+func TestCaptureFields(t *testing.T) {
+	regexes := captureRegexes
+	captureRegexes = map[uint]*regexp.Regexp{1: regexp.MustCompile(`T(?P<CB>A+)(C)`)}
+	defer func() { captureRegexes = regexes }()
+
+	captures, ok := captureFields(1, "GTAAACG", 10, false)
+	want := []Capture{{Name: "CB", Value: "AAA", From: 12}, {Name: "2", Value: "C", From: 15}}
+	if !ok || !reflect.DeepEqual(captures, want) {
+		t.Errorf("captureFields = %v, %v, want %v, true", captures, ok, want)
+	}
+	// => reverse strand offsets are where the value starts in the read
+	captures, _ = captureFields(1, "GTAAACG", 10, true)
+	if captures[0].From != 12 || captures[1].From != 11 {
+		t.Errorf("reverse strand capture offsets = %d, %d, want 12, 11", captures[0].From, captures[1].From)
+	}
+	if captures, ok := captureFields(1, "GGGG", 0, false); ok || captures != nil {
+		t.Errorf("captureFields without a match = %v, %v, want nil, false", captures, ok)
+	}
+	if captures, ok := captureFields(2, "GGGG", 0, false); !ok || captures != nil {
+		t.Errorf("captureFields without a regex = %v, %v, want nil, true", captures, ok)
+	}
+
+	if got := captureValue(want, "2"); got != "C" {
+		t.Errorf("captureValue = %q, want \"C\"", got)
+	}
+	if got := captureValue(want, "umi"); got != "" {
+		t.Errorf("captureValue of a missing name = %q, want \"\"", got)
+	}
+	if got := formatCaptures(want); got != "CB=AAA;2=C" {
+		t.Errorf("formatCaptures = %q, want \"CB=AAA;2=C\"", got)
+	}
+}
+
+func TestCaptureOutput(t *testing.T) {
+	record := OutputRecord{
+		ReadID:   "r1",
+		ID:       3,
+		MatchSeq: "TAAAC",
+		Captures: []Capture{{Name: "BC", Value: "AAA"}, {Name: "CB", Value: "TTT"}, {Name: "umi", Value: "GG"}},
+	}
+
+	if got := parseHeaderTemplate("{cap:umi} {cap:none}").header(record); got != "@r1 GG" {
+		t.Errorf("header = %q, want \"@r1 GG\"", got)
+	}
+	expectFatal(t, "a capture placeholder without a name", func() { parseHeaderTemplate("{cap}") })
+	expectFatal(t, "a named placeholder that isn't a capture", func() { parseHeaderTemplate("{id:x}") })
+
+	tags := make(map[string]string)
+	for _, tag := range samTags(record) {
+		tags[tag.Tag] = tag.Value
+	}
+	if tags["BC"] != "AAA" || tags["CB"] != "TTT" {
+		t.Errorf("BC, CB tags = %q, %q, want the captured \"AAA\", \"TTT\"", tags["BC"], tags["CB"])
+	}
+	if _, ok := tags["umi"]; ok {
+		t.Error("a capture not named like a SAM tag was written as a tag")
+	}
+}
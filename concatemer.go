@@ -0,0 +1,157 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * concatemer.go
+ *
+ * => with '-split', reads are split at barcode hits into segments, eg: for
+ *    concatenated or chimeric long-read amplicons; each segment starts at its
+ *    hit (the first one also has the read's 5' end), and is written to its
+ *    hit's sample as '<read>_seg<N>'
+ *
+ * => reads with segments naming more than one sample are counted as chimeras
+ *
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Segment = a read segment and the hit it's assigned by
+type Segment struct {
+	Hit Hit
+	// [From,To) region of the read
+	Window KeepWindow
+}
+
+// checks '-split' against other flags and the patterns; segments start at
+// match start offsets, so every pattern needs the 'L' flag
+func checkSplitFlags(patternFile string) {
+	switch {
+	case *flagRounds != "":
+		log.Fatal("Splitting reads ('-split') can't be used with split-pool barcode rounds ('-rounds')!")
+	case *flagMateTrim != "":
+		log.Fatal("Splitting reads ('-split') can't be used with mate trim rules ('-mate-trim')!")
+	case *flagReadStructure != "":
+		log.Fatal("Splitting reads ('-split') can't be used with read structures ('-rs')!")
+	case *flagSwapMates:
+		log.Fatal("Splitting reads ('-split') can't be used with mate swapping ('-swap-mates')!")
+	}
+	if patternFile == "" {
+		return
+	}
+	for _, pattern := range parseFile(patternFile) {
+		if !pattern.hasFlag('L') {
+			log.Fatal(fmt.Sprintf("Splitting reads ('-split') needs match start offsets; pattern ID %d doesn't have the 'L' flag!", pattern.ID))
+		}
+	}
+}
+
+// returns the hit distance for tie-breaking overlapping hits; 0 if not verified
+func hitDistance(hit Hit) int {
+	if hit.Edits == nil {
+		return 0
+	}
+	return hit.Edits.Distance()
+}
+
+// returns the hits a read is split at, in read order: of overlapping hits,
+// the one ending first is kept, ties broken by distance then scan order
+func splitHits(hits []Hit, role ReadRole) []Hit {
+	var roleHits []Hit
+	for _, hit := range hits {
+		if hit.Role == role {
+			roleHits = append(roleHits, hit)
+		}
+	}
+	sort.SliceStable(roleHits, func(i, j int) bool {
+		if roleHits[i].To != roleHits[j].To {
+			return roleHits[i].To < roleHits[j].To
+		}
+		return hitDistance(roleHits[i]) < hitDistance(roleHits[j])
+	})
+
+	var split []Hit
+	for _, hit := range roleHits {
+		if len(split) > 0 && hit.From < split[len(split)-1].To {
+			continue
+		}
+		split = append(split, hit)
+	}
+	return split
+}
+
+// returns the segments of a read of length n split at hits
+func readSegments(hits []Hit, n int) []Segment {
+	segments := make([]Segment, len(hits))
+	for i, hit := range hits {
+		from, to := int(hit.From), n
+		if i == 0 {
+			from = 0
+		}
+		if i+1 < len(hits) {
+			to = int(hits[i+1].From)
+		}
+		segments[i] = Segment{Hit: hit, Window: KeepWindow{from, to}}
+	}
+	return segments
+}
+
+// returns a FASTQ header line with '_seg<n>' appended to the read ID
+func segmentName(name string, n int) string {
+	readID := getReadID(name)
+	return "@" + readID + fmt.Sprintf("_seg%d", n) + name[1+len(readID):]
+}
+
+// makes and writes the output for each segment of the reads in a read set
+func emitSegments(records []FASTQRecord, hits []Hit) {
+	var outputs []HitOutput
+	for _, record := range records {
+		split := splitHits(hits, record.Role)
+		for i, segment := range readSegments(split, len(strings.TrimSpace(record.Seq))) {
+			output := hitOutput(segment.Hit, record, segment.Window)
+			output.Record.Name = segmentName(record.Name, i+1)
+			output.Record.ReadID = getReadID(output.Record.Name)
+			outputs = append(outputs, output)
+		}
+	}
+	if skipRevCompInvalid() {
+		return
+	}
+
+	for _, output := range outputs {
+		if *flagMinLen > 0 && len(output.Record.Seq) < *flagMinLen {
+			runStats.TooShort++
+			if *flagShort == "drop" {
+				continue
+			}
+			output.Record.Bin = shortBinName
+		}
+		emitHitOutput(output)
+	}
+}
+
+// adds the segments of the reads in a read set to the split stats
+func (stats *StatsCollector) addSegments(records []FASTQRecord, hits []Hit) {
+	for _, record := range records {
+		split := splitHits(hits, record.Role)
+		if len(split) == 0 {
+			continue
+		}
+		stats.Segments += len(split)
+		for _, hit := range split {
+			stats.SegmentSamples[hitSample(hit)]++
+		}
+		if !sameSample(split) {
+			stats.Chimeras++
+		}
+	}
+}
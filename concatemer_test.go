@@ -0,0 +1,87 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitHits(t *testing.T) {
+	hits := []Hit{
+		{ID: 3, Role: RoleR1, From: 20, To: 28},
+		// => overlapping hits: the one ending first is kept
+		{ID: 1, Role: RoleR1, From: 0, To: 8},
+		{ID: 2, Role: RoleR1, From: 2, To: 10},
+		// => hits of other reads are ignored
+		{ID: 4, Role: RoleR2, From: 12, To: 16},
+		// => overlapping hits ending together: the closer one is kept
+		{ID: 5, Role: RoleR1, From: 40, To: 48, Edits: &Edits{Mismatches: 2}},
+		{ID: 6, Role: RoleR1, From: 41, To: 48, Edits: &Edits{Deletions: 1}},
+		// => adjacent hits don't overlap
+		{ID: 7, Role: RoleR1, From: 48, To: 56},
+	}
+	var ids []uint
+	for _, hit := range splitHits(hits, RoleR1) {
+		ids = append(ids, hit.ID)
+	}
+	if want := []uint{1, 3, 6, 7}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("split at hits of IDs %v, want %v", ids, want)
+	}
+	if split := splitHits(hits, RoleI1); len(split) != 0 {
+		t.Errorf("split a read without hits at %+v", split)
+	}
+}
+
+func TestReadSegments(t *testing.T) {
+	hits := []Hit{{ID: 1, From: 4, To: 8}, {ID: 2, From: 12, To: 16}, {ID: 1, From: 30, To: 34}}
+	var windows []KeepWindow
+	for _, segment := range readSegments(hits, 40) {
+		windows = append(windows, segment.Window)
+	}
+	// => the first segment has the read's 5' end, each other starts at its hit
+	if want := []KeepWindow{{0, 12}, {12, 30}, {30, 40}}; !reflect.DeepEqual(windows, want) {
+		t.Errorf("segment windows = %v, want %v", windows, want)
+	}
+
+	// => segments are written from their window
+	record := FASTQRecord{Name: "@read1 1:N:0", Seq: "AAAACCCCGGGGTTTTACGT\n", Qual: "ABCDEFGHIJKLMNOPQRST\n", Role: RoleR1}
+	var seqs []string
+	for _, segment := range readSegments([]Hit{{ID: 1, From: 4, To: 8}, {ID: 2, From: 12, To: 16}}, 20) {
+		seqs = append(seqs, hitOutput(segment.Hit, record, segment.Window).Record.Seq)
+	}
+	if want := []string{"AAAACCCCGGGG", "TTTTACGT"}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("segments = %v, want %v", seqs, want)
+	}
+}
+
+func TestSegmentName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"@read1 1:N:0:ACGT", "@read1_seg2 1:N:0:ACGT"},
+		{"@read1", "@read1_seg2"},
+	}
+	for _, test := range tests {
+		if got := segmentName(test.name, 2); got != test.want {
+			t.Errorf("segmentName(%s) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSegmentStats(t *testing.T) {
+	stats := newStatsCollector()
+	records := []FASTQRecord{{Role: RoleR1}, {Role: RoleR2}}
+
+	// => R1 is chimeric, R2 has two segments of one sample
+	stats.addSegments(records, []Hit{
+		{ID: 1, Role: RoleR1, From: 0, To: 4}, {ID: 2, Role: RoleR1, From: 10, To: 14},
+		{ID: 1, Role: RoleR2, From: 0, To: 4}, {ID: 1, Role: RoleR2, From: 10, To: 14},
+	})
+	if stats.Segments != 4 || stats.Chimeras != 1 || !reflect.DeepEqual(stats.SegmentSamples, map[string]int{"1": 3, "2": 1}) {
+		t.Errorf("segments %d, chimeras %d, samples %v, want 4, 1, map[1:3 2:1]", stats.Segments, stats.Chimeras, stats.SegmentSamples)
+	}
+}
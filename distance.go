@@ -0,0 +1,169 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * distance.go
+ *
+ * => post-verification of approximate matches: hyperscan only reports that a
+ *    '{edit_distance=N}' or '{hamming_distance=N}' pattern matched, so the
+ *    matched span is aligned against the pattern's nominal sequence to count
+ *    the actual mismatches and indels
+ * => only patterns with a literal nucleotide expression have a nominal
+ *    sequence; 'N' in the pattern matches any base
+ * => when a read set's hits name more than one sample, the hits with the
+ *    lowest distance break the tie
+ *
+ */
+
+import (
+	"regexp"
+	"strings"
+)
+
+// literal nucleotide pattern expression
+var reNominalSeq = regexp.MustCompile(`^[ACGTNacgtn]+$`)
+
+// NominalPattern = the literal sequence of a pattern, for verifying matches
+type NominalPattern struct {
+	Seq string
+	// => substitutions only, '{hamming_distance=N}'
+	Hamming bool
+}
+
+// Edits = the differences between a match and its pattern's nominal sequence
+type Edits struct {
+	Mismatches, Insertions, Deletions int
+}
+
+// nominalPatterns from the pattern file, by pattern ID
+var nominalPatterns = make(map[uint]NominalPattern)
+
+// returns the nominal sequences of the literal patterns in a pattern file
+func getNominalPatterns(patterns []*Pattern) map[uint]NominalPattern {
+	nominals := make(map[uint]NominalPattern)
+	for _, pattern := range patterns {
+		if !reNominalSeq.MatchString(pattern.Expression) {
+			continue
+		}
+		nominals[pattern.ID] = NominalPattern{
+			Seq:     strings.ToUpper(pattern.Expression),
+			Hamming: pattern.HammingDistance > 0 && pattern.EditDistance == 0,
+		}
+	}
+	return nominals
+}
+
+// returns the distance, ie: the total number of edits
+func (edits Edits) Distance() int {
+	return edits.Mismatches + edits.Insertions + edits.Deletions
+}
+
+// returns true if base a in a read matches base b in a pattern
+func baseMatches(a, b byte) bool {
+	return b == 'N' || a&^0x20 == b
+}
+
+// returns the edits of a match against a pattern ID's nominal sequence; ok
+// is false if the pattern doesn't have one
+func verifyMatch(id uint, match string) (edits Edits, ok bool) {
+	nominal, ok := nominalPatterns[id]
+	if !ok {
+		return Edits{}, false
+	}
+	if nominal.Hamming && len(match) == len(nominal.Seq) {
+		for i := 0; i < len(match); i++ {
+			if !baseMatches(match[i], nominal.Seq[i]) {
+				edits.Mismatches++
+			}
+		}
+		return edits, true
+	}
+	return alignEdits(nominal.Seq, match), true
+}
+
+// returns the edits of the best alignment of the whole pattern to a suffix
+// of the matched span; the leftmost start reported for an approximate match
+// may include bases that aren't part of the best alignment
+func alignEdits(pattern, match string) Edits {
+	m, n := len(pattern), len(match)
+
+	// => d[i][j] = distance of pattern[:i] against a suffix of match[:j]
+	d := make([][]int, m+1)
+	for i := range d {
+		d[i] = make([]int, n+1)
+		d[i][0] = i
+	}
+	for i := 1; i <= m; i++ {
+		for j := 1; j <= n; j++ {
+			cost := 1
+			if baseMatches(match[j-1], pattern[i-1]) {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j-1]+cost, d[i-1][j]+1, d[i][j-1]+1)
+		}
+	}
+
+	// => trace back from the end of the span, preferring substitutions
+	var edits Edits
+	i, j := m, n
+	for i > 0 {
+		cost := 1
+		if j > 0 && baseMatches(match[j-1], pattern[i-1]) {
+			cost = 0
+		}
+		switch {
+		case j > 0 && d[i][j] == d[i-1][j-1]+cost:
+			edits.Mismatches += cost
+			i, j = i-1, j-1
+		case d[i][j] == d[i-1][j]+1:
+			// => pattern base missing from the read
+			edits.Deletions++
+			i--
+		default:
+			// => extra base in the read
+			edits.Insertions++
+			j--
+		}
+	}
+	return edits
+}
+
+// returns the lowest distance of the verified hits, and false if any hit
+// isn't verified
+func bestDistance(hits []Hit) (int, bool) {
+	best := -1
+	for _, hit := range hits {
+		if hit.Edits == nil {
+			return 0, false
+		}
+		if best < 0 || hit.Edits.Distance() < best {
+			best = hit.Edits.Distance()
+		}
+	}
+	return best, best >= 0
+}
+
+// returns the hits a read set is assigned by: all of them, unless they name
+// more than one sample and are all verified, then those with the lowest
+// distance
+func bestHits(hits []Hit) []Hit {
+	if len(hits) < 2 || sameSample(hits) {
+		return hits
+	}
+	best, ok := bestDistance(hits)
+	if !ok {
+		return hits
+	}
+
+	var kept []Hit
+	for _, hit := range hits {
+		if hit.Edits.Distance() == best {
+			kept = append(kept, hit)
+		}
+	}
+	return kept
+}
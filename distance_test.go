@@ -0,0 +1,95 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlignEdits(t *testing.T) {
+	tests := []struct {
+		pattern, match string
+		want           Edits
+	}{
+		{"ACGTACGT", "ACGTACGT", Edits{}},
+		{"ACGTACGT", "acgtacgt", Edits{}},
+		{"ACGNACGT", "ACGGACGT", Edits{}},
+		{"ACGTACGT", "ACGAACGT", Edits{Mismatches: 1}},
+		{"ACGTACGT", "ACGTTACGT", Edits{Insertions: 1}},
+		{"ACGTACGT", "ACGACGT", Edits{Deletions: 1}},
+		// => a leading base before the best alignment isn't an edit
+		{"ACGTACGT", "GACGTACGT", Edits{}},
+	}
+	for _, test := range tests {
+		if got := alignEdits(test.pattern, test.match); got != test.want {
+			t.Errorf("alignEdits(%s, %s) = %+v, want %+v", test.pattern, test.match, got, test.want)
+		}
+	}
+}
+
+func TestVerifyMatch(t *testing.T) {
+	nominals := nominalPatterns
+	defer func() { nominalPatterns = nominals }()
+	nominalPatterns = map[uint]NominalPattern{
+		1: {Seq: "ACGTACGT"},
+		2: {Seq: "ACGTACGT", Hamming: true},
+	}
+
+	// => a Hamming pattern counts substitutions only, position by position
+	if edits, ok := verifyMatch(2, "TCGTACGA"); !ok || edits != (Edits{Mismatches: 2}) {
+		t.Errorf("verifyMatch(2, TCGTACGA) = %+v, %t, want 2 mismatches", edits, ok)
+	}
+	if edits, ok := verifyMatch(1, "ACGTTACGT"); !ok || edits.Distance() != 1 {
+		t.Errorf("verifyMatch(1, ACGTTACGT) = %+v, %t, want distance 1", edits, ok)
+	}
+	if _, ok := verifyMatch(3, "ACGT"); ok {
+		t.Errorf("verified a match of a pattern without a nominal sequence")
+	}
+}
+
+func TestBestHits(t *testing.T) {
+	exact, oneEdit := &Edits{}, &Edits{Mismatches: 1}
+	hits := []Hit{{ID: 1, Edits: oneEdit}, {ID: 2, Edits: exact}, {ID: 3, Edits: exact}}
+	if got := bestHits(hits); !reflect.DeepEqual(got, hits[1:]) {
+		t.Errorf("bestHits = %+v, want the exact hits", got)
+	}
+
+	// => hits aren't tie-broken if any isn't verified
+	hits[2].Edits = nil
+	if got := bestHits(hits); !reflect.DeepEqual(got, hits) {
+		t.Errorf("bestHits with a hit not verified = %+v, want all", got)
+	}
+	if distance, ok := bestDistance(hits[:2]); !ok || distance != 0 {
+		t.Errorf("bestDistance = %d, %t, want 0, true", distance, ok)
+	}
+}
+
+func TestScanMatchAtReadEnd(t *testing.T) {
+	patterns := testPatterns(t, "1:/AAA./sL", "2:/AAAC/L{hamming_distance=1}")
+	matcher, err := newGoMatcher(patterns)
+	if err != nil {
+		t.Fatalf("couldn't build matcher: %s", err)
+	}
+	nominals := nominalPatterns
+	nominalPatterns = getNominalPatterns(patterns)
+	t.Cleanup(func() { nominalPatterns = nominals })
+
+	// => both patterns match the "\n" terminating the read; hits end with the read
+	readSetHits = readSetHits[:0]
+	scanFastqRecord(matcher, FASTQRecord{Seq: "GGAAA\n", Qual: "IIIII\n", Role: RoleR1})
+	if len(readSetHits) != 2 {
+		t.Fatalf("hits = %+v, want 2", readSetHits)
+	}
+	for _, hit := range readSetHits {
+		if hit.From != 2 || hit.To != 5 || hit.MatchSeq != "AAA" || hit.MatchQual != "III" {
+			t.Errorf("hit = %+v, want AAA at 2-5", hit)
+		}
+	}
+	if edits := readSetHits[1].Edits; edits == nil || edits.Distance() != 1 {
+		t.Errorf("edits = %+v, want distance 1", edits)
+	}
+}
@@ -0,0 +1,659 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * gomatcher.go
+ *
+ * => pure-Go matching engine, reporting matches as Hyperscan does in block
+ *    mode: every end offset at which a pattern matches, with the leftmost
+ *    start for patterns with the 'L' flag (otherwise 0)
+ * => patterns are split by kind:
+ *
+ *	literal expressions               Aho-Corasick automaton
+ *	literals with edit_distance       Myers' bit-parallel algorithm
+ *	literals with hamming_distance    bit-parallel shift-and with mismatches
+ *	other expressions                 Go regexp program, run in one pass
+ *
+ * => supported subset: flags 'i', 's', 'm', 'H', 'L', 'V' ('8', 'W' and 'P'
+ *    are ignored); all extensions; RE2 syntax only, without word boundary
+ *    assertions
+ *
+ */
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// errScanTerminated = returned by Scan when a match handler returns an error,
+// as for hyperscan.ErrScanTerminated
+var errScanTerminated = errors.New("scan terminated by match handler")
+
+// goMatch = a single match of a pattern
+type goMatch struct {
+	// index of the pattern in the matcher
+	pattern  int
+	from, to uint64
+}
+
+// goMatcher = pure-Go engine over a parsed pattern set; read-only once
+// built, so it's shared by its clones
+type goMatcher struct {
+	patterns []*Pattern
+	literals *acAutomaton
+	approx   []*approxPattern
+	regexes  []*regexPattern
+}
+
+// returns a matcher for a pattern set, or an error for patterns outside the
+// supported subset
+func newGoMatcher(patterns []*Pattern) (*goMatcher, error) {
+	matcher := &goMatcher{patterns: patterns}
+	var literals []int
+
+	for i, pattern := range patterns {
+		if pattern.Expression == "" {
+			return nil, fmt.Errorf("pattern %d: empty expression", pattern.ID)
+		}
+		literal := regexp.QuoteMeta(pattern.Expression) == pattern.Expression
+
+		switch {
+		case pattern.EditDistance > 0 && pattern.HammingDistance > 0:
+			return nil, fmt.Errorf("pattern %d: edit_distance and hamming_distance can't both be set", pattern.ID)
+		case pattern.EditDistance > 0 || pattern.HammingDistance > 0:
+			if !literal {
+				return nil, fmt.Errorf("pattern %d: approximate matching of non-literal expressions isn't supported by the pure-Go engine", pattern.ID)
+			}
+			approx, err := newApproxPattern(i, pattern)
+			if err != nil {
+				return nil, err
+			}
+			matcher.approx = append(matcher.approx, approx)
+		case literal:
+			literals = append(literals, i)
+		default:
+			regex, err := newRegexPattern(i, pattern)
+			if err != nil {
+				return nil, err
+			}
+			matcher.regexes = append(matcher.regexes, regex)
+		}
+	}
+
+	if len(literals) > 0 {
+		matcher.literals = newACAutomaton(patterns, literals)
+	}
+	return matcher, nil
+}
+
+// reports each match in data to handler, by end offset
+func (matcher *goMatcher) Scan(data []byte, handler MatchHandler, context interface{}) error {
+	var matches []goMatch
+	if matcher.literals != nil {
+		matches = matcher.literals.scan(data, matches)
+	}
+	for _, approx := range matcher.approx {
+		matches = approx.scan(data, matches)
+	}
+	for _, regex := range matcher.regexes {
+		matches = regex.scan(data, matches)
+	}
+
+	for _, match := range matcher.filter(matches) {
+		pattern := matcher.patterns[match.pattern]
+		from := uint64(0)
+		if pattern.hasFlag('L') {
+			from = match.from
+		}
+		if err := handler(pattern.ID, from, match.to, 0, context); err != nil {
+			return errScanTerminated
+		}
+	}
+	return nil
+}
+
+// returns the matches passing the extensions and single match flags, by end
+// offset and ID; matches of one ID at one end offset are reported once, with
+// the leftmost start
+func (matcher *goMatcher) filter(matches []goMatch) []goMatch {
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.to != b.to {
+			return a.to < b.to
+		}
+		if idA, idB := matcher.patterns[a.pattern].ID, matcher.patterns[b.pattern].ID; idA != idB {
+			return idA < idB
+		}
+		return a.from < b.from
+	})
+
+	var kept []goMatch
+	reported := make(map[int]bool)
+	for _, match := range matches {
+		pattern := matcher.patterns[match.pattern]
+		switch {
+		case match.to < pattern.MinOffset:
+			continue
+		case pattern.MaxOffset > 0 && match.to > pattern.MaxOffset:
+			continue
+		case match.to-match.from < pattern.MinLength:
+			continue
+		case pattern.hasFlag('H') && reported[match.pattern]:
+			continue
+		}
+		if n := len(kept); n > 0 && kept[n-1].to == match.to && matcher.patterns[kept[n-1].pattern].ID == pattern.ID {
+			continue
+		}
+		reported[match.pattern] = true
+		kept = append(kept, match)
+	}
+	return kept
+}
+
+// returns a matcher sharing the patterns; the engine has no scratch space
+func (matcher *goMatcher) Clone() (Matcher, error) {
+	return matcher, nil
+}
+
+// nothing to free
+func (matcher *goMatcher) Close() {}
+
+// returns a byte lowercased, for caseless matching
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// acNode = an Aho-Corasick automaton state
+type acNode struct {
+	next map[byte]int
+	fail int
+	// indices of the patterns ending at this state, including by fail links
+	out []int
+}
+
+// acAutomaton = Aho-Corasick automaton over the literal patterns; built on
+// lowercased literals, case-sensitive matches are checked when found
+type acAutomaton struct {
+	patterns []*Pattern
+	nodes    []acNode
+}
+
+// returns an automaton for the literal patterns at indices
+func newACAutomaton(patterns []*Pattern, indices []int) *acAutomaton {
+	ac := &acAutomaton{patterns: patterns, nodes: []acNode{{next: make(map[byte]int)}}}
+
+	for _, i := range indices {
+		state := 0
+		for _, c := range []byte(strings.ToLower(patterns[i].Expression)) {
+			next, ok := ac.nodes[state].next[c]
+			if !ok {
+				next = len(ac.nodes)
+				ac.nodes = append(ac.nodes, acNode{next: make(map[byte]int)})
+				ac.nodes[state].next[c] = next
+			}
+			state = next
+		}
+		ac.nodes[state].out = append(ac.nodes[state].out, i)
+	}
+
+	// => fail links, breadth-first
+	queue := []int{}
+	for _, next := range ac.nodes[0].next {
+		queue = append(queue, next)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, next := range ac.nodes[state].next {
+			fail := ac.nodes[state].fail
+			for fail > 0 {
+				if _, ok := ac.nodes[fail].next[c]; ok {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			if target, ok := ac.nodes[fail].next[c]; ok && target != next {
+				ac.nodes[next].fail = target
+			}
+			ac.nodes[next].out = append(ac.nodes[next].out, ac.nodes[ac.nodes[next].fail].out...)
+			queue = append(queue, next)
+		}
+	}
+	return ac
+}
+
+// appends the literal matches in data to matches
+func (ac *acAutomaton) scan(data []byte, matches []goMatch) []goMatch {
+	state := 0
+	for j, b := range data {
+		c := lowerByte(b)
+		for {
+			if next, ok := ac.nodes[state].next[c]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+
+		for _, i := range ac.nodes[state].out {
+			pattern := ac.patterns[i]
+			from := j + 1 - len(pattern.Expression)
+			if !pattern.hasFlag('i') && string(data[from:j+1]) != pattern.Expression {
+				continue
+			}
+			matches = append(matches, goMatch{i, uint64(from), uint64(j + 1)})
+		}
+	}
+	return matches
+}
+
+// approxPattern = a literal pattern matched within an edit or Hamming distance
+type approxPattern struct {
+	index   int
+	seq     []byte
+	caseful bool
+	k       int
+	hamming bool
+	// bit masks of the pattern positions matching each byte
+	peq [256]uint64
+}
+
+// returns an approximate pattern for the pattern at index
+func newApproxPattern(index int, pattern *Pattern) (*approxPattern, error) {
+	approx := &approxPattern{
+		index:   index,
+		seq:     []byte(pattern.Expression),
+		caseful: !pattern.hasFlag('i'),
+		k:       int(pattern.EditDistance),
+		hamming: pattern.HammingDistance > 0,
+	}
+	if approx.hamming {
+		approx.k = int(pattern.HammingDistance)
+	}
+	if approx.k >= len(approx.seq) {
+		return nil, fmt.Errorf("pattern %d: distance %d allows empty or vacuous matches", pattern.ID, approx.k)
+	}
+
+	for c := 0; c < 256; c++ {
+		for i := 0; i < len(approx.seq) && i < 64; i++ {
+			if approx.equal(byte(c), approx.seq[i]) {
+				approx.peq[c] |= 1 << uint(i)
+			}
+		}
+	}
+	return approx, nil
+}
+
+// returns true if a data byte matches a pattern byte
+func (approx *approxPattern) equal(c, p byte) bool {
+	if approx.caseful {
+		return c == p
+	}
+	return lowerByte(c) == lowerByte(p)
+}
+
+// appends the matches in data to matches
+func (approx *approxPattern) scan(data []byte, matches []goMatch) []goMatch {
+	var ends []int
+	switch {
+	case approx.hamming && len(approx.seq) <= 64:
+		ends = approx.hammingEnds(data)
+	case approx.hamming:
+		ends = approx.hammingEndsSlow(data)
+	case len(approx.seq) <= 64:
+		ends = approx.editEnds(data)
+	default:
+		ends = approx.editEndsSlow(data)
+	}
+
+	for _, end := range ends {
+		from := end - len(approx.seq)
+		if !approx.hamming {
+			from = approx.leftmostStart(data, end)
+		}
+		matches = append(matches, goMatch{approx.index, uint64(from), uint64(end)})
+	}
+	return matches
+}
+
+// returns the end offsets of matches within the Hamming distance; shift-and
+// with a state vector per number of mismatches
+func (approx *approxPattern) hammingEnds(data []byte) []int {
+	var ends []int
+	m := len(approx.seq)
+	last := uint64(1) << uint(m-1)
+	states := make([]uint64, approx.k+1)
+
+	for j, c := range data {
+		previous := states[0]
+		states[0] = (states[0]<<1 | 1) & approx.peq[c]
+		for d := 1; d <= approx.k; d++ {
+			state := states[d]
+			states[d] = (states[d]<<1|1)&approx.peq[c] | (previous<<1 | 1)
+			previous = state
+		}
+		if j+1 >= m && states[approx.k]&last != 0 {
+			ends = append(ends, j+1)
+		}
+	}
+	return ends
+}
+
+// returns the end offsets of matches within the Hamming distance, for
+// patterns longer than 64
+func (approx *approxPattern) hammingEndsSlow(data []byte) []int {
+	var ends []int
+	m := len(approx.seq)
+	for end := m; end <= len(data); end++ {
+		mismatches := 0
+		for i := 0; i < m && mismatches <= approx.k; i++ {
+			if !approx.equal(data[end-m+i], approx.seq[i]) {
+				mismatches++
+			}
+		}
+		if mismatches <= approx.k {
+			ends = append(ends, end)
+		}
+	}
+	return ends
+}
+
+// returns the end offsets of matches within the edit distance; Myers'
+// bit-vector algorithm, with a free start in data
+func (approx *approxPattern) editEnds(data []byte) []int {
+	var ends []int
+	m := len(approx.seq)
+	last := uint64(1) << uint(m-1)
+	pv, mv, score := ^uint64(0), uint64(0), m
+
+	for j, c := range data {
+		eq := approx.peq[c]
+		xv := eq | mv
+		xh := ((eq & pv) + pv) ^ pv | eq
+		ph := mv | ^(xh | pv)
+		mh := pv & xh
+		if ph&last != 0 {
+			score++
+		} else if mh&last != 0 {
+			score--
+		}
+		ph <<= 1
+		mh <<= 1
+		pv = mh | ^(xv | ph)
+		mv = ph & xv
+		if score <= approx.k {
+			ends = append(ends, j+1)
+		}
+	}
+	return ends
+}
+
+// returns the end offsets of matches within the edit distance, for patterns
+// longer than 64; one dynamic programming column per data byte
+func (approx *approxPattern) editEndsSlow(data []byte) []int {
+	var ends []int
+	m := len(approx.seq)
+	column := make([]int, m+1)
+	for i := range column {
+		column[i] = i
+	}
+
+	for j, c := range data {
+		diagonal := column[0]
+		for i := 1; i <= m; i++ {
+			cost := 1
+			if approx.equal(c, approx.seq[i-1]) {
+				cost = 0
+			}
+			above := column[i]
+			column[i] = min(diagonal+cost, column[i-1]+1, above+1)
+			diagonal = above
+		}
+		if column[m] <= approx.k {
+			ends = append(ends, j+1)
+		}
+	}
+	return ends
+}
+
+// returns the leftmost start of a match within the edit distance ending at
+// end; the pattern is aligned backwards from end against the longest
+// candidate span
+func (approx *approxPattern) leftmostStart(data []byte, end int) int {
+	m := len(approx.seq)
+	span := min(m+approx.k, end)
+
+	// => row[l] = distance of the pattern suffix so far against the last l bytes
+	row := make([]int, span+1)
+	for l := range row {
+		row[l] = l
+	}
+	for i := m - 1; i >= 0; i-- {
+		diagonal := row[0]
+		row[0] = m - i
+		for l := 1; l <= span; l++ {
+			cost := 1
+			if approx.equal(data[end-l], approx.seq[i]) {
+				cost = 0
+			}
+			above := row[l]
+			row[l] = min(diagonal+cost, row[l-1]+1, above+1)
+			diagonal = above
+		}
+	}
+
+	for l := span; l > 0; l-- {
+		if row[l] <= approx.k {
+			return end - l
+		}
+	}
+	return end
+}
+
+// regexPattern = an expression matched with Go regexp
+type regexPattern struct {
+	index int
+	// => unanchored, to skip data without matches; not for expressions with
+	// '$', which Go doesn't match before a final newline
+	any         *regexp.Regexp
+	endAnchored bool
+	// => compiled program, run over the data once for every end offset
+	prog       *syntax.Prog
+	matchPC    uint32
+	threads    [2]*regexThreads
+	allowEmpty bool
+}
+
+// regexThread = a program counter, and the start of the match it's part of
+type regexThread struct {
+	pc    uint32
+	start int
+}
+
+// regexThreads = a set of threads by program counter, in the order added
+type regexThreads struct {
+	sparse []uint32
+	dense  []regexThread
+}
+
+// returns a regex pattern for the pattern at index
+func newRegexPattern(index int, pattern *Pattern) (*regexPattern, error) {
+	flags := ""
+	for _, flag := range "ism" {
+		if pattern.hasFlag(byte(flag)) {
+			flags += string(flag)
+		}
+	}
+	prefix := ""
+	if flags != "" {
+		prefix = "(?" + flags + ")"
+	}
+
+	parsed, err := syntax.Parse(prefix+pattern.Expression, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %d: not supported by the pure-Go engine, %s", pattern.ID, err)
+	}
+	regex := &regexPattern{index: index, allowEmpty: pattern.hasFlag('V')}
+	if usesWordBoundary(parsed) {
+		return nil, fmt.Errorf("pattern %d: word boundary assertions aren't supported by the pure-Go engine", pattern.ID)
+	}
+	regex.endAnchored = usesEndAssertion(parsed)
+
+	regex.any, err = regexp.Compile(prefix + "(?:" + pattern.Expression + ")")
+	if err != nil {
+		return nil, fmt.Errorf("pattern %d: %s", pattern.ID, err)
+	}
+	regex.prog, err = syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("pattern %d: %s", pattern.ID, err)
+	}
+	for pc, inst := range regex.prog.Inst {
+		if inst.Op == syntax.InstMatch {
+			regex.matchPC = uint32(pc)
+		}
+	}
+	for i := range regex.threads {
+		regex.threads[i] = &regexThreads{sparse: make([]uint32, len(regex.prog.Inst))}
+	}
+
+	if !regex.allowEmpty && regex.any.MatchString("") {
+		return nil, fmt.Errorf("pattern %d: matches empty data, use the 'V' flag to allow", pattern.ID)
+	}
+	return regex, nil
+}
+
+// returns true if a parsed expression has word boundary assertions
+func usesWordBoundary(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpWordBoundary || re.Op == syntax.OpNoWordBoundary {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if usesWordBoundary(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if a parsed expression has '$' assertions
+func usesEndAssertion(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpEndLine || re.Op == syntax.OpEndText {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if usesEndAssertion(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the index of the thread at pc, if in the set
+func (threads *regexThreads) find(pc uint32) (int, bool) {
+	i := threads.sparse[pc]
+	if int(i) < len(threads.dense) && threads.dense[i].pc == pc {
+		return int(i), true
+	}
+	return 0, false
+}
+
+// returns the assertions that hold at offset i in data; '$' also holds
+// before a final newline, as for Hyperscan
+func emptyContext(data []byte, i int) syntax.EmptyOp {
+	before, after := rune(-1), rune(-1)
+	if i > 0 {
+		before = rune(data[i-1])
+	}
+	if i < len(data) {
+		after = rune(data[i])
+	}
+	context := syntax.EmptyOpContext(before, after)
+	if i == len(data)-1 && data[i] == '\n' {
+		context |= syntax.EmptyEndText
+	}
+	return context
+}
+
+// adds the thread at pc, and those it reaches without consuming data; the
+// first thread added at a pc is kept, so threads are added in start order
+func (regex *regexPattern) add(threads *regexThreads, pc uint32, start int, context syntax.EmptyOp) {
+	if _, ok := threads.find(pc); ok {
+		return
+	}
+	threads.sparse[pc] = uint32(len(threads.dense))
+	threads.dense = append(threads.dense, regexThread{pc, start})
+
+	inst := &regex.prog.Inst[pc]
+	switch inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		regex.add(threads, inst.Out, start, context)
+		regex.add(threads, inst.Arg, start, context)
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(inst.Arg)&^context == 0 {
+			regex.add(threads, inst.Out, start, context)
+		}
+	case syntax.InstNop, syntax.InstCapture:
+		regex.add(threads, inst.Out, start, context)
+	}
+}
+
+// returns true if a thread's instruction consumes byte c
+func consumes(inst *syntax.Inst, c byte) bool {
+	switch inst.Op {
+	case syntax.InstRune, syntax.InstRune1:
+		return inst.MatchRune(rune(c))
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return c != '\n'
+	}
+	return false
+}
+
+// appends the matches in data to matches, in a single pass: threads are
+// started at each offset after those started earlier, so the first thread
+// to reach the match at an end offset has the leftmost start
+func (regex *regexPattern) scan(data []byte, matches []goMatch) []goMatch {
+	if !regex.endAnchored && !regex.any.Match(data) {
+		return matches
+	}
+
+	current, next := regex.threads[0], regex.threads[1]
+	current.dense = current.dense[:0]
+	for end := 0; ; end++ {
+		regex.add(current, uint32(regex.prog.Start), end, emptyContext(data, end))
+		if i, ok := current.find(regex.matchPC); ok {
+			if start := current.dense[i].start; start < end || regex.allowEmpty {
+				matches = append(matches, goMatch{regex.index, uint64(start), uint64(end)})
+			}
+		}
+		if end == len(data) {
+			break
+		}
+
+		next.dense = next.dense[:0]
+		context := emptyContext(data, end+1)
+		for _, thread := range current.dense {
+			inst := &regex.prog.Inst[thread.pc]
+			if consumes(inst, data[end]) {
+				regex.add(next, inst.Out, thread.start, context)
+			}
+		}
+		current, next = next, current
+	}
+	return matches
+}
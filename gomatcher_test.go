@@ -0,0 +1,318 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testMatch = a match as reported to a MatchHandler
+type testMatch struct {
+	ID       uint
+	From, To uint64
+}
+
+// returns the matches a matcher reports for data
+func scanAll(t *testing.T, matcher Matcher, data []byte) []testMatch {
+	var matches []testMatch
+	handler := func(id uint, from, to uint64, flags uint, context interface{}) error {
+		matches = append(matches, testMatch{id, from, to})
+		return nil
+	}
+	if err := matcher.Scan(data, handler, nil); err != nil {
+		t.Fatalf("scan failed: %s", err)
+	}
+	return matches
+}
+
+// returns patterns parsed from "<id>:<pattern>" lines
+func testPatterns(t *testing.T, lines ...string) []*Pattern {
+	var patterns []*Pattern
+	for _, line := range lines {
+		fields := strings.SplitN(line, ":", 2)
+		pattern, err := parsePattern(fields[1])
+		if err != nil {
+			t.Fatalf("couldn't parse pattern '%s': %s", line, err)
+		}
+		var id uint
+		fmt.Sscan(fields[0], &id)
+		pattern.ID = id
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// returns a random read, mostly 'ACGT' with some 'N' and lowercase bases,
+// newline terminated as scanned
+func randomRead(rng *rand.Rand, length int) []byte {
+	read := make([]byte, length, length+1)
+	for i := range read {
+		read[i] = "ACGT"[rng.Intn(4)]
+		switch rng.Intn(40) {
+		case 0:
+			read[i] = 'N'
+		case 1:
+			read[i] = lowerByte(read[i])
+		}
+	}
+	return append(read, '\n')
+}
+
+// returns a random pattern set over a read: literals, approximate literals
+// and regular expressions, some taken from the read so they match
+func randomPatterns(t *testing.T, rng *rand.Rand, read []byte) []*Pattern {
+	sequence := func(length int) string {
+		if rng.Intn(2) == 0 {
+			start := rng.Intn(len(read) - length)
+			return strings.ToUpper(string(read[start : start+length]))
+		}
+		seq := make([]byte, length)
+		for i := range seq {
+			seq[i] = "ACGT"[rng.Intn(4)]
+		}
+		return string(seq)
+	}
+	flags := func() string {
+		return []string{"", "L", "iL", "i", "HL"}[rng.Intn(5)]
+	}
+
+	var lines []string
+	for id := 1; id <= 12; id++ {
+		var line string
+		switch id % 4 {
+		case 0:
+			line = fmt.Sprintf("%d:/%s/%s", id, sequence(3+rng.Intn(4)), flags())
+		case 1:
+			line = fmt.Sprintf("%d:/%s/%s{edit_distance=%d}", id, sequence(6+rng.Intn(6)), flags(), 1+rng.Intn(2))
+		case 2:
+			line = fmt.Sprintf("%d:/%s/%s{hamming_distance=%d}", id, sequence(6+rng.Intn(6)), flags(), 1+rng.Intn(2))
+		case 3:
+			line = fmt.Sprintf("%d:/%s/%s", id, []string{"AC[GT]{2}A", "G+T", "A.{2}C", "(CA|TG)+G", "T[^A]T"}[rng.Intn(5)], flags())
+		}
+		lines = append(lines, line)
+	}
+	return testPatterns(t, lines...)
+}
+
+// returns the edit distance between a and b, folding case if caseless
+func levenshtein(a, b string, caseless bool) int {
+	if caseless {
+		a, b = strings.ToLower(a), strings.ToLower(b)
+	}
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			above := row[j]
+			row[j] = min(diagonal+cost, row[j-1]+1, above+1)
+			diagonal = above
+		}
+	}
+	return row[len(b)]
+}
+
+// compiled whole-span expressions, for naiveSpanMatches
+var naiveRegexes = make(map[string]*regexp.Regexp)
+
+// returns true if span matches a pattern, by definition
+func naiveSpanMatches(pattern *Pattern, span string) bool {
+	caseless := pattern.hasFlag('i')
+	switch {
+	case pattern.EditDistance > 0:
+		return levenshtein(pattern.Expression, span, caseless) <= int(pattern.EditDistance)
+	case pattern.HammingDistance > 0:
+		if len(span) != len(pattern.Expression) {
+			return false
+		}
+		mismatches := 0
+		for i := range span {
+			if levenshtein(span[i:i+1], pattern.Expression[i:i+1], caseless) > 0 {
+				mismatches++
+			}
+		}
+		return mismatches <= int(pattern.HammingDistance)
+	}
+	expr := `\A(?:` + pattern.Expression + `)\z`
+	if caseless {
+		expr = "(?i)" + expr
+	}
+	regex, ok := naiveRegexes[expr]
+	if !ok {
+		regex = regexp.MustCompile(expr)
+		naiveRegexes[expr] = regex
+	}
+	return regex.MatchString(span)
+}
+
+// returns the matches of patterns in data by brute force: every non-empty
+// span is tried, and each end offset is reported with its leftmost start
+func naiveMatches(patterns []*Pattern, data []byte) []testMatch {
+	var matches []testMatch
+	for end := 1; end <= len(data); end++ {
+		var ids []uint
+		starts := make(map[uint]uint64)
+		for _, pattern := range patterns {
+			for start := 0; start < end; start++ {
+				if !naiveSpanMatches(pattern, string(data[start:end])) {
+					continue
+				}
+				if _, ok := starts[pattern.ID]; !ok {
+					ids = append(ids, pattern.ID)
+					starts[pattern.ID] = uint64(start)
+				}
+				break
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			matches = append(matches, testMatch{id, starts[id], uint64(end)})
+		}
+	}
+	return matches
+}
+
+// applies the 'L' and 'H' flags to matches, as reported to a MatchHandler
+func reportedMatches(patterns []*Pattern, matches []testMatch) []testMatch {
+	byID := make(map[uint]*Pattern)
+	for _, pattern := range patterns {
+		byID[pattern.ID] = pattern
+	}
+	var reported []testMatch
+	seen := make(map[uint]bool)
+	for _, match := range matches {
+		pattern := byID[match.ID]
+		if pattern.hasFlag('H') && seen[match.ID] {
+			continue
+		}
+		seen[match.ID] = true
+		if !pattern.hasFlag('L') {
+			match.From = 0
+		}
+		reported = append(reported, match)
+	}
+	return reported
+}
+
+func TestGoMatcherAgainstBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		read := randomRead(rng, 40+rng.Intn(40))
+		patterns := randomPatterns(t, rng, read)
+
+		matcher, err := newGoMatcher(patterns)
+		if err != nil {
+			t.Fatalf("couldn't build matcher: %s", err)
+		}
+		got := scanAll(t, matcher, read)
+		want := reportedMatches(patterns, naiveMatches(patterns, read))
+		if !reflect.DeepEqual(got, want) {
+			for _, pattern := range patterns {
+				t.Logf("pattern %d: %s", pattern.ID, pattern)
+			}
+			t.Fatalf("read %q:\n got %v\nwant %v", read, got, want)
+		}
+	}
+}
+
+func TestGoMatcherLongPatterns(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 5; round++ {
+		read := randomRead(rng, 200)
+		seq := strings.ToUpper(string(read[50:130]))
+		mutated := []byte(seq)
+		mutated[10], mutated[40] = 'A', 'C'
+		patterns := testPatterns(t,
+			fmt.Sprintf("1:/%s/L{edit_distance=3}", mutated),
+			fmt.Sprintf("2:/%s/iL{hamming_distance=4}", mutated),
+		)
+
+		matcher, err := newGoMatcher(patterns)
+		if err != nil {
+			t.Fatalf("couldn't build matcher: %s", err)
+		}
+		got := scanAll(t, matcher, read)
+		want := reportedMatches(patterns, naiveMatches(patterns, read))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("read %q:\n got %v\nwant %v", read, got, want)
+		}
+	}
+}
+
+func TestGoMatcherAssertionsAndExtensions(t *testing.T) {
+	data := []byte("ACGTTTACGTAAACGT\n")
+	for _, test := range []struct {
+		pattern string
+		want    []testMatch
+	}{
+		{"1:/ACGT/L", []testMatch{{1, 0, 4}, {1, 6, 10}, {1, 12, 16}}},
+		{"1:/ACGT/", []testMatch{{1, 0, 4}, {1, 0, 10}, {1, 0, 16}}},
+		{"1:/ACGT/HL", []testMatch{{1, 0, 4}}},
+		{"1:/^ACGT/L", []testMatch{{1, 0, 4}}},
+		{"1:/ACGT$/L", []testMatch{{1, 12, 16}}},
+		{"1:/ACGT$|TTA/L", []testMatch{{1, 4, 7}, {1, 12, 16}}},
+		{"1:/acgt/iL", []testMatch{{1, 0, 4}, {1, 6, 10}, {1, 12, 16}}},
+		{"1:/acgt/L", nil},
+		{"1:/ACGT/L{min_offset=5,max_offset=12}", []testMatch{{1, 6, 10}}},
+		{"1:/T+/L", []testMatch{{1, 3, 4}, {1, 3, 5}, {1, 3, 6}, {1, 9, 10}, {1, 15, 16}}},
+		{"1:/T+/L{min_length=2}", []testMatch{{1, 3, 5}, {1, 3, 6}}},
+		{"1:/GT.*GT/L", []testMatch{{1, 2, 10}, {1, 2, 16}}},
+		{"1:/A.*\\n/sL", []testMatch{{1, 0, 17}}},
+	} {
+		matcher, err := newGoMatcher(testPatterns(t, test.pattern))
+		if err != nil {
+			t.Fatalf("%s: couldn't build matcher: %s", test.pattern, err)
+		}
+		if got := scanAll(t, matcher, data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %v\nwant %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestGoMatcherRegexLongRead(t *testing.T) {
+	// => a single pass over the read; trying each end offset would be quadratic
+	read := []byte(strings.Repeat("T", 500000) + "\n")
+	var want []testMatch
+	for _, at := range []int{1000, 250000, 499990} {
+		copy(read[at:], "ACGGTGCA")
+		want = append(want, testMatch{1, uint64(at), uint64(at + 8)})
+	}
+
+	matcher, err := newGoMatcher(testPatterns(t, "1:/AC[GT]{2}T+GCA/L"))
+	if err != nil {
+		t.Fatalf("couldn't build matcher: %s", err)
+	}
+	if got := scanAll(t, matcher, read); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestGoMatcherUnsupported(t *testing.T) {
+	for _, pattern := range []string{
+		"1:/\\bACGT/",
+		"1:/A(?=C)/",
+		"1:/A*/",
+		"1:/AC.T/{edit_distance=1}",
+		"1:/ACGT/{edit_distance=4}",
+	} {
+		if _, err := newGoMatcher(testPatterns(t, pattern)); err == nil {
+			t.Errorf("%s: expected an error", pattern)
+		}
+	}
+}
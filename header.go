@@ -0,0 +1,165 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * header.go
+ *
+ * => FASTQ header comment templates, eg: "{comment} {sample} {id}:{from}-{to}"
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// placeholders supported in header templates:
+//
+//	{comment}   comment from the input FASTQ header
+//	{sample}    sample name of the matched pattern ID
+//	{id}        matched pattern ID
+//	{from}      match start offset
+//	{to}        match end offset
+//	{match}     matched sequence
+//	{matchqual} matched base qualities
+//	{dist}      edit distance of the match to its pattern's nominal sequence
+//	{strand}    strand of the match, '+' or '-' for reverse complement ('-both-strands')
+//	{umi}       UMI read sequence
+//	{role}      read role (R1, R2, I1, I2, UMI)
+//	{illumina}  Illumina-style '<read>:<filtered>:<control>:<barcode>', barcode = matched sequence
+//	{cell}      composite cell ID of split-pool barcode rounds
+//	{cb}        whitelist corrected cell barcode
+//	{cr}        raw cell barcode
+//	{cap:name}  sub-field captured from the match by the pattern ID's capture regex
+var headerPlaceholders = []string{"comment", "sample", "id", "from", "to", "match", "matchqual", "dist", "strand", "umi", "role", "illumina", "cell", "cb", "cr", "cap:<name>"}
+
+// Illumina CASAVA 1.8+ comment, eg: "1:N:0:ACGTACGT"
+var reIlluminaComment = regexp.MustCompile(`^[123]:([YN]):(\d+):`)
+
+// template placeholder, eg: "{sample}", or "{cap:umi}" with a capture name
+var reHeaderPlaceholder = regexp.MustCompile(`\{([a-z]+)(?::(\w+))?\}`)
+
+// HeaderTemplate = a parsed FASTQ header comment template
+type HeaderTemplate struct {
+	text string
+	// => true if the template is just "{comment}", so headers are left as-is
+	passthrough bool
+}
+
+// headerTemplate from the '-H' flag
+var headerTemplate HeaderTemplate
+
+// returns a parsed header template; unknown placeholders are fatal
+func parseHeaderTemplate(text string) HeaderTemplate {
+	for _, placeholder := range reHeaderPlaceholder.FindAllStringSubmatch(text, -1) {
+		// => capture placeholders need a name, others can't have one
+		known := placeholder[1] == "cap" && placeholder[2] != ""
+		for _, name := range headerPlaceholders {
+			known = known || (name == placeholder[1] && placeholder[2] == "")
+		}
+		if !known {
+			log.Fatal(fmt.Sprintf("Unknown header template placeholder '%s'! Supported: {%s}", placeholder[0], strings.Join(headerPlaceholders, "}, {")))
+		}
+	}
+	return HeaderTemplate{text: text, passthrough: text == "{comment}"}
+}
+
+// returns the FASTQ header line for a record; swapped mates are marked at
+// the end of the comment
+func (t HeaderTemplate) header(record OutputRecord) string {
+	if t.passthrough {
+		if record.Swapped {
+			return record.Name + " " + swappedMarker
+		}
+		return record.Name
+	}
+
+	comment := t.expand(record)
+	if record.Swapped {
+		comment = strings.TrimSpace(comment + " " + swappedMarker)
+	}
+	if comment == "" {
+		return "@" + record.ReadID
+	}
+	return "@" + record.ReadID + " " + comment
+}
+
+// returns the template expanded for a record
+func (t HeaderTemplate) expand(record OutputRecord) string {
+	comment := getHeaderComment(record.Name)
+	expanded := reHeaderPlaceholder.ReplaceAllStringFunc(t.text, func(placeholder string) string {
+		if strings.HasPrefix(placeholder, "{cap:") {
+			return captureValue(record.Captures, placeholder[5:len(placeholder)-1])
+		}
+		switch placeholder {
+		case "{comment}":
+			return comment
+		case "{sample}":
+			return recordSample(record)
+		case "{id}":
+			return fmt.Sprint(record.ID)
+		case "{from}":
+			return fmt.Sprint(record.From)
+		case "{to}":
+			return fmt.Sprint(record.To)
+		case "{match}":
+			return record.MatchSeq
+		case "{matchqual}":
+			return record.MatchQual
+		case "{dist}":
+			if record.Edits == nil {
+				return ""
+			}
+			return fmt.Sprint(record.Edits.Distance())
+		case "{strand}":
+			if record.Reverse {
+				return "-"
+			}
+			return "+"
+		case "{umi}":
+			return record.UMI
+		case "{role}":
+			return string(record.Role)
+		case "{cell}":
+			return record.Cell
+		case "{cb}":
+			return record.CellBarcode.Corrected
+		case "{cr}":
+			return record.CellBarcode.Raw
+		case "{illumina}":
+			return illuminaComment(record, comment)
+		}
+		return placeholder
+	})
+	return strings.TrimSpace(expanded)
+}
+
+// returns the comment part of a FASTQ header line, after the read ID
+func getHeaderComment(name string) string {
+	i := strings.IndexAny(name, " \t")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(name[i+1:])
+}
+
+// returns an Illumina-style comment with the matched sequence as barcode;
+// filter and control fields are kept from an Illumina input comment
+func illuminaComment(record OutputRecord, comment string) string {
+	read := "1"
+	if record.Role == RoleR2 {
+		read = "2"
+	}
+	filtered, control := "N", "0"
+	if m := reIlluminaComment.FindStringSubmatch(comment); m != nil {
+		filtered, control = m[1], m[2]
+	}
+	return read + ":" + filtered + ":" + control + ":" + record.MatchSeq
+}
@@ -0,0 +1,60 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestHeaderTemplate(t *testing.T) {
+	record := OutputRecord{
+		ID: 7, Role: RoleR2, Name: "@read1 2:Y:18:ATCACG", ReadID: "read1",
+		From: 4, To: 12, MatchSeq: "ACGTACGT", MatchQual: "IIIIIIII", UMI: "GATTACA",
+	}
+	tests := []struct {
+		template, want string
+	}{
+		// => headers are left as-is by default
+		{"{comment}", "@read1 2:Y:18:ATCACG"},
+		{"{comment} {sample} {id}:{from}-{to}", "@read1 2:Y:18:ATCACG 7 7:4-12"},
+		{"{role} {match} {matchqual} {umi}", "@read1 R2 ACGTACGT IIIIIIII GATTACA"},
+		// => Illumina comments keep the input's filter and control fields
+		{"{illumina}", "@read1 2:Y:18:ACGTACGT"},
+		// => no comment left after expanding
+		{"", "@read1"},
+		{" {umi} ", "@read1 GATTACA"},
+	}
+	for _, test := range tests {
+		if got := parseHeaderTemplate(test.template).header(record); got != test.want {
+			t.Errorf("header of template %q = %q, want %q", test.template, got, test.want)
+		}
+	}
+
+	// => input headers without an Illumina comment
+	record = OutputRecord{ID: 7, Role: RoleR1, Name: "@read1\tlane=1", ReadID: "read1", MatchSeq: "ACGT"}
+	if got := parseHeaderTemplate("{illumina} {comment}").header(record); got != "@read1 1:N:0:ACGT lane=1" {
+		t.Errorf("header of a tab separated comment = %q, want \"@read1 1:N:0:ACGT lane=1\"", got)
+	}
+
+	expectFatal(t, "an unknown placeholder", func() {
+		parseHeaderTemplate("{comment} {lane}")
+	})
+}
+
+func TestGetHeaderComment(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"@read1 1:N:0:ACGT", "1:N:0:ACGT"},
+		{"@read1\t1:N:0:ACGT extra", "1:N:0:ACGT extra"},
+		{"@read1", ""},
+	}
+	for _, test := range tests {
+		if got := getHeaderComment(test.name); got != test.want {
+			t.Errorf("getHeaderComment(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
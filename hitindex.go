@@ -0,0 +1,231 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * hitindex.go
+ *
+ * => compact binary hit index, written while scanning ('-index'), so that
+ *    outputs can be re-made with different options by 'emit' without
+ *    rescanning the input
+ *
+ * => format, all integers unsigned varints:
+ *
+ *	"GBCLYHI1"
+ *	<number of pattern IDs> <pattern ID>...
+ *	<number of read roles> (<length> <role>)...
+ *	per read set with hits, in input order:
+ *	  <read sets skipped since previous entry + 1> <number of hits>
+ *	  (<read role index> <matcher ID> <from> <to - from>)...
+ *	0 <total read sets>
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hit index file magic, including format version
+const hitIndexMagic = "GBCLYHI1"
+
+// HitIndexWriter writes a hit index while scanning
+type HitIndexWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	roles  map[ReadRole]uint64
+	// ordinal of the next read set, and of the read set after the last entry
+	ordinal, next uint64
+	buf           [binary.MaxVarintLen64]byte
+}
+
+// HitIndexReader replays a hit index in place of scanning
+type HitIndexReader struct {
+	file       *os.File
+	filename   string
+	reader     *bufio.Reader
+	patternIDs []uint
+	roles      []ReadRole
+	// ordinal of the next read set, and of the pending entry's read set
+	ordinal, entryOrdinal uint64
+	entryHits             []Hit
+	// => true once the end of index marker was read
+	done  bool
+	total uint64
+}
+
+// hitIndex from the '-index' flag when scanning; nil if not writing an index
+var hitIndex *HitIndexWriter
+
+// returns a new HitIndexWriter, with the header written for the pattern IDs and read set
+func newHitIndexWriter(filename string, ids []uint, readSet ReadSet) *HitIndexWriter {
+	file := createOutputFile(filename)
+	index := &HitIndexWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		roles:  make(map[ReadRole]uint64),
+	}
+
+	index.writer.WriteString(hitIndexMagic)
+	index.putUvarint(uint64(len(ids)))
+	for _, id := range ids {
+		index.putUvarint(uint64(id))
+	}
+	index.putUvarint(uint64(len(readSet)))
+	for i, input := range readSet {
+		index.roles[input.Role] = uint64(i)
+		index.putUvarint(uint64(len(input.Role)))
+		index.writer.WriteString(string(input.Role))
+	}
+
+	return index
+}
+
+// writes an unsigned varint
+func (index *HitIndexWriter) putUvarint(x uint64) {
+	n := binary.PutUvarint(index.buf[:], x)
+	index.writer.Write(index.buf[:n])
+}
+
+// adds the hits of the next read set; read sets without hits only advance the ordinal
+func (index *HitIndexWriter) writeReadSet(hits []Hit) {
+	ordinal := index.ordinal
+	index.ordinal++
+	if len(hits) == 0 {
+		return
+	}
+
+	index.putUvarint(ordinal - index.next + 1)
+	index.putUvarint(uint64(len(hits)))
+	for _, hit := range hits {
+		index.putUvarint(index.roles[hit.Role])
+		index.putUvarint(uint64(hit.matcherID()))
+		index.putUvarint(hit.From)
+		index.putUvarint(hit.To - hit.From)
+	}
+	index.next = ordinal + 1
+}
+
+// writes the end of index marker, then flushes and closes the file
+func (index *HitIndexWriter) Close() {
+	index.putUvarint(0)
+	index.putUvarint(index.ordinal)
+	checkErr(index.writer.Flush(), fmt.Sprintf("Couldn't write hit index '%s'!", index.file.Name()))
+	index.file.Close()
+}
+
+// returns a HitIndexReader with the header read, positioned at the first entry
+func openHitIndex(filename string) *HitIndexReader {
+	file, err := os.Open(filename)
+	checkErr(err, fmt.Sprintf("Can't read hit index '%s'! %s", filename, err))
+
+	index := &HitIndexReader{file: file, filename: filename, reader: bufio.NewReader(file)}
+
+	magic := make([]byte, len(hitIndexMagic))
+	if _, err := io.ReadFull(index.reader, magic); err != nil || string(magic) != hitIndexMagic {
+		log.Fatal(fmt.Sprintf("'%s' is not a GoBCLy hit index!", filename))
+	}
+
+	for n := index.uvarint(); n > 0; n-- {
+		index.patternIDs = append(index.patternIDs, uint(index.uvarint()))
+	}
+	for n := index.uvarint(); n > 0; n-- {
+		role := make([]byte, index.uvarint())
+		_, err := io.ReadFull(index.reader, role)
+		checkErr(err, fmt.Sprintf("Truncated hit index '%s'!", filename))
+		index.roles = append(index.roles, ReadRole(role))
+	}
+
+	index.readEntry()
+	return index
+}
+
+// closes the hit index file
+func (index *HitIndexReader) Close() {
+	index.file.Close()
+}
+
+// returns the next unsigned varint; a truncated index is fatal
+func (index *HitIndexReader) uvarint() uint64 {
+	x, err := binary.ReadUvarint(index.reader)
+	checkErr(err, fmt.Sprintf("Truncated hit index '%s'!", index.filename))
+	return x
+}
+
+// reads the next entry, or the end of index marker
+func (index *HitIndexReader) readEntry() {
+	gap := index.uvarint()
+	if gap == 0 {
+		index.done = true
+		index.total = index.uvarint()
+		return
+	}
+
+	index.entryOrdinal = index.ordinal + gap - 1
+	index.entryHits = index.entryHits[:0]
+	for n := index.uvarint(); n > 0; n-- {
+		roleIndex := index.uvarint()
+		if roleIndex >= uint64(len(index.roles)) {
+			log.Fatal(fmt.Sprintf("Bad read role in hit index '%s'!", index.filename))
+		}
+		hit := Hit{Role: index.roles[roleIndex], ID: uint(index.uvarint()), From: index.uvarint()}
+		hit.To = hit.From + index.uvarint()
+		index.entryHits = append(index.entryHits, hit)
+	}
+}
+
+// checks the read roles of the index match the input read set
+func (index *HitIndexReader) checkReadSet(readSet ReadSet) {
+	match := len(index.roles) == len(readSet)
+	for i := 0; match && i < len(readSet); i++ {
+		match = index.roles[i] == readSet[i].Role
+	}
+	if !match {
+		var roles []ReadRole
+		for _, input := range readSet {
+			roles = append(roles, input.Role)
+		}
+		log.Fatal(fmt.Sprintf("Hit index '%s' read roles %v don't match input read roles %v!", index.filename, index.roles, roles))
+	}
+}
+
+// replays the stored hits of the next read set through eventHandler, in place of scanning
+func (index *HitIndexReader) replay(records []FASTQRecord) {
+	ordinal := index.ordinal
+	index.ordinal++
+	if index.done || ordinal != index.entryOrdinal {
+		return
+	}
+
+	for _, hit := range index.entryHits {
+		var record *FASTQRecord
+		for i := range records {
+			if records[i].Role == hit.Role {
+				record = &records[i]
+			}
+		}
+		if record == nil || hit.To > uint64(len(record.Seq)) {
+			log.Fatal(fmt.Sprintf("Hit index '%s' doesn't match the input at read set %d!", index.filename, ordinal+1))
+		}
+		eventHandler(hit.ID, hit.From, hit.To, 0, *record)
+	}
+	index.readEntry()
+}
+
+// checks the whole index was replayed against an input of the same length
+func (index *HitIndexReader) finish() {
+	if !index.done {
+		log.Fatal(fmt.Sprintf("Hit index '%s' has hits past the end of the input (%d read sets)!", index.filename, index.ordinal))
+	}
+	if index.total != index.ordinal {
+		log.Fatal(fmt.Sprintf("Hit index '%s' was written for %d read sets, input has %d!", index.filename, index.total, index.ordinal))
+	}
+}
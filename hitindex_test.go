@@ -0,0 +1,111 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// returns the position of hits, as replayed from a hit index
+func hitPositions(hits []Hit) []Hit {
+	var positions []Hit
+	for _, hit := range hits {
+		positions = append(positions, Hit{ID: hit.ID, Role: hit.Role, From: hit.From, To: hit.To, Reverse: hit.Reverse})
+	}
+	return positions
+}
+
+// writes a hit index of read sets of hits, returning its file name
+func writeTestHitIndex(t *testing.T, ids []uint, readSets [][]Hit) string {
+	filename := filepath.Join(t.TempDir(), "test.hs_index")
+	index := newHitIndexWriter(filename, ids, ReadSet{{Role: RoleR1}, {Role: RoleR2}})
+	for _, hits := range readSets {
+		index.writeReadSet(hits)
+	}
+	index.Close()
+	finalizeOutputFiles()
+	return filename
+}
+
+func TestHitIndexRoundTrip(t *testing.T) {
+	readSets := [][]Hit{
+		{{ID: 2, Role: RoleR1, From: 0, To: 4}},
+		nil,
+		nil,
+		{{ID: 7, Role: RoleR2, From: 3, To: 11, Reverse: true}, {ID: 2, Role: RoleR1, From: 8, To: 12}},
+		nil,
+	}
+	filename := writeTestHitIndex(t, []uint{1, 2, 7}, readSets)
+
+	index := openHitIndex(filename)
+	if !reflect.DeepEqual(index.patternIDs, []uint{1, 2, 7}) || !reflect.DeepEqual(index.roles, []ReadRole{RoleR1, RoleR2}) {
+		t.Fatalf("index header = IDs %v, roles %v", index.patternIDs, index.roles)
+	}
+	index.checkReadSet(ReadSet{{Role: RoleR1}, {Role: RoleR2}})
+
+	records := []FASTQRecord{
+		{Name: "@read", Seq: "ACGTACGTACGTACGT\n", Qual: "IIIIIIIIIIIIIIII\n", Role: RoleR1},
+		{Name: "@read", Seq: "TTTTGGGGCCCCAAAA\n", Qual: "IIIIIIIIIIIIIIII\n", Role: RoleR2},
+	}
+	for i, want := range readSets {
+		readSetHits = readSetHits[:0]
+		index.replay(records)
+		if got := hitPositions(readSetHits); !reflect.DeepEqual(got, hitPositions(want)) {
+			t.Errorf("read set %d replayed %+v, want %+v", i, got, want)
+		}
+	}
+	index.finish()
+
+	index.Close()
+	if _, err := index.file.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("read after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestHitIndexReplayErrors(t *testing.T) {
+	readSets := [][]Hit{nil, {{ID: 1, Role: RoleR2, From: 0, To: 4}}, nil}
+	filename := writeTestHitIndex(t, []uint{1}, readSets)
+
+	expectFatal(t, "a read set of other roles", func() {
+		index := openHitIndex(filename)
+		defer index.Close()
+		index.checkReadSet(ReadSet{{Role: RoleR2}, {Role: RoleR1}})
+	})
+	expectFatal(t, "a read set without R2", func() {
+		index := openHitIndex(filename)
+		defer index.Close()
+		index.checkReadSet(ReadSet{{Role: RoleR1}})
+	})
+
+	// => inputs shorter or longer than the index
+	records := []FASTQRecord{{Role: RoleR1, Seq: "ACGT\n", Qual: "IIII\n"}, {Role: RoleR2, Seq: "ACGT\n", Qual: "IIII\n"}}
+	expectFatal(t, "an input shorter than the index", func() {
+		index := openHitIndex(filename)
+		defer index.Close()
+		index.replay(records)
+		index.finish()
+	})
+	expectFatal(t, "an input longer than the index", func() {
+		index := openHitIndex(filename)
+		defer index.Close()
+		for i := 0; i < 4; i++ {
+			index.replay(records)
+		}
+		index.finish()
+	})
+	// => hits past the end of a read
+	expectFatal(t, "an input of shorter reads", func() {
+		index := openHitIndex(filename)
+		defer index.Close()
+		short := []FASTQRecord{{Role: RoleR1, Seq: "ACGT\n", Qual: "IIII\n"}, {Role: RoleR2, Seq: "AC\n", Qual: "II\n"}}
+		index.replay(short)
+		index.replay(short)
+	})
+}
@@ -0,0 +1,193 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * hits.go
+ *
+ * => hit table output, one row per match as TSV or JSON Lines
+ * => by default only the hit each read set is assigned by is written;
+ *    '-hits-all' writes every hit, including in ambiguous read sets
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FASTQ read ID, the header up to the first whitespace
+var reReadID = regexp.MustCompile(`^@(\S+)`)
+
+// hit table TSV columns, in HitRow field order
+var hitTableColumns = []string{"read_id", "mate", "id", "sample", "from", "to", "strand", "match", "match_qual", "edit_distance", "assignment", "captures"}
+
+// HitRow = a single hit table row
+type HitRow struct {
+	ReadID    string   `json:"read_id"`
+	Mate      ReadRole `json:"mate"`
+	ID        uint     `json:"id"`
+	Sample    string   `json:"sample"`
+	From      uint64   `json:"from"`
+	To        uint64   `json:"to"`
+	Strand    string   `json:"strand"`
+	Match     string   `json:"match"`
+	MatchQual string   `json:"match_qual"`
+	// => nil when the matcher doesn't report it
+	EditDistance *int   `json:"edit_distance,omitempty"`
+	Assignment   string `json:"assignment"`
+	// => sub-fields from the capture regex, if any
+	Captures map[string]string `json:"captures,omitempty"`
+}
+
+// HitTableWriter writes hit table rows to a file
+type HitTableWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	// => JSON Lines instead of TSV
+	jsonl bool
+	// => write every hit, not just the winning one
+	all bool
+}
+
+// hitTable from the '-hits' flag; nil if not writing a hit table
+var hitTable *HitTableWriter
+
+// returns the read ID of a FASTQ header line
+func getReadID(name string) string {
+	m := reReadID.FindStringSubmatch(name)
+	if m == nil {
+		log.Fatal(fmt.Sprintf("Couldn't parse read ID from FASTQ header '%s'!", name))
+	}
+	return m[1]
+}
+
+// returns the name of an assignment, for hit table rows
+func (assignment Assignment) String() string {
+	switch assignment {
+	case AssignSample:
+		return "assigned"
+	case AssignAmbiguous:
+		return "ambiguous"
+	case AssignRejected:
+		return "rejected"
+	}
+	return "undetermined"
+}
+
+// returns the matched bases and qualities of a hit in record, as read;
+// streamed reads aren't kept, so their hits carry them
+func (hit Hit) match(record FASTQRecord) (string, string) {
+	if *flagStreamChunk > 0 {
+		return hit.MatchSeq, hit.MatchQual
+	}
+	seq, qual := strings.TrimSpace(record.Seq), strings.TrimSpace(record.Qual)
+	from, to := hit.span(len(seq))
+	return seq[from:to], qual[min(from, len(qual)):min(to, len(qual))]
+}
+
+// returns the offsets of a hit clipped to a read of length n; matches can
+// run into the "\n" terminating scanned data, and fixed-position hits past
+// the end of short reads
+func (hit Hit) span(n int) (int, int) {
+	to := min(int(hit.To), n)
+	return min(int(hit.From), to), to
+}
+
+// returns a new HitTableWriter; file names ending in ".jsonl" or ".json"
+// get JSON Lines, otherwise TSV with a header line
+func newHitTableWriter(filename string, all bool) *HitTableWriter {
+	file := createOutputFile(filename)
+	table := &HitTableWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		jsonl:  strings.HasSuffix(filename, ".jsonl") || strings.HasSuffix(filename, ".json"),
+		all:    all,
+	}
+	if !table.jsonl {
+		fmt.Fprintln(table.writer, strings.Join(hitTableColumns, "\t"))
+	}
+	return table
+}
+
+// writes the rows for a scanned read set and its hits
+func (table *HitTableWriter) writeReadSet(records []FASTQRecord, hits []Hit, rejected bool) {
+	assignment, _ := readSetAssignment(hits, rejected)
+	winner := winningHit(hits)
+
+	recordsByRole := make(map[ReadRole]FASTQRecord)
+	for _, record := range records {
+		recordsByRole[record.Role] = record
+	}
+
+	for i, hit := range hits {
+		if !table.all && i != winner {
+			continue
+		}
+		record := recordsByRole[hit.Role]
+		row := HitRow{
+			ReadID:     getReadID(record.Name),
+			Mate:       hit.Role,
+			ID:         hit.ID,
+			Sample:     hitSample(hit),
+			From:       hit.From,
+			To:         hit.To,
+			Strand:     hit.strand(),
+			Assignment: assignment.String(),
+		}
+		row.Match, row.MatchQual = hit.match(record)
+		if hit.Edits != nil {
+			distance := hit.Edits.Distance()
+			row.EditDistance = &distance
+		}
+		if hit.Captures != nil {
+			row.Captures = make(map[string]string)
+			for _, capture := range hit.Captures {
+				row.Captures[capture.Name] = capture.Value
+			}
+		}
+		table.write(row)
+	}
+}
+
+// writes a single row
+func (table *HitTableWriter) write(row HitRow) {
+	if table.jsonl {
+		line, err := json.Marshal(row)
+		checkErr(err, fmt.Sprintf("Couldn't encode hit table row! %s", err))
+		table.writer.Write(append(line, '\n'))
+		return
+	}
+
+	editDistance := ""
+	if row.EditDistance != nil {
+		editDistance = fmt.Sprint(*row.EditDistance)
+	}
+	captures := ""
+	if row.Captures != nil {
+		var pairs []Capture
+		for name, value := range row.Captures {
+			pairs = append(pairs, Capture{Name: name, Value: value})
+		}
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+		captures = formatCaptures(pairs)
+	}
+	fmt.Fprintf(table.writer, "%s\t%s\t%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+		row.ReadID, row.Mate, row.ID, row.Sample, row.From, row.To, row.Strand, row.Match, row.MatchQual, editDistance, row.Assignment, captures)
+}
+
+// flushes and closes the hit table file
+func (table *HitTableWriter) Close() {
+	checkErr(table.writer.Flush(), fmt.Sprintf("Couldn't write hit table '%s'!", table.file.Name()))
+	table.file.Close()
+}
@@ -0,0 +1,134 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// returns the rows a hit table writes for read sets, split into fields
+func hitTableRows(table *HitTableWriter, readSets [][]Hit) [][]string {
+	var buf bytes.Buffer
+	table.writer = bufio.NewWriter(&buf)
+	records := []FASTQRecord{
+		{Name: "@read1 1:N:0", Seq: "ACGTACGT\n", Qual: "ABCDEFGH\n", Role: RoleR1},
+		{Name: "@read1 2:N:0", Seq: "TTTTGGGG\n", Qual: "IJKLMNOP\n", Role: RoleR2},
+	}
+	for _, hits := range readSets {
+		table.writeReadSet(records, hits, false)
+	}
+	table.writer.Flush()
+
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line != "" {
+			rows = append(rows, strings.Split(line, "\t"))
+		}
+	}
+	return rows
+}
+
+func TestHitTableRows(t *testing.T) {
+	readSets := [][]Hit{
+		{{ID: 1, Role: RoleR1, From: 4, To: 8}, {ID: 1, Role: RoleR2, From: 0, To: 4}},
+		// => ambiguous and undetermined read sets
+		{{ID: 1, Role: RoleR1, From: 0, To: 4}, {ID: 2, Role: RoleR2, From: 4, To: 8}},
+		nil,
+	}
+
+	// => only the hit each read set is assigned by
+	rows := hitTableRows(&HitTableWriter{}, readSets)
+	want := []string{"read1", "R1", "1", "1", "4", "8", "+", "ACGT", "EFGH", "", "assigned"}
+	if len(rows) != 1 || !reflect.DeepEqual(rows[0][:11], want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+
+	// => every hit
+	rows = hitTableRows(&HitTableWriter{all: true}, readSets)
+	var got []string
+	for _, row := range rows {
+		got = append(got, strings.Join(row[:11], " "))
+	}
+	all := []string{
+		"read1 R1 1 1 4 8 + ACGT EFGH  assigned",
+		"read1 R2 1 1 0 4 + TTTT IJKL  assigned",
+		"read1 R1 1 1 0 4 + ACGT ABCD  ambiguous",
+		"read1 R2 2 2 4 8 + GGGG MNOP  ambiguous",
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("rows of every hit = %q, want %q", got, all)
+	}
+}
+
+func TestHitTableJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	table := &HitTableWriter{writer: bufio.NewWriter(&buf), jsonl: true}
+	distance := 1
+	table.write(HitRow{ReadID: "read1", Mate: RoleR1, ID: 3, Sample: "S3", From: 2, To: 6, Strand: "+",
+		Match: "ACGT", MatchQual: "IIII", EditDistance: &distance, Assignment: "assigned"})
+	table.write(HitRow{ReadID: "read2", Mate: RoleR2, ID: 3, Sample: "S3", Strand: "+", Assignment: "ambiguous"})
+	table.writer.Flush()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatalf("couldn't decode %s: %s", lines[0], err)
+	}
+	for column, want := range map[string]interface{}{"read_id": "read1", "mate": "R1", "id": 3.0, "from": 2.0, "match": "ACGT", "edit_distance": 1.0, "assignment": "assigned"} {
+		if row[column] != want {
+			t.Errorf("%s = %v, want %v", column, row[column], want)
+		}
+	}
+	// => no edit distance when the matcher doesn't report it
+	if strings.Contains(lines[1], "edit_distance") {
+		t.Errorf("row without an edit distance = %s", lines[1])
+	}
+}
+
+func TestGetReadID(t *testing.T) {
+	for name, want := range map[string]string{"@read1 1:N:0:ACGT": "read1", "@read1/1\tBC:Z:ACGT": "read1/1", "@read1": "read1"} {
+		if got := getReadID(name); got != want {
+			t.Errorf("getReadID(%q) = %q, want %q", name, got, want)
+		}
+	}
+	expectFatal(t, "a header without a read ID", func() {
+		getReadID("read1")
+	})
+}
+
+func TestHitMatchClipped(t *testing.T) {
+	record := FASTQRecord{Name: "@read1", Seq: "GGAAA\n", Qual: "ABCDE\n", Role: RoleR1}
+	tests := []struct {
+		hit               Hit
+		wantSeq, wantQual string
+	}{
+		{Hit{From: 1, To: 3}, "GA", "BC"},
+		// => into the line end, and past the end of the read
+		{Hit{From: 2, To: 6}, "AAA", "CDE"},
+		{Hit{From: 8, To: 12}, "", ""},
+	}
+	for _, test := range tests {
+		if seq, qual := test.hit.match(record); seq != test.wantSeq || qual != test.wantQual {
+			t.Errorf("match of %d-%d = %q %q, want %q %q", test.hit.From, test.hit.To, seq, qual, test.wantSeq, test.wantQual)
+		}
+	}
+
+	var buf bytes.Buffer
+	table := &HitTableWriter{writer: bufio.NewWriter(&buf)}
+	table.writeReadSet([]FASTQRecord{record}, []Hit{{ID: 1, Role: RoleR1, From: 2, To: 6}}, false)
+	table.writer.Flush()
+	if want := "read1\tR1\t1\t1\t2\t6\t+\tAAA\tCDE\t\tassigned\t\n"; buf.String() != want {
+		t.Errorf("hit table row = %q, want %q", buf.String(), want)
+	}
+}
@@ -26,15 +26,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
-	//
-	"github.com/flier/gohs/hyperscan" //hyperscan
 	// TODO: re-evaluate FASTQ readers vs. line reading
 	"github.com/drio/drio.go/bio/fasta"
 	//"github.com/biogo/biogo/io/seqio/fasta" //Heng Li's FASTQ file reader => not using
@@ -64,24 +61,77 @@ var (
 	// *** flags ***
 
 	// input flags
-	flagR1File       = flag.String("r1", "", "Path to R1 file.")
-	flagR2File       = flag.String("r2", "", "Path to R2 file.")
+	flagR1File       = newFileListFlag("r1", "Path to R1 file(s); repeat or comma-separate for multiple lanes, globs allowed.")
+	flagR2File       = newFileListFlag("r2", "Path to R2 file(s); repeat or comma-separate for multiple lanes, globs allowed.")
+	flagI1File       = newFileListFlag("i1", "Path to I1 (index 1) file(s).")
+	flagI2File       = newFileListFlag("i2", "Path to I2 (index 2) file(s).")
+	flagUMIFile      = newFileListFlag("umi", "Path to UMI read file(s).")
+	flagUBAMFile     = newFileListFlag("ubam", "Path to unaligned BAM file(s); replaces FASTQ inputs, roles are taken from READ1/READ2 flags and BC/RX tags.")
 	flagPatternsFile = flag.String("p", "", "Path to Hyperscan-complatible PCRE patterns table file.")
+	flagRounds       = flag.String("rounds", "", "Path to split-pool barcode rounds file, in place of '-p'; lines '<round> <pattern file> <role> <anchor: start|prev> <min> <max>'.")
 
 	// database flags
 	flagRecompile = flag.Bool("c", false, "Force pattern database recompile.")
 
 	// global output options
 	// => match / non-match output options
-	flagLTrim   = flag.Bool("L", false, "Trim sequence left/upstream of match.")
-	flagRTrim   = flag.Bool("R", false, "Trim sequence right/downstream of match.")
-	flagMTrim   = flag.Bool("M", false, "Trim matched sequence.")
-	flagRevComp = flag.Bool("r", false, "Reverse-complement output.")
+	flagLTrim    = flag.Bool("L", false, "Trim sequence left/upstream of match.")
+	flagRTrim    = flag.Bool("R", false, "Trim sequence right/downstream of match.")
+	flagMTrim    = flag.Bool("M", false, "Trim matched sequence.")
+	flagRevComp  = flag.Bool("r", false, "Reverse-complement output.")
+	flagRCPolicy = flag.String("rc-policy", "N", "Characters other than IUPAC codes when reverse complementing: 'N' (write as N), 'skip' (don't write the read set) or 'abort'.")
+	// => streaming options, for long reads
+	flagStreamChunk = flag.Int("stream", 0, "Scan FASTQ reads as they're read, in chunks of at most this many bases, with a stream pattern database, for long reads; reads are only kept in memory to be written with '-q', '-bam' or '-sam' (0 = scan whole reads).")
+	flagSOMHorizon  = flag.String("som-horizon", "large", "Start of match precision with '-stream': 'small' (matches starting within 64 KiB of their end), 'medium' (4 GiB) or 'large'.")
+	// => strand options
+	flagBothStrands = flag.Bool("both-strands", false, "Also scan for the reverse complement of each pattern, as the same ID and sample; hits report their strand.")
+	flagOrient      = flag.Bool("orient", false, "Reverse-complement reads matched on the reverse strand ('-both-strands'), so the barcode reads 5'->3'.")
+	// => concatemer splitting, for long reads
+	flagSplit = flag.Bool("split", false, "Split reads at barcode hits into segments '<read>_seg<N>', each written to its own sample; reads with segments of more than one sample are counted as chimeras. Patterns need the 'L' flag.")
+	// => fixed-position layouts
+	flagReadStructure = flag.String("rs", "", "Read structures by role, comma-separated, eg: 'R1:8B12M+T,R2:+T'; B = barcode (scanned), M = UMI, T = template (output), S = skip.")
+	// => mate-aware trimming options
+	flagMateTrim  = flag.String("mate-trim", "", "Mate trim rules '<target>:<mode>:<source>', comma-separated; modes: 'rc' (trim target at reverse complement of source's upstream + match), 'same' (trim same 5' region as source). Eg: 'R2:rc:R1'.")
+	flagMinLen    = flag.Int("min-len", 0, "Minimum output read length after trimming; shorter read sets are dropped or binned (0 = no limit).")
+	flagShort     = flag.String("short", "drop", "Read sets shorter than '-min-len': 'drop', or 'bin' to write them to a separate 'too_short' output.")
+	flagSwapMates = flag.Bool("swap-mates", false, "Swap the R1 and R2 output of read pairs assigned by a hit in R2, so the barcoded mate is always written as R1; both mates of assigned pairs are written, swapped records are marked in headers.")
+	// => masking options; comma-separated 'N', 'lower' and/or 'qual'
+	flagMaskUp    = flag.String("mask-up", "", "Mask sequence left/upstream of match: 'N', 'lower' and/or 'qual', comma-separated.")
+	flagMaskMatch = flag.String("mask-match", "", "Mask matched sequence: 'N', 'lower' and/or 'qual', comma-separated.")
+	flagMaskDown  = flag.String("mask-down", "", "Mask sequence right/downstream of match: 'N', 'lower' and/or 'qual', comma-separated.")
+	flagMaskQual  = flag.String("mask-qual", "#", "Base quality character for 'qual' masking.")
+	// => quality-aware matching options
+	flagQualMask      = flag.Int("qmask", 0, "Mask bases below this Phred quality to 'N' before scanning (0 = off).")
+	flagMatchMinQual  = flag.Int("match-min-qual", 0, "Reject matches with any base below this Phred quality (0 = off).")
+	flagMatchMeanQual = flag.Float64("match-mean-qual", 0, "Reject matches with a mean Phred quality below this (0 = off).")
 	// => FASTQ output options
 	flagFASTQOut  = flag.Bool("q", false, "Print FASTQ output.")
-	flagFASTQMSeq = flag.Bool("m", true, "Include matched sequence in FASTQ / ID output formats.")
+	flagFASTQMSeq = flag.Bool("m", true, "Include matched sequence in FASTQ '+' line / ID output formats.")
+	flagHeader    = flag.String("H", "{comment}", "FASTQ header comment template; placeholders: {comment} {sample} {id} {from} {to} {match} {matchqual} {umi} {role} {illumina}.")
+	flagPlusInfo  = flag.Bool("P", false, "Write match info on the FASTQ '+' line (legacy format).")
+	// => uBAM / SAM output options
+	flagBAMOut     = flag.Bool("bam", false, "Write unaligned BAM output, one file per sample.")
+	flagSAMOut     = flag.Bool("sam", false, "Write SAM output, one file per sample.")
+	flagReadGroups = flag.Bool("rg", false, "Write a single BAM / SAM file with a read group per sample.")
+	flagSamples    = flag.String("samples", "", "Path to sample sheet mapping pattern IDs to sample names.")
+	flagWhitelist  = flag.String("whitelist", "", "Path to cell barcode whitelist, one barcode per line (optionally gzipped); barcodes within one mismatch are corrected, others rejected.")
+	flagWLSource   = flag.String("wl-source", "", "Whitelist barcode source: '<role>:<from>-<to>' read region, eg: 'R1:0-16', or 'cap:<name>' capture group.")
+	flagWLQual     = flag.Bool("wl-qual", false, "Weigh whitelist corrections by base quality and barcode frequency.")
+	flagCapture    = flag.String("capture", "", "Path to capture regex file, '<pattern ID>:<regex>' per line; named groups are extracted from matches as '{cap:<name>}' header fields and, if named like a SAM tag, BAM/SAM tags.")
+	// => output file options
+	flagOutDir   = flag.String("outdir", ".", "Output directory.")
+	flagNameTmpl = flag.String("name", "", "Output file name template (without extension); placeholders: {basename} {sample} {snum} {id} {mate} {lane}, or preset 'bclconvert'.")
+	flagForce    = flag.Bool("force", false, "Overwrite existing output files.")
+	flagMaxOpen  = flag.Int("maxopen", 256, "Maximum number of output files open at once; less recently used files are closed and reopened as needed (0 = no limit).")
+	// => stats report options
+	flagStats   = flag.String("stats", "", "Stats report path prefix, writes <prefix>.json and <prefix>.tsv (default with file output: <outdir>/<basename>.hs_dmux.stats).")
+	flagMultiQC = flag.Bool("multiqc", false, "Also write MultiQC custom content files <prefix>.*_mqc.json.")
+	flagHTML    = flag.Bool("html", false, "Also write a self-contained HTML report <prefix>.html.")
 	// generic match output
 	flagPrintID = flag.Bool("i", false, "Print ID of sequence record.")
+	flagHits    = flag.String("hits", "", "Write a hit table, one row per match; TSV, or JSON Lines if the file name ends in '.jsonl'.")
+	flagHitsAll = flag.Bool("hits-all", false, "Write every hit to the hit table, not just the hit each read set is assigned by.")
+	flagIndex   = flag.String("index", "", "Write a binary hit index for re-making outputs with 'emit'; with 'emit', the hit index to read.")
 	//	flagByteOffset = flag.Bool("b", false, "Display offset in bytes of a matched pattern.")
 
 	// logging / debug options
@@ -89,31 +139,27 @@ var (
 	flagDebug   = flag.Bool("d", false, "Debug mode.")
 	flagSilent  = flag.Bool("s", false, "Silent mode.")
 
-	// fileWriters map of GzipWriters
-	fileWriters GzipWriters
-)
-
-// InputSet = Set of required files for validation purposes
-type InputSet struct {
-	R1Filepath   string
-	R2Filepath   string
-	PatternsFile string
-	OK           bool
-} // TODO: this isn't necessary, remove later
-
-// GzipWriters for storing pointers to io.Writers
-type GzipWriters map[uint]*gzip.Writer
+	// fileWriters pool of RecordWriters by output file name
+	fileWriters *WriterPool
 
-// => index type 'uint' here matches 'id' type of hyperscan match
+	// emitCommand = true for the 'emit' sub-command, which replays a hit
+	// index ('-index') against the original input instead of scanning
+	emitCommand bool
+)
 
 var theme = func(s string) string { return s }
 
-func init() {
-	fileWriters = make(GzipWriters)
-
+// parses flags and sets up logging; called from main, not init, so tests
+// don't parse the test binary's flags
+func parseFlags() {
 	// TODO: re-evaluate 'packr'
 	//	box := packr.NewBox("./.packr")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "emit" {
+		emitCommand = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	// setting DebugFlag = false will cause parameters
 	// with values that don't pass validation to be deleted
@@ -169,31 +215,74 @@ func highlight(s string) string {
 // FASTQRecord contains the data from a fasta fastq record
 type FASTQRecord struct {
 	InputFileBasename, Name, Seq, Qual string
+	Role                               ReadRole
+	Lane                               string
+	// UMI sequence from the UMI read of the same read set, if any
+	UMI string
+	// offset of the scanned segment in the read, for read structure barcodes
+	ScanOffset uint64
+	// cell barcode of the read set, if checked against a whitelist
+	CellBarcode CellBarcode
 }
 
-// DemuxRecord probably isn't necessary
-type DemuxRecord struct {
-	R1 FASTQRecord
-	R2 FASTQRecord
-} // TODO: remove this
+// HitOutput = output for a single hit, ready to be written or printed
+type HitOutput struct {
+	Record OutputRecord
+	// output regions, for the '-i' and plain text formats
+	Left, Match, Right string
+}
 
-// DemuxReaders also probably aren't needed
-type DemuxReaders struct {
-	R1 *fasta.FqReader
-	R2 *fasta.FqReader
-} //TODO: remove this
+// collects hits in the read set being scanned; output is made for the whole
+// read set once all its reads are scanned, see emitReadSet
+func eventHandler(id uint, from, to uint64, flags uint, context interface{}) error {
 
-// DemuxScratch hyperscan scratch space
-type DemuxScratch struct {
-	R1 *hyperscan.Scratch
-	R2 *hyperscan.Scratch
-} //TODO: remove this
+	fastq := context.(FASTQRecord)
+	from, to = fastq.ScanOffset+from, fastq.ScanOffset+to
 
-var demuxSet [4]FASTQRecord
+	// => matches can run into the "\n" terminating the scanned data
+	seq := strings.TrimSpace(fastq.Seq)
+	to = min(to, uint64(len(seq)))
+	from = min(from, to)
 
-func eventHandler(id uint, from, to uint64, flags uint, context interface{}) error {
+	matchQual := ""
+	if qual := strings.TrimSpace(fastq.Qual); to <= uint64(len(qual)) {
+		matchQual = qual[from:to]
+	}
+	addHit(id, fastq.Role, from, to, seq[from:to], matchQual)
+
+	return nil
+}
+
+// adds a match of a matcher ID in a read of role to the read set's hits,
+// from its bases and qualities as read; unless rejected by base quality
+func addHit(id uint, role ReadRole, from, to uint64, match, matchQual string) {
+	// => reverse strand siblings are hits of their pattern ID
+	id, reverse := strandID(id)
+	hit := Hit{ID: id, Role: role, From: from, To: to, Reverse: reverse, MatchSeq: match, MatchQual: matchQual}
+	if matchQual != "" && !matchQualityOK(matchQual) {
+		runStats.QualityRejected++
+		runStats.id(id).QualityRejected++
+		return
+	}
+	// => matches are captured and verified as the pattern's strand
+	if reverse {
+		match = reverseComplementSeq(match)
+	}
+	if _, ok := captureRegexes[id]; ok {
+		var captured bool
+		hit.Captures, captured = captureFields(id, match, int(hit.From), reverse)
+		hit.CaptureFailed = !captured
+	}
+	if edits, ok := verifyMatch(id, match); ok {
+		hit.Edits = &edits
+	}
+	readSetHits = append(readSetHits, hit)
+}
 
-	fastq := FASTQRecord{context.(FASTQRecord).InputFileBasename, context.(FASTQRecord).Name, context.(FASTQRecord).Seq, context.(FASTQRecord).Qual}
+// returns the output for a hit in a read; output is limited to the keep
+// window, as set by mate trim rules
+func hitOutput(hit Hit, fastq FASTQRecord, keep KeepWindow) HitOutput {
+	id, from, to := hit.ID, hit.From, hit.To
 
 	// TODO: can maybe be optimized
 	inputData := []byte(strings.TrimSpace(fastq.Seq) + "\n")
@@ -225,85 +314,139 @@ func eventHandler(id uint, from, to uint64, flags uint, context interface{}) err
 
 	var seqLeftString, qualLeftString, seqMatchString, qualMatchString, seqRightString, qualRightString string
 
+	// => upstream / downstream are of the barcode, so swapped for reads
+	// reoriented by '-orient'
+	reversed := outputReversed(hit, fastq.Role)
+	lTrim, rTrim := *flagLTrim, *flagRTrim
+	maskUp, maskDown := maskUpstream, maskDownstream
+	if reversed && !*flagRevComp {
+		lTrim, rTrim = rTrim, lTrim
+		maskUp, maskDown = maskDown, maskUp
+	}
+
 	// optionally trim sequence left / upstream of match
-	if *flagLTrim {
+	if lTrim {
 		seqLeftString = ""
 		qualLeftString = ""
 	} else {
-		seqLeftString = string(inputData[:from])
-		qualLeftString = string(inputQual[:from])
+		start, end := keep.clip(0, int(from))
+		seqLeftString = string(inputData[start:end])
+		qualLeftString = string(inputQual[start:end])
 	}
 
 	// optionally trim sequence that was matched
-	// TODO: masking options
 	if *flagMTrim {
 		seqMatchString = ""
 		qualMatchString = ""
 	} else {
-		seqMatchString = string(inputData[from:to])
-		qualMatchString = string(inputQual[from:to])
+		start, end := keep.clip(int(from), int(to))
+		seqMatchString = string(inputData[start:end])
+		qualMatchString = string(inputQual[start:end])
 	}
 
 	// optionally trim sequence right / downstream of match
-	if *flagRTrim {
+	if rTrim {
 		seqRightString = ""
 		qualRightString = ""
 	} else {
-		seqRightString = string(inputData[to:matchEndPos])
-		qualRightString = string(inputQual[to:matchEndPos])
+		start, end := keep.clip(int(to), matchEndPos)
+		seqRightString = string(inputData[start:end])
+		qualRightString = string(inputQual[start:end])
 	}
 
+	// optionally mask regions that were kept
+	seqLeftString, qualLeftString = applyMask(seqLeftString, qualLeftString, maskUp)
+	seqMatchString, qualMatchString = applyMask(seqMatchString, qualMatchString, maskMatch)
+	seqRightString, qualRightString = applyMask(seqRightString, qualRightString, maskDown)
+
 	// prepare output strings for writing
 	// TODO: mode specific?
 	outSeq := seqLeftString + seqMatchString + seqRightString
 	outQual := qualLeftString + qualMatchString + qualRightString
 	outName := fastq.Name
 
-	// reverse complement the output if user requested
-	if *flagRevComp {
+	matchSeq, matchQual := string(inputData[from:to]), string(inputQual[from:to])
+
+	// reverse complement the output if user requested, or to orient the barcode
+	if reversed {
 		outSeq = reverseComplementDNA(outSeq)
 		outQual = reverse(outQual)
 	}
+	if *flagOrient && hit.Reverse {
+		matchSeq = reverseComplementDNA(matchSeq)
+		matchQual = reverse(matchQual)
+	}
+
+	// TODO: this is FASTQ specific
+	outID := getReadID(outName)
+
+	return HitOutput{
+		Record: OutputRecord{
+			ID:                id,
+			Role:              fastq.Role,
+			Lane:              fastq.Lane,
+			InputFileBasename: fastq.InputFileBasename,
+			Name:              outName,
+			ReadID:            outID,
+			Seq:               outSeq,
+			Qual:              outQual,
+			From:              from,
+			To:                to,
+			MatchSeq:          matchSeq,
+			MatchQual:         matchQual,
+			Reverse:           hit.Reverse,
+			UMI:               fastq.UMI,
+			Captures:          hit.Captures,
+			Cell:              hit.Cell,
+			Edits:             hit.Edits,
+			CellBarcode:       fastq.CellBarcode,
+		},
+		Left:  seqLeftString,
+		Match: seqMatchString,
+		Right: seqRightString,
+	}
+}
 
-	// use a regex to parse out FASTQ read ID
-	// TODO: Fix this hack; this is FASTQ specific
-	reID := regexp.MustCompile(`^@(\S+)`)
-	outID := reID.FindStringSubmatch(outName)[1]
-
-	if *flagFASTQOut {
-		if fileWriters[id] == nil {
-			outputGzFastqFile := fastq.InputFileBasename + "." + fmt.Sprintf("%d", id) + ".hs_dmux.fastq.gz"
-			fileWriters[id] = getGzWriter(outputGzFastqFile)
-		}
-		gzWriter := fileWriters[id]
-
-		matchSeq := ""
-		if *flagFASTQMSeq {
-			matchSeq = " " + seqMatchString
-		}
-		gzWriter.Write([]byte(fmt.Sprintf("%s\n%s\n%s\n%s\n", outName, outSeq, "+"+outID+" "+fmt.Sprint(id)+":"+fmt.Sprint(from)+"-"+fmt.Sprint(to)+matchSeq, outQual)))
+// writes or prints a hit output in the selected output format
+func emitHitOutput(output HitOutput) {
+	record := output.Record
+	if *flagFASTQOut || *flagBAMOut || *flagSAMOut {
+		writeOutputRecord(record)
 	} else if *flagPrintID {
 		matchSeq := ""
 		if *flagFASTQMSeq {
-			matchSeq = " " + seqMatchString
+			matchSeq = " " + output.Match
 		}
-		fmt.Printf("%s %s\n", fastq.InputFileBasename, outID+" "+fmt.Sprint(id)+":"+fmt.Sprint(from)+"-"+fmt.Sprint(to)+matchSeq)
+		fmt.Printf("%s %s\n", record.InputFileBasename, record.ReadID+" "+fmt.Sprint(record.ID)+":"+fmt.Sprint(record.From)+"-"+fmt.Sprint(record.To)+matchSeq)
 	} else {
-		fmt.Printf("%s%s%s\n", seqLeftString, theme(seqMatchString), seqRightString)
+		fmt.Printf("%s%s%s\n", output.Left, theme(output.Match), output.Right)
 	}
-
-	return nil
 }
 
 func main() {
+	parseFlags()
 	if !*flagSilent {
 		fmt.Fprint(os.Stderr, highlight("HIKEEBA!")+" "+cyan(Cmd)+" "+"["+fmt.Sprintf("%s %s(%s) DEBUG=%t", Binary, Version, BuildDate, Debug)+"] // Brett Whitty <brettwhitty@gmail.com>\n")
 	}
-	if *flagR1File == "" || *flagR2File == "" {
+	readSet := newReadSet()
+	if len(readSet) == 0 {
 		fmt.Fprintf(os.Stderr, "Usage: %s ["+green("flags")+"] <"+cyan("pattern file")+"> <"+cyan("input file")+">\n", highlight(Binary))
+		fmt.Fprintf(os.Stderr, "       %s emit -index <"+cyan("hit index")+"> ["+green("flags")+"] <"+cyan("input file")+">\n", highlight(Binary))
 		flag.PrintDefaults()
 		os.Exit(-1)
 	}
+	outputFormats := 0
+	for _, f := range []bool{*flagFASTQOut, *flagBAMOut, *flagSAMOut} {
+		if f {
+			outputFormats++
+		}
+	}
+	if outputFormats > 1 {
+		log.Fatal("Only one of the FASTQ ('-q'), BAM ('-bam') or SAM ('-sam') output formats can be selected!")
+	}
+	if *flagReadGroups && !(*flagBAMOut || *flagSAMOut) {
+		log.Fatal("Read group output ('-rg') requires BAM ('-bam') or SAM ('-sam') output!")
+	}
 	if !*flagNoColor {
 		// enable color if supported, unless disabled by flag
 		stat, _ := os.Stdout.Stat()
@@ -320,101 +463,241 @@ func main() {
 	//pattern := hyperscan.NewPattern(flag.Arg(0), hyperscan.SomLeftMost|hyperscan.Caseless)
 	patternFile := *flagPatternsFile
 
-	inputSet := InputSet{*flagR1File, *flagR2File, *flagPatternsFile, false}
-
-	readerR1, bar := getFQReader(inputSet.R1Filepath, true)
-	readerR2, _ := getFQReader(inputSet.R2Filepath, false)
-
-	// TODO: fix this hack
-	r1FileBasename, r1OK := getGzFastqBasename(inputSet.R1Filepath)
-	if !r1OK {
-		log.Fatal("R1 file doesn't have '.fastq.gz' suffix as expected!")
+	headerTemplate = parseHeaderTemplate(*flagHeader)
+	parseMaskFlags()
+	checkQualityFlags()
+	checkRevCompPolicy()
+	mateTrimRules = parseMateTrimRules(*flagMateTrim)
+	readStructures = parseReadStructures(*flagReadStructure)
+	if *flagCapture != "" {
+		captureRegexes = readCaptureFile(*flagCapture)
+	}
+	if *flagWhitelist != "" {
+		whitelist = loadWhitelist(*flagWhitelist, *flagWLSource, *flagWLQual)
+	}
+	if *flagShort != "drop" && *flagShort != "bin" {
+		log.Fatal(fmt.Sprintf("Unknown '-short' action '%s'! Supported: drop, bin", *flagShort))
+	}
+	switch {
+	case *flagStreamChunk < 0:
+		log.Fatal("Stream chunk size ('-stream') can't be negative!")
+	case *flagSOMHorizon != "small" && *flagSOMHorizon != "medium" && *flagSOMHorizon != "large":
+		log.Fatal(fmt.Sprintf("Unknown start of match horizon '%s'! Supported: small, medium, large", *flagSOMHorizon))
+	case *flagStreamChunk > 0:
+		checkStreamFlags(patternFile)
+	}
+	if *flagRounds != "" {
+		switch {
+		case patternFile != "":
+			log.Fatal("Use either a pattern file ('-p') or split-pool barcode rounds ('-rounds'), not both!")
+		case *flagReadGroups:
+			log.Fatal("Read group output ('-rg') can't be used with split-pool barcode rounds ('-rounds')!")
+		case emitCommand || *flagIndex != "":
+			log.Fatal("Hit indexes ('-index') don't record split-pool barcode rounds ('-rounds')!")
+		}
+		barcodeRounds = readRoundsFile(*flagRounds)
+		checkRoundPatterns(barcodeRounds)
 	}
-	r2FileBasename, r2OK := getGzFastqBasename(inputSet.R2Filepath)
-	if !r2OK {
-		log.Fatal("R2 file doesn't have '.fastq.gz' suffix as expected!")
+	if *flagSplit {
+		checkSplitFlags(patternFile)
+	}
+	switch {
+	case *flagOrient && !*flagBothStrands:
+		log.Fatal("Orienting reads ('-orient') requires both-strand scanning ('-both-strands')!")
+	case *flagOrient && *flagRevComp:
+		log.Fatal("Use either '-orient' or '-r' to reverse-complement output, not both!")
+	case *flagBothStrands && *flagRounds != "":
+		log.Fatal("Both-strand scanning ('-both-strands') can't be used with split-pool barcode rounds ('-rounds')!")
 	}
 
-	// Read our pattern set in and build Hyperscan databases from it.
-	log.Info(fmt.Sprintf("Pattern file: %s\n", patternFile))
-	//dbStreaming, dbBlock := databasesFromFile(patternFile)
-	database := blockDatabaseFromFile(patternFile)
-	defer database.Close()
-
-	scratch, err := hyperscan.NewScratch(database)
-	checkErr(err, fmt.Sprintf("Unable to allocate scratch space. Exiting."))
-	defer scratch.Free()
-
-	var demuxScratch DemuxScratch
-
-	// scratch clones for demux threads
-	demuxScratch.R1, err = scratch.Clone()
-	checkErr(err)
-	demuxScratch.R2, err = scratch.Clone()
-	checkErr(err)
+	var sampleOrder []string
+	if *flagSamples != "" {
+		sampleSheet, sampleOrder = readSampleSheet(*flagSamples)
+	}
+	var index *HitIndexReader
+	if emitCommand {
+		if *flagIndex == "" {
+			log.Fatal("'emit' requires a hit index ('-index')!")
+		}
+		index = openHitIndex(*flagIndex)
+		defer index.Close()
+		patternIDs = index.patternIDs
+	} else if len(barcodeRounds) == 0 {
+		patternIDs = getPatternIDs(patternFile)
+	}
+	if patternFile != "" {
+		nominalPatterns = getNominalPatterns(parseFile(patternFile))
+	}
+	assignSampleNumbers(sampleOrder, patternIDs)
+
+	nameTemplate = getNameTemplate(*flagNameTmpl)
+	fileWriters = newWriterPool(*flagMaxOpen)
+	if *flagFASTQOut || *flagBAMOut || *flagSAMOut || *flagMultiQC || *flagHTML {
+		makeOutDir()
+	}
+	// don't leave partial output files behind on fatal errors
+	log.RegisterExitHandler(removeTempOutputFiles)
+	var matcher Matcher
+	if len(barcodeRounds) > 0 {
+		openRoundMatchers(barcodeRounds)
+		defer closeRoundMatchers(barcodeRounds)
+	} else if !emitCommand {
+		// Read our pattern set in and build a matcher from it.
+		log.Info(fmt.Sprintf("Pattern file: %s (%s)\n", patternFile, matchEngine))
+		//dbStreaming, dbBlock := databasesFromFile(patternFile)
+		matcher = newMatcherFromFile(patternFile)
+		defer matcher.Close()
+	}
+
+	// readers and matcher clones for each input read role
+	bar := readSet.open(matcher)
+	defer readSet.close()
+	// output files not specific to a read role are named from the first input
+	outputBasename = readSet[0].Basename
+	pairedInput = readSet.hasRole(RoleR1) && readSet.hasRole(RoleR2)
+	if *flagSwapMates && !pairedInput {
+		log.Fatal("Swapping mates ('-swap-mates') requires paired R1 and R2 input!")
+	}
+
+	statsPrefix := *flagStats
+	if statsPrefix == "" && (*flagFASTQOut || *flagBAMOut || *flagSAMOut || *flagMultiQC || *flagHTML) {
+		statsPrefix = filepath.Join(*flagOutDir, outputBasename+".hs_dmux.stats")
+	}
+
+	// => refuse to overwrite outputs before scanning, not part way through
+	checkOutputFiles(readSet, statsPrefix)
+	if *flagHits != "" {
+		hitTable = newHitTableWriter(*flagHits, *flagHitsAll)
+	}
+	if emitCommand {
+		index.checkReadSet(readSet)
+	} else if *flagIndex != "" {
+		hitIndex = newHitIndexWriter(*flagIndex, patternIDs, readSet)
+	}
 
-	doneCount := 0
-	seqCountR1 := 0
-	seqCountR2 := 0
 	for {
-		/*
-			R1
-		*/
-		fqR1, doneR1 := readerR1.Iter()
-		if doneR1 {
-			doneCount++
-		}
-		rR1 := FASTQRecord{InputFileBasename: r1FileBasename, Name: fqR1.Name, Seq: fqR1.Seq, Qual: fqR1.Qual}
-		log.Debug(rR1.Name)
-		scanFastqRecord(database, demuxScratch.R1, rR1)
-		seqCountR1++
-		/*
-			R2
-		*/
-		fqR2, doneR2 := readerR2.Iter()
-		if doneR2 {
-			doneCount++
-		}
-		rR2 := FASTQRecord{InputFileBasename: r2FileBasename, Name: fqR2.Name, Seq: fqR2.Seq, Qual: fqR2.Qual}
-		log.Debug(rR2.Name)
-		scanFastqRecord(database, demuxScratch.R2, rR2)
-		seqCountR2++
-		if doneCount >= 1 {
-			if doneCount == 2 {
+		// => streamed reads are scanned as they're read, see scanStreamRecord
+		readSetHits = readSetHits[:0]
+		records, done := readSet.next()
+		if done {
+			if bar != nil {
 				bar.Finish()
+			}
 
-				log.Debug(fmt.Sprintf("%d %d", seqCountR1, seqCountR2))
+			if emitCommand {
+				index.finish()
+			}
 
-				// close any open gzip filewriters
-				for _, fw := range fileWriters {
-					fw.Close()
-				}
+			log.Debug(readSet.counts())
+			readSet.logLaneCounts()
+
+			log.Info(fmt.Sprintf("Read sets: %d, assigned: %d, undetermined: %d, ambiguous: %d", runStats.ReadSets, runStats.Assigned, runStats.Undetermined, runStats.Ambiguous))
+			if whitelist != nil {
+				log.Info(fmt.Sprintf("Whitelist exact: %d, corrected: %d, rejected: %d; read sets rejected: %d", runStats.WhitelistExact, runStats.WhitelistCorrected, runStats.WhitelistRejected, runStats.Rejected))
+			}
+			if matchQualityFiltered() {
+				log.Info(fmt.Sprintf("Matches rejected by base quality: %d", runStats.QualityRejected))
+			}
+			if runStats.RevCompInvalid > 0 {
+				log.Info(fmt.Sprintf("Read sets with unexpected characters reverse complementing (%s): %d, skipped: %d", *flagRCPolicy, runStats.RevCompInvalid, runStats.RevCompSkipped))
+			}
+			if *flagSwapMates {
+				log.Info(fmt.Sprintf("Read pairs with mates swapped: %d", runStats.MatesSwapped))
+			}
+			if *flagSplit {
+				log.Info(fmt.Sprintf("Read segments: %d, chimeric reads: %d", runStats.Segments, runStats.Chimeras))
+			}
+			if *flagMinLen > 0 {
+				log.Info(fmt.Sprintf("Read sets shorter than %d after trimming (%s): %d", *flagMinLen, *flagShort, runStats.TooShort))
+			}
 
-				// close any open gzip filewriters
-				for _, fw := range fileWriters {
-					fw.Close()
+			// close any open output filewriters, then move outputs into place
+			closeOutputWriters()
+			if hitTable != nil {
+				hitTable.Close()
+			}
+			if hitIndex != nil {
+				hitIndex.Close()
+			}
+			if statsPrefix != "" {
+				report := runStats.report(readSet)
+				writeStatsReport(report, statsPrefix)
+				if *flagMultiQC {
+					writeMultiQCReport(report, statsPrefix)
 				}
+				if *flagHTML {
+					writeHTMLReport(report, statsPrefix)
+				}
+			}
+			finalizeOutputFiles()
 
-				break
-			} else {
-				log.Error(fmt.Sprintf("%d %d", seqCountR1, seqCountR2))
-				log.Fatal("Encountered input file record mismatch!!!")
-				os.Exit(-1)
+			break
+		}
+
+		umi := readStructureUMI(readStructures, readSet.umi(records), records)
+		for i := range records {
+			records[i].UMI = umi
+		}
+		if emitCommand {
+			index.replay(records)
+		} else if len(barcodeRounds) > 0 {
+			readSetHits = append(readSetHits, chainRounds(records)...)
+		} else if *flagStreamChunk == 0 {
+			for i, record := range records {
+				log.Debug(record.Name)
+				scanFastqRecord(readSet[i].Matcher, record)
 			}
 		}
+		if hitIndex != nil {
+			hitIndex.writeReadSet(readSetHits)
+		}
+		// => read sets are checked against the whitelist, if any; rejected
+		// read sets aren't written or assigned, and read sets without hits
+		// can be assigned by their cell barcode alone
+		rejected := false
+		if whitelist != nil {
+			var accepted bool
+			readSetHits, accepted = whitelist.checkReadSet(records, readSetHits)
+			rejected = !accepted
+		}
+		// => streamed reads are written as spooled, see scanStreamRecord
+		if !rejected {
+			emitReadSet(records, readSetHits)
+		}
+		runStats.addReadSet(records, readSetHits, rejected)
+		if hitTable != nil {
+			hitTable.writeReadSet(records, readSetHits, rejected)
+		}
 	}
 
 	return
 }
 
-func scanFastqRecord(database hyperscan.BlockDatabase, scratch *hyperscan.Scratch, record FASTQRecord) {
+func scanFastqRecord(matcher Matcher, record FASTQRecord) {
 	// => strings.TrimSpace() may be overkill here
+	seq := qualityMaskSeq(strings.TrimSpace(record.Seq), strings.TrimSpace(record.Qual))
+
+	// => only the barcode segments of reads with a read structure are scanned
+	if structure, ok := readStructures[record.Role]; ok {
+		for _, span := range structure.spans(len(seq)) {
+			if span.Type == segmentBarcode && span.To > span.From {
+				record.ScanOffset = uint64(span.From)
+				scanData(matcher, seq[span.From:span.To], record)
+			}
+		}
+		return
+	}
+
+	scanData(matcher, seq, record)
+}
+
+// scans a sequence, reporting hits in record to eventHandler
+func scanData(matcher Matcher, seq string, record FASTQRecord) {
 	// eventHandler is expecting input is a line terminated with "\n"
-	inputData := []byte(strings.TrimSpace(record.Seq) + "\n")
+	inputData := []byte(seq + "\n")
 
-	if err := database.Scan(inputData, scratch, eventHandler, record); err != nil {
+	if err := matcher.Scan(inputData, eventHandler, record); err != nil {
 		log.Fatal("ERROR: Unable to scan input buffer. Exiting.")
-		os.Exit(-1)
 	}
 }
 
@@ -423,158 +706,13 @@ func checkErr(err error, optMsg ...string) {
 	if len(optMsg) > 0 {
 		msg = optMsg[0]
 	}
+	// => log.Fatal runs the exit handlers, removing temporary output files
 	if err != nil {
-		if msg != "" {
-			log.Fatal(msg)
-		}
-		os.Exit(-1)
-	}
-}
-
-func reverse(s string) string {
-	runes := []rune(s)
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
-	}
-	return string(runes)
-}
-
-func reverseComplementDNA(s string) string {
-	fwd := "atgcn.ATGCN."
-	rvs := "tacgn.TACGN."
-
-	comp := map[rune]rune{
-		[]rune(fwd)[0]:  []rune(rvs)[0],
-		[]rune(fwd)[1]:  []rune(rvs)[1],
-		[]rune(fwd)[2]:  []rune(rvs)[2],
-		[]rune(fwd)[3]:  []rune(rvs)[3],
-		[]rune(fwd)[4]:  []rune(rvs)[4],
-		[]rune(fwd)[5]:  []rune(rvs)[5],
-		[]rune(fwd)[6]:  []rune(rvs)[6],
-		[]rune(fwd)[7]:  []rune(rvs)[7],
-		[]rune(fwd)[8]:  []rune(rvs)[8],
-		[]rune(fwd)[9]:  []rune(rvs)[9],
-		[]rune(fwd)[10]: []rune(rvs)[10],
-		[]rune(fwd)[11]: []rune(rvs)[11],
-	}
-
-	runes := []rune(s)
-	// check that we have a mapping for all characters we encounter
-	for _, c := range runes {
-		_, cExists := comp[c]
-		if !cExists {
-			log.Fatal(fmt.Sprintf("Unexpected character in:\n%s\n", s))
-		}
-	}
-
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = comp[runes[j]], comp[runes[i]]
-	}
-
-	return string(runes)
-}
-
-func parseFile(filename string) (patterns []*hyperscan.Pattern) {
-	// open pattern file for reading
-	data, err := ioutil.ReadFile(filename)
-	checkErr(err, fmt.Sprintf("Can't read pattern file '%s'", filename))
-
-	reader := bufio.NewReader(bytes.NewBuffer(data))
-	eof := false
-	lineno := 0
-
-	for !eof {
-		line, err := reader.ReadString('\n')
-
-		switch err {
-		case nil:
-			// pass
-		case io.EOF:
-			eof = true
-		default:
-			fmt.Fprintf(os.Stderr, highlight("ERROR: ")+"Can't read pattern file %s, %s\n", filename, err)
-			os.Exit(-1)
-		}
-
-		line = strings.TrimSpace(line)
-		lineno++
-
-		// if line is empty, or a comment, we can skip it
-		if len(line) == 0 || line[0] == '#' {
-			continue
-		}
-
-		// otherwise, it should be ID:PCRE, e.g.
-		//  10001:/foobar/is
-		strs := strings.SplitN(line, ":", 2)
-		// TODO: Need to add support for parsing extended attribute flags...
-		//  10001:/foobar/is{key1=value1,key2=value2,...}
-
-		// parse the pattern ID
-		id, err := strconv.ParseInt(strs[0], 10, 64)
-		checkErr(err, fmt.Sprintf("Could not parse id at line %d, %s", lineno, err))
-
-		// parse the pattern
-		pattern, err := hyperscan.ParsePattern(strs[1])
-		checkErr(err, fmt.Sprintf("Could not parse pattern at line %d, %s", lineno, err))
-
-		// set Id on the pattern
-		pattern.Id = int(id)
-
-		// add the pattern
-		patterns = append(patterns, pattern)
-	}
-
-	return
-}
-
-/**
- * This function will read in the file with the specified name, with an
- * expression per line, ignoring lines starting with '#' and build a Hyperscan
- * database for it.
- */
-func blockDatabaseFromFile(filename string) hyperscan.BlockDatabase {
-	dbFilename := getDbFilename(filename)
-
-	// remove existing compiled database if recompile flag set
-	if *flagRecompile {
-		if fileExists(dbFilename) {
-			err := os.Remove(dbFilename)
-			checkErr(err, fmt.Sprintf("Couldn't remove DB file '%s'! %s", dbFilename, err))
+		if msg == "" {
+			msg = err.Error()
 		}
+		log.Fatal(msg)
 	}
-
-	// short circuit compiling if we already have a serialized db
-	if fileExists(dbFilename) {
-		log.Debug("Serialized pattern DB exists, use '-c' flag to recompile from text.")
-		log.Info(fmt.Sprintf("Reading from pattern DB file: %s", dbFilename))
-		return readDbFile(dbFilename)
-	}
-
-	log.Info("Compiling patterns ... ")
-
-	// do the actual file reading and pattern parsing
-	patterns := parseFile(filename)
-
-	// compile a block database from the parsed patterns
-	bdb, err := hyperscan.NewBlockDatabase(patterns...)
-	checkErr(err, fmt.Sprintf("Could not compile patterns, %s", err))
-
-	log.Info(" ... DONE!")
-
-	// serialize the compiled database to save time on next run
-	log.Info("Serializing pattern DB ... ")
-	writeDbFile(dbFilename, bdb)
-	log.Info(" ... DONE!")
-
-	return bdb
-}
-
-// returns string to use as serialized pattern database file name
-func getDbFilename(filename string) string {
-	fileMD5, err := getFileMD5(filename)
-	checkErr(err, fmt.Sprintf("Failed to generate MD5 digest of %s", filename))
-	return filename + "." + fileMD5 + ".hsdb"
 }
 
 // check if a file exists by name
@@ -587,41 +725,6 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-// reads a pattern block database that we've previously serialized to a gzipped file
-func readDbFile(dbFilename string) hyperscan.BlockDatabase {
-	// open DB file for reading; should be gzipped
-	inFile, err := os.Open(dbFilename)
-	checkErr(err, fmt.Sprintf("Couldn't open DB file '%s' for reading! %s", dbFilename, err))
-	defer inFile.Close()
-
-	// create gzip stream reader
-	gzipReader, err := gzip.NewReader(inFile)
-	checkErr(err, fmt.Sprintf("Couldn't create gzip reader on DB file! %s", err))
-	defer gzipReader.Close()
-
-	dbData, err := ioutil.ReadAll(gzipReader)
-	checkErr(err, fmt.Sprintf("Could not read database file, %s", err))
-
-	bdb, err := hyperscan.UnmarshalBlockDatabase(dbData)
-	checkErr(err, fmt.Sprintf("Failed to unmarshall DB file! %s", err))
-
-	return bdb
-}
-
-// write a compiled block database to a gzipped file to avoid recompiling on next run
-func writeDbFile(dbFilename string, database hyperscan.BlockDatabase) {
-	// serialize the block database to bytes
-	dbData, err := database.Marshal()
-	checkErr(err, fmt.Sprintf("Could not serialize pattern DB, %s", err))
-
-	// get a gzip stream writer
-	gzWriter := getGzWriter(dbFilename)
-	defer gzWriter.Close()
-
-	// write gzip compressed DB bytes to file
-	gzWriter.Write(dbData)
-}
-
 // returns a pointer to a gzip.Writer
 func getGzWriter(filename string) *gzip.Writer {
 	// open a filehandle for writing the file
@@ -656,32 +759,22 @@ func getFileSizeInBytes(filename string) int64 {
 	return fileSizeInBytes
 }
 
-// returns pointer to a FASTQ reader;
-// if wantBar = true returns pointer to a pb.ProgressBar for read IO, otherwise nil
-func getFQReader(filename string, wantBar bool) (*fasta.FqReader, *pb.ProgressBar) {
-	// if wantBar = true, this will be progress bar for read IO
-	// ... otherwise = nil
-	var bar *pb.ProgressBar
-
+// returns pointer to a FASTQ reader and the underlying file, to be closed by the caller;
+// if bar != nil, read IO is reported to the progress bar
+func getFQReader(filename string, bar *pb.ProgressBar) (*fasta.FqReader, *os.File) {
 	// input is STDIN?
-	isSTDIN := strings.EqualFold("/dev/stdin", filename) || strings.EqualFold("stdin", filename) || strings.EqualFold("-", filename)
+	isSTDIN := isSTDINFilename(filename)
 
 	// check if input is gzipped
 	isGzip, err := regexp.MatchString(`\.gz$`, filename)
 	checkErr(err)
 
-	// TODO: move this into some sort of file integrity check?
-	// file size in bytes
-	var inputFileSizeBytes int64 = 0
-
 	var inFile *os.File
 	// open file for reading
 	if isSTDIN {
 		// input is STDIN
 		inFile = os.Stdin
 	} else {
-		inputFileSizeBytes = getFileSizeInBytes(filename)
-
 		// input is normal file
 		inFile, err = os.Open(filename)
 		checkErr(err)
@@ -689,15 +782,10 @@ func getFQReader(filename string, wantBar bool) (*fasta.FqReader, *pb.ProgressBa
 
 	var fileReader io.Reader
 
-	if *flagSilent {
+	if *flagSilent || bar == nil {
 		fileReader = inFile
 	} else {
-		if wantBar {
-			bar = pb.Full.Start64(inputFileSizeBytes)
-			fileReader = bar.NewProxyReader(inFile)
-		} else {
-			fileReader = inFile
-		}
+		fileReader = bar.NewProxyReader(inFile)
 	}
 
 	// set up a FASTQ reader, supporting gz'd stream
@@ -708,11 +796,15 @@ func getFQReader(filename string, wantBar bool) (*fasta.FqReader, *pb.ProgressBa
 		fqr.Reader = bufio.NewReader(gzipReader)
 	} else {
 		// get buffered reader
-		barReader := bar.NewProxyReader(fileReader)
-		fqr.Reader = bufio.NewReader(barReader)
+		fqr.Reader = bufio.NewReader(fileReader)
 	}
 
-	return &fqr, bar
+	return &fqr, inFile
+}
+
+// returns true if filename refers to STDIN
+func isSTDINFilename(filename string) bool {
+	return strings.EqualFold("/dev/stdin", filename) || strings.EqualFold("stdin", filename) || strings.EqualFold("-", filename)
 }
 
 // cut and paste md5 checksum code
@@ -0,0 +1,30 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testFatal = the panic value of log.Fatal during expectFatal
+type testFatal struct{}
+
+// runs fn, failing the test unless it exits with log.Fatal
+func expectFatal(t *testing.T, what string, fn func()) {
+	t.Helper()
+	logger := log.StandardLogger()
+	exit := logger.ExitFunc
+	logger.ExitFunc = func(int) { panic(testFatal{}) }
+	defer func() {
+		logger.ExitFunc = exit
+		if _, ok := recover().(testFatal); !ok {
+			t.Errorf("%s didn't exit with an error", what)
+		}
+	}()
+	fn()
+}
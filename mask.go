@@ -0,0 +1,91 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * mask.go
+ *
+ * => masking of the upstream, matched and downstream regions of a read,
+ *    keeping read length fixed while neutralizing barcode bases
+ *
+ */
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaskMode = set of masking operations for a read region
+type MaskMode uint8
+
+const (
+	// MaskN = replace bases with 'N'
+	MaskN MaskMode = 1 << iota
+	// MaskLower = lowercase bases
+	MaskLower
+	// MaskQual = set base qualities to the '-mask-qual' character
+	MaskQual
+)
+
+// mask mode names, as given in the '-mask-*' flags
+var maskModeNames = map[string]MaskMode{"N": MaskN, "lower": MaskLower, "qual": MaskQual}
+
+var (
+	// masks for the upstream, matched and downstream regions, from the '-mask-*' flags
+	maskUpstream, maskMatch, maskDownstream MaskMode
+	// maskQual = base quality character for 'qual' masking
+	maskQual byte
+)
+
+// returns the mask mode for a comma-separated list of mode names, eg: "N,qual"
+func parseMaskMode(text string) MaskMode {
+	var mode MaskMode
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		m, ok := maskModeNames[name]
+		if !ok {
+			log.Fatal(fmt.Sprintf("Unknown mask mode '%s'! Supported: N, lower, qual", name))
+		}
+		mode |= m
+	}
+	return mode
+}
+
+// sets the region masks and quality character from the '-mask-*' flags
+func parseMaskFlags() {
+	maskUpstream = parseMaskMode(*flagMaskUp)
+	maskMatch = parseMaskMode(*flagMaskMatch)
+	maskDownstream = parseMaskMode(*flagMaskDown)
+
+	if len(*flagMaskQual) != 1 || (*flagMaskQual)[0] < '!' || (*flagMaskQual)[0] > '~' {
+		log.Fatal(fmt.Sprintf("Mask quality ('-mask-qual') must be a single Phred+33 character, got '%s'!", *flagMaskQual))
+	}
+	maskQual = (*flagMaskQual)[0]
+}
+
+// returns the sequence and qualities of a region with mask applied
+func applyMask(seq, qual string, mask MaskMode) (string, string) {
+	if mask == 0 {
+		return seq, qual
+	}
+
+	if mask&MaskN != 0 {
+		seq = strings.Repeat("N", len(seq))
+	}
+	if mask&MaskLower != 0 {
+		seq = strings.ToLower(seq)
+	}
+	if mask&MaskQual != 0 {
+		qual = strings.Repeat(string(maskQual), len(qual))
+	}
+
+	return seq, qual
+}
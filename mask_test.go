@@ -0,0 +1,56 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMaskMode(t *testing.T) {
+	tests := []struct {
+		text string
+		want MaskMode
+	}{
+		{"", 0},
+		{"N", MaskN},
+		{"N,qual", MaskN | MaskQual},
+		{" lower , N,", MaskN | MaskLower},
+	}
+	for _, test := range tests {
+		if got := parseMaskMode(test.text); got != test.want {
+			t.Errorf("parseMaskMode(%q) = %b, want %b", test.text, got, test.want)
+		}
+	}
+	expectFatal(t, "an unknown mask mode", func() {
+		parseMaskMode("N,upper")
+	})
+}
+
+func TestApplyMask(t *testing.T) {
+	// => the default '-mask-qual' character, '#'
+	parseMaskFlags()
+	tests := []struct {
+		mode              string
+		wantSeq, wantQual string
+	}{
+		{"", "ACgt", "IIII"},
+		{"N", "NNNN", "IIII"},
+		{"lower", "acgt", "IIII"},
+		{"N,lower", "nnnn", "IIII"},
+		{"qual", "ACgt", "####"},
+		{"N,qual", "NNNN", "####"},
+	}
+	for _, test := range tests {
+		seq, qual := applyMask("ACgt", "IIII", parseMaskMode(test.mode))
+		if seq != test.wantSeq || qual != test.wantQual {
+			t.Errorf("%q mask = %s %s, want %s %s", test.mode, seq, qual, test.wantSeq, test.wantQual)
+		}
+	}
+	// => regions keep their length
+	if seq, qual := applyMask("", "", MaskN|MaskQual); seq != "" || qual != "" {
+		t.Errorf("mask of an empty region = %q %q", seq, qual)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * matcher.go
+ *
+ * => the matching engine interface; Hyperscan by default (matcher_hs.go),
+ *    or a pure-Go engine with the 'purego' build tag (matcher_purego.go),
+ *    for systems without Hyperscan / cgo:
+ *
+ *	go build -tags purego
+ *
+ * => with '-stream', reads are scanned in chunks by a StreamMatcher as they're
+ *    read, for long reads; only the match state is kept between chunks
+ *    (Hyperscan only), see stream.go
+ *
+ */
+
+// MatchHandler = callback for each match found by a Matcher, as for
+// hyperscan.MatchHandler; from is 0 unless the pattern has the 'L' flag
+type MatchHandler func(id uint, from, to uint64, flags uint, context interface{}) error
+
+// Matcher = a compiled pattern set that scans blocks of data
+type Matcher interface {
+	// reports each match in data to handler, by end offset
+	Scan(data []byte, handler MatchHandler, context interface{}) error
+	// returns a matcher sharing the compiled patterns, with its own scratch space
+	Clone() (Matcher, error)
+	// frees the matcher; clones are freed separately
+	Close()
+}
+
+// MatchStream = an open stream of a StreamMatcher; match offsets are from
+// the start of the stream
+type MatchStream interface {
+	// reports each match ending in chunk to the stream's handler
+	Scan(chunk []byte) error
+	// reports matches at the end of the stream, and frees it
+	Close() error
+}
+
+// StreamMatcher = a Matcher that can also scan data in chunks
+type StreamMatcher interface {
+	Matcher
+	// returns a new stream, reporting matches to handler
+	Open(handler MatchHandler, context interface{}) (MatchStream, error)
+}
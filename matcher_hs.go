@@ -0,0 +1,250 @@
+//go:build !purego
+
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * matcher_hs.go
+ *
+ * => Hyperscan matching engine; compiled pattern databases are serialized
+ *    next to the pattern file to save compiling on the next run
+ *
+ */
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/flier/gohs/hyperscan"
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the matching engine, for logging
+const matchEngine = "hyperscan"
+
+// hsMatcher = a Hyperscan block database and scratch space
+type hsMatcher struct {
+	database hyperscan.BlockDatabase
+	scratch  *hyperscan.Scratch
+	// => clones share the database of the matcher they're cloned from
+	clone bool
+}
+
+// hsStreamMatcher = a Hyperscan stream database and scratch space, for '-stream'
+type hsStreamMatcher struct {
+	database hyperscan.StreamDatabase
+	scratch  *hyperscan.Scratch
+	// => clones share the database of the matcher they're cloned from
+	clone bool
+}
+
+// returns a matcher for a pattern file; a stream matcher with '-stream'
+func newMatcherFromFile(filename string) Matcher {
+	if *flagStreamChunk > 0 {
+		database := streamDatabaseFromFile(filename, *flagSOMHorizon)
+
+		scratch, err := hyperscan.NewScratch(database)
+		checkErr(err, fmt.Sprintf("Unable to allocate scratch space. Exiting."))
+
+		return &hsStreamMatcher{database: database, scratch: scratch}
+	}
+
+	database := blockDatabaseFromFile(filename)
+
+	scratch, err := hyperscan.NewScratch(database)
+	checkErr(err, fmt.Sprintf("Unable to allocate scratch space. Exiting."))
+
+	return &hsMatcher{database: database, scratch: scratch}
+}
+
+// reports each match in data to handler
+func (matcher *hsMatcher) Scan(data []byte, handler MatchHandler, context interface{}) error {
+	return matcher.database.Scan(data, matcher.scratch, hyperscan.MatchHandler(handler), context)
+}
+
+// returns a matcher sharing the database, with cloned scratch space
+func (matcher *hsMatcher) Clone() (Matcher, error) {
+	scratch, err := matcher.scratch.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &hsMatcher{database: matcher.database, scratch: scratch, clone: true}, nil
+}
+
+// frees the scratch space, and the database unless cloned
+func (matcher *hsMatcher) Close() {
+	matcher.scratch.Free()
+	if !matcher.clone {
+		matcher.database.Close()
+	}
+}
+
+// reports each match in data to handler, as a single stream
+func (matcher *hsStreamMatcher) Scan(data []byte, handler MatchHandler, context interface{}) error {
+	stream, err := matcher.Open(handler, context)
+	if err != nil {
+		return err
+	}
+	if err := stream.Scan(data); err != nil {
+		stream.Close()
+		return err
+	}
+	return stream.Close()
+}
+
+// returns a new stream, reporting matches to handler
+func (matcher *hsStreamMatcher) Open(handler MatchHandler, context interface{}) (MatchStream, error) {
+	return matcher.database.Open(0, matcher.scratch, hyperscan.MatchHandler(handler), context)
+}
+
+// returns a matcher sharing the database, with cloned scratch space
+func (matcher *hsStreamMatcher) Clone() (Matcher, error) {
+	scratch, err := matcher.scratch.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &hsStreamMatcher{database: matcher.database, scratch: scratch, clone: true}, nil
+}
+
+// frees the scratch space, and the database unless cloned
+func (matcher *hsStreamMatcher) Close() {
+	matcher.scratch.Free()
+	if !matcher.clone {
+		matcher.database.Close()
+	}
+}
+
+/**
+ * This function will read in the file with the specified name, with an
+ * expression per line, ignoring lines starting with '#' and build a Hyperscan
+ * database for it.
+ */
+func blockDatabaseFromFile(filename string) hyperscan.BlockDatabase {
+	return databaseFromFile(filename, "").(hyperscan.BlockDatabase)
+}
+
+// returns a stream database for a pattern file, with the start of match
+// horizon; "small", "medium" or "large"
+func streamDatabaseFromFile(filename, horizon string) hyperscan.StreamDatabase {
+	return databaseFromFile(filename, "stream-"+horizon).(hyperscan.StreamDatabase)
+}
+
+// returns a database for a pattern file, compiled or read from the serialized
+// database; mode is "" for block mode, or "stream-<horizon>"
+func databaseFromFile(filename, mode string) hyperscan.Database {
+	dbFilename := getDbFilename(filename, mode)
+
+	// remove existing compiled database if recompile flag set
+	if *flagRecompile {
+		if fileExists(dbFilename) {
+			err := os.Remove(dbFilename)
+			checkErr(err, fmt.Sprintf("Couldn't remove DB file '%s'! %s", dbFilename, err))
+		}
+	}
+
+	// short circuit compiling if we already have a serialized db
+	if fileExists(dbFilename) {
+		log.Debug("Serialized pattern DB exists, use '-c' flag to recompile from text.")
+		log.Info(fmt.Sprintf("Reading from pattern DB file: %s", dbFilename))
+		return readDbFile(dbFilename, mode)
+	}
+
+	log.Info("Compiling patterns ... ")
+
+	// do the actual file reading and pattern parsing
+	var patterns []*hyperscan.Pattern
+	for _, p := range scanPatterns(filename) {
+		pattern, err := hyperscan.ParsePattern(p.String())
+		checkErr(err, fmt.Sprintf("Could not parse pattern %d, %s", p.ID, err))
+		pattern.Id = int(p.ID)
+		patterns = append(patterns, pattern)
+	}
+
+	// compile a database for the mode from the parsed patterns
+	var db hyperscan.Database
+	var err error
+	switch mode {
+	case "":
+		db, err = hyperscan.NewBlockDatabase(patterns...)
+	case "stream-small":
+		// => the small horizon is the default for patterns with the 'L' flag
+		db, err = hyperscan.NewStreamDatabase(patterns...)
+	case "stream-medium":
+		db, err = hyperscan.NewMediumStreamDatabase(patterns...)
+	case "stream-large":
+		db, err = hyperscan.NewLargeStreamDatabase(patterns...)
+	default:
+		log.Fatal(fmt.Sprintf("Unknown pattern database mode '%s'!", mode))
+	}
+	checkErr(err, fmt.Sprintf("Could not compile patterns, %s", err))
+
+	log.Info(" ... DONE!")
+
+	// serialize the compiled database to save time on next run
+	log.Info("Serializing pattern DB ... ")
+	writeDbFile(dbFilename, db)
+	log.Info(" ... DONE!")
+
+	return db
+}
+
+// returns string to use as serialized pattern database file name; block
+// mode databases have no mode in the name
+func getDbFilename(filename, mode string) string {
+	fileMD5, err := getFileMD5(filename)
+	checkErr(err, fmt.Sprintf("Failed to generate MD5 digest of %s", filename))
+	// => both-strand databases have the reverse complement patterns too
+	if *flagBothStrands {
+		fileMD5 += ".both"
+	}
+	if mode != "" {
+		return filename + "." + fileMD5 + "." + mode + ".hsdb"
+	}
+	return filename + "." + fileMD5 + ".hsdb"
+}
+
+// reads a pattern database for a mode that we've previously serialized to a gzipped file
+func readDbFile(dbFilename, mode string) hyperscan.Database {
+	// open DB file for reading; should be gzipped
+	inFile, err := os.Open(dbFilename)
+	checkErr(err, fmt.Sprintf("Couldn't open DB file '%s' for reading! %s", dbFilename, err))
+	defer inFile.Close()
+
+	// create gzip stream reader
+	gzipReader, err := gzip.NewReader(inFile)
+	checkErr(err, fmt.Sprintf("Couldn't create gzip reader on DB file! %s", err))
+	defer gzipReader.Close()
+
+	dbData, err := ioutil.ReadAll(gzipReader)
+	checkErr(err, fmt.Sprintf("Could not read database file, %s", err))
+
+	var db hyperscan.Database
+	if mode == "" {
+		db, err = hyperscan.UnmarshalBlockDatabase(dbData)
+	} else {
+		db, err = hyperscan.UnmarshalStreamDatabase(dbData)
+	}
+	checkErr(err, fmt.Sprintf("Failed to unmarshall DB file! %s", err))
+
+	return db
+}
+
+// write a compiled database to a gzipped file to avoid recompiling on next run
+func writeDbFile(dbFilename string, database hyperscan.Database) {
+	// serialize the database to bytes
+	dbData, err := database.Marshal()
+	checkErr(err, fmt.Sprintf("Could not serialize pattern DB, %s", err))
+
+	// get a gzip stream writer
+	gzWriter := getGzWriter(dbFilename)
+	defer gzWriter.Close()
+
+	// write gzip compressed DB bytes to file
+	gzWriter.Write(dbData)
+}
@@ -0,0 +1,190 @@
+//go:build !purego
+
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/flier/gohs/hyperscan"
+)
+
+// returns a Hyperscan matcher for patterns
+func newTestHSMatcher(t *testing.T, patterns []*Pattern) Matcher {
+	var hsPatterns []*hyperscan.Pattern
+	for _, p := range patterns {
+		pattern, err := hyperscan.ParsePattern(p.String())
+		if err != nil {
+			t.Fatalf("couldn't parse pattern %d: %s", p.ID, err)
+		}
+		pattern.Id = int(p.ID)
+		hsPatterns = append(hsPatterns, pattern)
+	}
+	database, err := hyperscan.NewBlockDatabase(hsPatterns...)
+	if err != nil {
+		t.Fatalf("couldn't compile patterns: %s", err)
+	}
+	scratch, err := hyperscan.NewScratch(database)
+	if err != nil {
+		t.Fatalf("couldn't allocate scratch space: %s", err)
+	}
+	return &hsMatcher{database: database, scratch: scratch}
+}
+
+// => Hyperscan may report matches of different IDs at the same end offset
+// in any order, so both engines' matches are compared in the pure-Go order
+func sortTestMatches(matches []testMatch) []testMatch {
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].To != matches[j].To {
+			return matches[i].To < matches[j].To
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches
+}
+
+func TestGoMatcherAgainstHyperscan(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	for round := 0; round < 200; round++ {
+		read := randomRead(rng, 40+rng.Intn(110))
+		patterns := randomPatterns(t, rng, read)
+		// => leftmost starts are only compared for exact patterns
+		for _, pattern := range patterns {
+			if pattern.EditDistance > 0 || pattern.HammingDistance > 0 {
+				pattern.Flags = strings.Replace(pattern.Flags, "L", "", 1)
+			}
+		}
+
+		goMatcher, err := newGoMatcher(patterns)
+		if err != nil {
+			t.Fatalf("couldn't build pure-Go matcher: %s", err)
+		}
+		hsMatcher := newTestHSMatcher(t, patterns)
+
+		got := scanAll(t, goMatcher, read)
+		want := sortTestMatches(scanAll(t, hsMatcher, read))
+		hsMatcher.Close()
+		if !reflect.DeepEqual(got, want) {
+			for _, pattern := range patterns {
+				t.Logf("pattern %d: %s", pattern.ID, pattern)
+			}
+			t.Fatalf("read %q:\n pure-Go   %v\n hyperscan %v", read, got, want)
+		}
+	}
+}
+
+// returns a Hyperscan stream matcher for patterns
+func newTestHSStreamMatcher(t *testing.T, patterns []*Pattern) StreamMatcher {
+	var hsPatterns []*hyperscan.Pattern
+	for _, p := range patterns {
+		pattern, err := hyperscan.ParsePattern(p.String())
+		if err != nil {
+			t.Fatalf("couldn't parse pattern %d: %s", p.ID, err)
+		}
+		pattern.Id = int(p.ID)
+		hsPatterns = append(hsPatterns, pattern)
+	}
+	database, err := hyperscan.NewLargeStreamDatabase(hsPatterns...)
+	if err != nil {
+		t.Fatalf("couldn't compile patterns: %s", err)
+	}
+	scratch, err := hyperscan.NewScratch(database)
+	if err != nil {
+		t.Fatalf("couldn't allocate scratch space: %s", err)
+	}
+	return &hsStreamMatcher{database: database, scratch: scratch}
+}
+
+// => hits of streamed reads in chunks match hits scanning whole reads
+func TestStreamRecordAgainstBlockScan(t *testing.T) {
+	withStreaming(t, 5, 0)
+	sortHits := func(hits []Hit) []Hit {
+		sort.SliceStable(hits, func(i, j int) bool {
+			if hits[i].To != hits[j].To {
+				return hits[i].To < hits[j].To
+			}
+			return hits[i].ID < hits[j].ID
+		})
+		return hits
+	}
+
+	rng := rand.New(rand.NewSource(5))
+	for round := 0; round < 100; round++ {
+		read := randomRead(rng, 40+rng.Intn(110))
+		var patterns []*Pattern
+		streamMatchWidth = 0
+		for _, pattern := range randomPatterns(t, rng, read) {
+			width, err := patternMaxWidth(pattern)
+			if err != nil {
+				continue
+			}
+			if !pattern.hasFlag('L') {
+				pattern.Flags += "L"
+			}
+			streamMatchWidth = max(streamMatchWidth, width)
+			patterns = append(patterns, pattern)
+		}
+		seq := strings.TrimSpace(string(read))
+		qual := strings.Repeat("I", len(seq))
+
+		blockMatcher := newTestHSMatcher(t, patterns)
+		readSetHits = readSetHits[:0]
+		scanData(blockMatcher, seq, FASTQRecord{Role: RoleR1, Seq: seq, Qual: qual})
+		want := sortHits(append([]Hit(nil), readSetHits...))
+		blockMatcher.Close()
+
+		streamMatcher := newTestHSStreamMatcher(t, patterns)
+		readSetHits = readSetHits[:0]
+		input := "@read\n" + seq + "\n+\n" + qual + "\n"
+		scanStreamRecord(bufio.NewReader(strings.NewReader(input)), streamMatcher, FASTQRecord{Role: RoleR1}, false)
+		got := sortHits(append([]Hit(nil), readSetHits...))
+		streamMatcher.Close()
+
+		if !reflect.DeepEqual(got, want) {
+			for _, pattern := range patterns {
+				t.Logf("pattern %d: %s", pattern.ID, pattern)
+			}
+			t.Fatalf("read %q:\n streamed %v\n block    %v", seq, got, want)
+		}
+	}
+}
+
+// => an expression matches a read if and only if its reverse complement
+// matches the read's reverse complement, as Hyperscan patterns
+func TestReverseComplementExpressionHyperscan(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	for _, expression := range revCompTestExpressions {
+		reversed, err := reverseComplementExpression(expression)
+		if err != nil {
+			t.Fatalf("reverseComplementExpression(%s): %s", expression, err)
+		}
+		matcher := newTestHSMatcher(t, testPatterns(t, "1:/"+expression+"/", "2:/"+reversed+"/"))
+
+		matched := func(id uint, data string) bool {
+			for _, match := range scanAll(t, matcher, []byte(data+"\n")) {
+				if match.ID == id {
+					return true
+				}
+			}
+			return false
+		}
+		for i := 0; i < 500; i++ {
+			read := revCompTestRead(rng)
+			rc := reverseComplementSeq(read)
+			if matched(1, read) != matched(2, rc) {
+				matcher.Close()
+				t.Fatalf("%s on %s = %t, %s on %s = %t", expression, read, matched(1, read), reversed, rc, matched(2, rc))
+			}
+		}
+		matcher.Close()
+	}
+}
@@ -0,0 +1,41 @@
+//go:build purego
+
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * matcher_purego.go
+ *
+ * => pure-Go matching engine, for builds without Hyperscan; patterns are
+ *    compiled on every run
+ *
+ */
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the matching engine, for logging
+const matchEngine = "pure-Go"
+
+// returns a matcher for a pattern file
+func newMatcherFromFile(filename string) Matcher {
+	if *flagStreamChunk > 0 {
+		log.Fatal("Streaming ('-stream') requires the hyperscan engine; this build has the pure-Go engine!")
+	}
+
+	log.Info("Compiling patterns ... ")
+	matcher, err := newGoMatcher(scanPatterns(filename))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not compile patterns, %s", err))
+	}
+	log.Info(" ... DONE!")
+
+	return matcher
+}
@@ -0,0 +1,267 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * matetrim.go
+ *
+ * => read set output, with mate trim rules that trim a mate relative to a
+ *    hit in its partner, and minimum post-trim length filtering
+ *
+ * => rules are "<target>:<mode>:<source>", eg: "R2:rc:R1"
+ *	rc   trim target from where the reverse complement of the source's
+ *	     upstream + matched region starts (read-through into the barcode)
+ *	same trim the same 5' region from target as source's upstream + match
+ *
+ */
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minimum overlap of a partial read-through at the 3' end for 'rc' rules
+const mateTrimMinOverlap = 6
+
+// sample / id name of the output bin for pairs that are too short after trimming
+const shortBinName = "too_short"
+
+// MateTrimRule = trim rule for a target mate, relative to a hit in a source mate
+type MateTrimRule struct {
+	Target, Source ReadRole
+	Mode           string
+}
+
+// KeepWindow = [From,To) region of a read kept in the output
+type KeepWindow struct {
+	From, To int
+}
+
+// fullWindow keeps the whole read
+var fullWindow = KeepWindow{0, math.MaxInt32}
+
+// mateTrimRules from the '-mate-trim' flag
+var mateTrimRules []MateTrimRule
+
+// returns a region [from,to) clipped to the window
+func (keep KeepWindow) clip(from, to int) (int, int) {
+	if from < keep.From {
+		from = keep.From
+	}
+	if to > keep.To {
+		to = keep.To
+	}
+	if from > to {
+		from = to
+	}
+	return from, to
+}
+
+// returns mate trim rules from a comma-separated list, eg: "R2:rc:R1"
+func parseMateTrimRules(text string) []MateTrimRule {
+	var rules []MateTrimRule
+	for _, spec := range strings.Split(text, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		fields := strings.Split(spec, ":")
+		if len(fields) != 3 {
+			log.Fatal(fmt.Sprintf("Mate trim rule '%s' should be '<target>:<mode>:<source>', eg: 'R2:rc:R1'!", spec))
+		}
+		rule := MateTrimRule{Target: ReadRole(fields[0]), Mode: fields[1], Source: ReadRole(fields[2])}
+		for _, role := range []ReadRole{rule.Target, rule.Source} {
+			if role != RoleR1 && role != RoleR2 && role != RoleI1 && role != RoleI2 && role != RoleUMI {
+				log.Fatal(fmt.Sprintf("Unknown read role '%s' in mate trim rule '%s'!", role, spec))
+			}
+		}
+		if rule.Mode != "rc" && rule.Mode != "same" {
+			log.Fatal(fmt.Sprintf("Unknown mode '%s' in mate trim rule '%s'! Supported: rc, same", rule.Mode, spec))
+		}
+		if rule.Target == rule.Source {
+			log.Fatal(fmt.Sprintf("Mate trim rule '%s' must reference a different mate!", spec))
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// returns the window of target kept by a rule, for a hit in source
+func (rule MateTrimRule) keepWindow(hit Hit, source, target FASTQRecord) KeepWindow {
+	seq := strings.TrimSpace(target.Seq)
+
+	switch rule.Mode {
+	case "same":
+		return KeepWindow{int(hit.To), len(seq)}
+	default:
+		// => a search string, not output, so not subject to '-rc-policy'
+		region := reverseComplementSeq(strings.TrimSpace(source.Seq)[:hit.To])
+		if i := strings.Index(seq, region); i >= 0 {
+			return KeepWindow{0, i}
+		}
+		// => partial read-through at the 3' end of target
+		for overlap := len(region) - 1; overlap >= mateTrimMinOverlap; overlap-- {
+			if overlap <= len(seq) && strings.HasSuffix(seq, region[:overlap]) {
+				return KeepWindow{0, len(seq) - overlap}
+			}
+		}
+		return fullWindow
+	}
+}
+
+// returns the output for target for a hit in source, without trimming
+// around the hit: for mates without hits of their own, written along with a
+// hit in their partner, and for reads with a read structure, written as
+// their template segments
+func mateOutput(hit Hit, source, target FASTQRecord, keep KeepWindow) HitOutput {
+	seq, qual := strings.TrimSpace(target.Seq), strings.TrimSpace(target.Qual)
+	if structure, ok := readStructures[target.Role]; ok {
+		seq, qual = structure.extract(seq, qual, segmentTemplate)
+	}
+	start, end := keep.clip(0, len(seq))
+	outSeq, outQual := seq[start:end], qual[start:end]
+	matchSeq, matchQual := hit.match(source)
+	if outputReversed(hit, target.Role) {
+		outSeq = reverseComplementDNA(outSeq)
+		outQual = reverse(outQual)
+	}
+
+	return HitOutput{
+		Record: OutputRecord{
+			ID:                hit.ID,
+			Role:              target.Role,
+			Lane:              target.Lane,
+			InputFileBasename: target.InputFileBasename,
+			Name:              target.Name,
+			ReadID:            getReadID(target.Name),
+			Seq:               outSeq,
+			Qual:              outQual,
+			From:              hit.From,
+			To:                hit.To,
+			MatchSeq:          matchSeq,
+			MatchQual:         matchQual,
+			UMI:               target.UMI,
+			Captures:          hit.Captures,
+			Cell:              hit.Cell,
+			Edits:             hit.Edits,
+			Reverse:           hit.Reverse,
+			CellBarcode:       target.CellBarcode,
+		},
+		Right: outSeq,
+	}
+}
+
+// makes and writes the output for a scanned read set and its hits
+func emitReadSet(records []FASTQRecord, hits []Hit) {
+	if *flagSplit {
+		emitSegments(records, hits)
+		return
+	}
+
+	recordsByRole := make(map[ReadRole]FASTQRecord)
+	hitRoles := make(map[ReadRole]bool)
+	for _, record := range records {
+		recordsByRole[record.Role] = record
+	}
+	for _, hit := range hits {
+		hitRoles[hit.Role] = true
+	}
+
+	// => keep windows for rule targets, from the first hit in the source mate
+	keeps := make(map[ReadRole]KeepWindow)
+	var partners []HitOutput
+	for _, rule := range mateTrimRules {
+		source, sourceOk := recordsByRole[rule.Source]
+		target, targetOk := recordsByRole[rule.Target]
+		if !sourceOk || !targetOk {
+			continue
+		}
+		for _, hit := range hits {
+			if hit.Role != rule.Source {
+				continue
+			}
+			keep := rule.keepWindow(hit, source, target)
+			keeps[rule.Target] = keep
+			// => only record outputs carry mates without hits of their own
+			if !hitRoles[rule.Target] && (*flagFASTQOut || *flagBAMOut || *flagSAMOut) {
+				partners = append(partners, mateOutput(hit, source, target, keep))
+			}
+			break
+		}
+	}
+
+	// => reads with a read structure and no hits of their own are written
+	// with the first hit of the read set
+	if len(hits) > 0 && (*flagFASTQOut || *flagBAMOut || *flagSAMOut) {
+		for _, record := range records {
+			if _, ok := readStructures[record.Role]; !ok || hitRoles[record.Role] {
+				continue
+			}
+			if _, ok := keeps[record.Role]; ok {
+				continue
+			}
+			partners = append(partners, mateOutput(hits[0], recordsByRole[hits[0].Role], record, fullWindow))
+		}
+	}
+
+	var outputs []HitOutput
+	for _, hit := range bestHits(hits) {
+		// => a chain of split-pool rounds is written once, for its last round
+		if hit.Round > 0 && hit.Round < len(barcodeRounds) {
+			continue
+		}
+		keep, ok := keeps[hit.Role]
+		if !ok {
+			keep = fullWindow
+		}
+		record := recordsByRole[hit.Role]
+		if _, ok := readStructures[hit.Role]; ok {
+			outputs = append(outputs, mateOutput(hit, record, record, keep))
+			continue
+		}
+		outputs = append(outputs, hitOutput(hit, record, keep))
+	}
+	outputs = append(outputs, partners...)
+
+	// => a pair-level decision, from the hit the read set is assigned by
+	swap := false
+	if *flagSwapMates && pairedInput && winningHit(hits) >= 0 {
+		swap = swapMates(hits)
+		if *flagFASTQOut || *flagBAMOut || *flagSAMOut {
+			outputs = append(outputs, pairPartners(hits, records, outputs, keeps)...)
+		}
+	}
+	if skipRevCompInvalid() {
+		return
+	}
+
+	if *flagMinLen > 0 {
+		for _, output := range outputs {
+			if len(output.Record.Seq) >= *flagMinLen {
+				continue
+			}
+			runStats.TooShort++
+			if *flagShort == "drop" {
+				return
+			}
+			for i := range outputs {
+				outputs[i].Record.Bin = shortBinName
+			}
+			break
+		}
+	}
+	if swap {
+		swapOutputRoles(outputs, records)
+		runStats.MatesSwapped++
+	}
+
+	for _, output := range outputs {
+		emitHitOutput(output)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMateTrimRules(t *testing.T) {
+	rules := parseMateTrimRules("R2:rc:R1, R1:same:I1,")
+	want := []MateTrimRule{{Target: RoleR2, Mode: "rc", Source: RoleR1}, {Target: RoleR1, Mode: "same", Source: RoleI1}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %+v, want %+v", rules, want)
+	}
+	if rules := parseMateTrimRules(""); len(rules) != 0 {
+		t.Errorf("rules of no rules = %+v", rules)
+	}
+
+	for _, text := range []string{"R2:rc", "R2:rc:R1:R1", "R3:rc:R1", "R2:cut:R1", "R1:same:R1"} {
+		expectFatal(t, "mate trim rule '"+text+"'", func() {
+			parseMateTrimRules(text)
+		})
+	}
+}
+
+func TestMateTrimKeepWindow(t *testing.T) {
+	// => barcode + linker at the start of R1; its reverse complement is
+	// "GGGGTTTT", where R2 reads through into it
+	source := FASTQRecord{Seq: "AAAACCCCGATTACAGATTACA\n", Role: RoleR1}
+	hit := Hit{ID: 1, Role: RoleR1, From: 4, To: 8}
+	rc := MateTrimRule{Target: RoleR2, Mode: "rc", Source: RoleR1}
+
+	tests := []struct {
+		rule   MateTrimRule
+		target string
+		want   KeepWindow
+	}{
+		// => full read-through, anywhere in target
+		{rc, "TGTAATCTGTAATCGGGGTTTTAC", KeepWindow{0, 14}},
+		// => partial read-through at the 3' end, of at least mateTrimMinOverlap
+		{rc, "TGTAATCTGTAATCGGGGTT", KeepWindow{0, 14}},
+		{rc, "TGTAATCTGTAATCGGGGT", fullWindow},
+		{rc, "TGTAATCTGTAATC", fullWindow},
+		{MateTrimRule{Target: RoleR2, Mode: "same", Source: RoleR1}, "CCCCGGGGATTACA", KeepWindow{8, 14}},
+	}
+	for _, test := range tests {
+		target := FASTQRecord{Seq: test.target + "\n", Role: RoleR2}
+		if got := test.rule.keepWindow(hit, source, target); got != test.want {
+			t.Errorf("%s keep window of %s = %v, want %v", test.rule.Mode, test.target, got, test.want)
+		}
+	}
+}
+
+func TestKeepWindowClip(t *testing.T) {
+	keep := KeepWindow{2, 10}
+	tests := []struct {
+		from, to, wantFrom, wantTo int
+	}{
+		{0, 20, 2, 10},
+		{4, 8, 4, 8},
+		{0, 1, 1, 1},
+		{12, 20, 10, 10},
+	}
+	for _, test := range tests {
+		if from, to := keep.clip(test.from, test.to); from != test.wantFrom || to != test.wantTo {
+			t.Errorf("clip(%d, %d) = %d, %d, want %d, %d", test.from, test.to, from, to, test.wantFrom, test.wantTo)
+		}
+	}
+	if from, to := fullWindow.clip(0, 150); from != 0 || to != 150 {
+		t.Errorf("full window clip(0, 150) = %d, %d", from, to)
+	}
+}
+
+func TestMateOutputMatchAtReadEnd(t *testing.T) {
+	source := FASTQRecord{Name: "@read1", Seq: "GGAAA\n", Qual: "ABCDE\n", Role: RoleR1}
+	target := FASTQRecord{Name: "@read1", Seq: "TTTTCC\n", Qual: "IIIIII\n", Role: RoleR2}
+
+	// => a match running into the line end of its read
+	output := mateOutput(Hit{ID: 1, Role: RoleR1, From: 2, To: 6}, source, target, fullWindow)
+	if record := output.Record; record.Seq != "TTTTCC" || record.MatchSeq != "AAA" || record.MatchQual != "CDE" {
+		t.Errorf("mate output = %s, match %s %s, want TTTTCC, match AAA CDE", record.Seq, record.MatchSeq, record.MatchQual)
+	}
+}
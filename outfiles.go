@@ -0,0 +1,233 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * outfiles.go
+ *
+ * => output directory, file name templates, and overwrite protection
+ * => output files are written under temporary names and renamed into place
+ *    only when the run completes successfully
+ *
+ */
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// preset file name templates, selectable by name with '-name'
+var nameTemplatePresets = map[string]string{
+	// => BCL Convert style, eg: "Sample_S1_L001_R1_001"
+	"bclconvert": "{sample}_S{snum}_{lane}_{mate}_001",
+}
+
+// placeholders supported in file name templates:
+//
+//	{basename} input file basename (lane dropped when lanes are merged)
+//	{sample}   sample name of the matched pattern ID
+//	{snum}     sample number, in sample sheet / pattern file order
+//	{id}       matched pattern ID
+//	{mate}     read role (R1, R2, I1, I2, UMI)
+//	{lane}     input lane (eg: L001); including it splits output by lane
+//	{cell}     composite cell ID of split-pool barcode rounds
+var namePlaceholders = []string{"basename", "sample", "snum", "id", "mate", "lane", "cell"}
+
+// file name template placeholder, with an optional leading separator that
+// is dropped along with an empty value, eg: "_{lane}"
+var reNamePlaceholder = regexp.MustCompile(`([_.-]?)\{([a-z]+)\}`)
+
+// nameTemplate from the '-name' flag, or the default for the output format
+var nameTemplate string
+
+// temporary file name for each output file, by final file name
+var tempOutputFiles = make(map[string]string)
+
+// returns the file name template, checking placeholders are known and
+// that the template can be used with the selected output options
+func getNameTemplate(text string) string {
+	if preset, ok := nameTemplatePresets[text]; ok {
+		text = preset
+	}
+
+	if text == "" {
+		switch {
+		case *flagReadGroups || len(barcodeRounds) > 0:
+			text = "{basename}.hs_dmux"
+		case *flagBAMOut || *flagSAMOut:
+			text = "{basename}.{sample}.hs_dmux"
+		default:
+			text = "{basename}.{id}.hs_dmux"
+		}
+	}
+
+	for _, placeholder := range reNamePlaceholder.FindAllStringSubmatch(text, -1) {
+		known := false
+		for _, name := range namePlaceholders {
+			known = known || name == placeholder[2]
+		}
+		if !known {
+			log.Fatal(fmt.Sprintf("Unknown file name template placeholder '{%s}'! Supported: {%s}", placeholder[2], strings.Join(namePlaceholders, "}, {")))
+		}
+		if *flagReadGroups && (placeholder[2] == "sample" || placeholder[2] == "snum" || placeholder[2] == "id") {
+			log.Fatal(fmt.Sprintf("File name template placeholder '{%s}' can't be used with read group output ('-rg')!", placeholder[2]))
+		}
+	}
+
+	return text
+}
+
+// returns the output file name for a record, in the output directory
+func expandNameTemplate(record OutputRecord, ext string) string {
+	basename := record.InputFileBasename
+	if *flagBAMOut || *flagSAMOut {
+		basename = outputBasename
+	}
+
+	name := reNamePlaceholder.ReplaceAllStringFunc(nameTemplate, func(s string) string {
+		m := reNamePlaceholder.FindStringSubmatch(s)
+		var value string
+		switch m[2] {
+		case "basename":
+			value = basename
+		case "sample":
+			value = recordSample(record)
+		case "snum":
+			value = fmt.Sprint(sampleNumber(recordSample(record)))
+			if record.Bin != "" {
+				value = "0"
+			}
+		case "id":
+			value = fmt.Sprint(record.ID)
+			if record.Bin != "" || record.Cell != "" {
+				value = recordSample(record)
+			}
+		case "cell":
+			value = record.Cell
+		case "mate":
+			value = string(record.Role)
+		case "lane":
+			value = record.Lane
+		}
+		if value == "" {
+			return ""
+		}
+		return m[1] + value
+	})
+
+	return filepath.Join(*flagOutDir, name+ext)
+}
+
+// returns a new file for writing output to filename; data is written to a
+// temporary file until finalizeOutputFiles is called
+func createOutputFile(filename string) *os.File {
+	checkOutputFile(filename)
+
+	tempFilename := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	outFile, err := os.Create(tempFilename)
+	checkErr(err, fmt.Sprintf("Couldn't open file '%s' for writing! %s", tempFilename, err))
+	tempOutputFiles[filename] = tempFilename
+
+	return outFile
+}
+
+// exits if an output file exists, unless overwriting with '-force'
+func checkOutputFile(filename string) {
+	if fileExists(filename) && !*flagForce {
+		log.Fatal(fmt.Sprintf("Output file '%s' exists! Use '-force' to overwrite.", filename))
+	}
+}
+
+// checks the output files that can be named before scanning, see
+// predictOutputFiles; the others are checked as they're created
+func checkOutputFiles(readSet ReadSet, statsPrefix string) {
+	if *flagForce {
+		return
+	}
+	for _, filename := range predictOutputFiles(readSet, statsPrefix) {
+		checkOutputFile(filename)
+	}
+}
+
+// returns the output files that can be named before scanning: stats and
+// reports, the hit table and index, and read output files for each pattern
+// ID, read role and lane; files named by cell barcodes aren't known until
+// they're written
+func predictOutputFiles(readSet ReadSet, statsPrefix string) []string {
+	var filenames []string
+	if statsPrefix != "" {
+		filenames = append(filenames, statsPrefix+".json", statsPrefix+".tsv")
+		if *flagMultiQC {
+			for name := range multiQCSections(StatsReport{}, "") {
+				filenames = append(filenames, statsPrefix+"."+name+"_mqc.json")
+			}
+		}
+		if *flagHTML {
+			filenames = append(filenames, statsPrefix+".html")
+		}
+	}
+	if *flagHits != "" {
+		filenames = append(filenames, *flagHits)
+	}
+	if *flagIndex != "" && !emitCommand {
+		filenames = append(filenames, *flagIndex)
+	}
+
+	if (*flagFASTQOut || *flagBAMOut || *flagSAMOut) && len(barcodeRounds) == 0 && whitelist == nil {
+		var records []OutputRecord
+		for _, id := range patternIDs {
+			records = append(records, OutputRecord{ID: id})
+		}
+		if *flagMinLen > 0 && *flagShort == "bin" {
+			records = append(records, OutputRecord{Bin: shortBinName})
+		}
+		for _, input := range readSet {
+			for _, file := range input.Files {
+				for _, record := range records {
+					record.Role, record.Lane, record.InputFileBasename = input.Role, file.Lane, input.Basename
+					filenames = append(filenames, getOutputFilename(record))
+				}
+			}
+		}
+	}
+
+	return filenames
+}
+
+// reopens a (temporary) output file for appending
+func reopenOutputFile(path string) *os.File {
+	outFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	checkErr(err, fmt.Sprintf("Couldn't reopen file '%s' for writing! %s", path, err))
+	return outFile
+}
+
+// renames temporary output files to their final names; call after all
+// output files are closed
+func finalizeOutputFiles() {
+	for filename, tempFilename := range tempOutputFiles {
+		err := os.Rename(tempFilename, filename)
+		checkErr(err, fmt.Sprintf("Couldn't rename '%s' to '%s'! %s", tempFilename, filename, err))
+		delete(tempOutputFiles, filename)
+	}
+}
+
+// removes temporary output files; registered to run on fatal errors
+func removeTempOutputFiles() {
+	for _, tempFilename := range tempOutputFiles {
+		os.Remove(tempFilename)
+	}
+}
+
+// creates the output directory if needed
+func makeOutDir() {
+	err := os.MkdirAll(*flagOutDir, 0755)
+	checkErr(err, fmt.Sprintf("Couldn't create output directory '%s'! %s", *flagOutDir, err))
+}
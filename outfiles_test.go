@@ -0,0 +1,44 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPredictOutputFiles(t *testing.T) {
+	fastqOut, multiQC, hits, outDir, minLen, short := *flagFASTQOut, *flagMultiQC, *flagHits, *flagOutDir, *flagMinLen, *flagShort
+	ids, template := patternIDs, nameTemplate
+	t.Cleanup(func() {
+		*flagFASTQOut, *flagMultiQC, *flagHits, *flagOutDir, *flagMinLen, *flagShort = fastqOut, multiQC, hits, outDir, minLen, short
+		patternIDs, nameTemplate = ids, template
+	})
+	*flagFASTQOut, *flagMultiQC, *flagHits, *flagOutDir, *flagMinLen, *flagShort = true, false, "hits.tsv", "out", 20, "bin"
+	patternIDs, nameTemplate = []uint{1, 2}, "{basename}.{id}_{lane}.hs_dmux"
+
+	readSet := ReadSet{
+		{Role: RoleR1, Basename: "S1_R1", Files: []*InputFile{{Lane: "L001"}, {Lane: "L002"}}},
+		{Role: RoleR2, Basename: "S1_R2", Files: []*InputFile{{Lane: "L001"}, {Lane: "L002"}}},
+	}
+	got := predictOutputFiles(readSet, "out/S1.stats")
+	sort.Strings(got)
+
+	want := []string{"hits.tsv", "out/S1.stats.json", "out/S1.stats.tsv"}
+	for _, basename := range []string{"S1_R1", "S1_R2"} {
+		for _, lane := range []string{"L001", "L002"} {
+			for _, id := range []string{"1", "2", shortBinName} {
+				want = append(want, filepath.Join("out", basename+"."+id+"_"+lane+".hs_dmux.fastq.gz"))
+			}
+		}
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("predicted output files = %v, want %v", got, want)
+	}
+}
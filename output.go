@@ -0,0 +1,347 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * output.go
+ *
+ * => demultiplexed record output: FASTQ, unaligned BAM or SAM files
+ * => BAM/SAM records carry the sample in RG, matched barcode in BC/QT,
+ *    UMI in RX, pattern ID / match offsets in XI/XB/XE, swapped mates in XW
+ *    and cell barcode in CR/CY/CB tags
+ *
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputRecord = a demultiplexed read, ready to be written
+type OutputRecord struct {
+	ID                uint
+	Role              ReadRole
+	Lane              string
+	InputFileBasename string
+	// full FASTQ header line, and the read ID parsed from it
+	Name, ReadID string
+	// output sequence and qualities, after trimming / reverse complement
+	Seq, Qual string
+	// match offsets and the matched region of the input read
+	From, To            uint64
+	MatchSeq, MatchQual string
+	UMI                 string
+	// sub-fields captured from the match
+	Captures []Capture
+	// composite cell ID of split-pool barcode rounds
+	Cell string
+	// edits of the match against its pattern's nominal sequence, if verified
+	Edits *Edits
+	// => match on the reverse strand, with '-both-strands'
+	Reverse bool
+	// => R1 / R2 role swapped, with '-swap-mates'
+	Swapped bool
+	// cell barcode, raw and whitelist corrected
+	CellBarcode CellBarcode
+	// output bin in place of the sample, eg: for pairs too short after trimming
+	Bin string
+}
+
+// RecordWriter = an output file of demultiplexed records
+type RecordWriter interface {
+	Write(record OutputRecord)
+	// Suspend flushes buffered output as complete compressed members and closes
+	// the file handle; Resume reopens the file in append mode
+	Suspend()
+	Resume()
+	Close()
+}
+
+// SAMTag = a SAM aux tag of type 'Z' (string) or 'i' (integer)
+type SAMTag struct {
+	Tag   string
+	Type  byte
+	Value string
+}
+
+var (
+	// outputBasename = basename for output files not specific to an input read role
+	outputBasename string
+	// pairedInput = read set has both R1 and R2
+	pairedInput bool
+	// patternIDs = all pattern IDs in the pattern file, for read group headers
+	patternIDs []uint
+)
+
+// returns the sample name of a record: its output bin, or its composite
+// cell ID, or the pattern ID's sample
+func recordSample(record OutputRecord) string {
+	if record.Bin != "" {
+		return record.Bin
+	}
+	if record.Cell != "" {
+		return record.Cell
+	}
+	return sampleName(record.ID)
+}
+
+// writes a record to its output file, opening the file on first use
+func writeOutputRecord(record OutputRecord) {
+	filename := getOutputFilename(record)
+	writer := fileWriters.get(filename, func() RecordWriter {
+		return newRecordWriter(filename, record)
+	})
+	writer.Write(record)
+}
+
+// closes all output files
+func closeOutputWriters() {
+	fileWriters.closeAll()
+}
+
+// returns the output file name for a record
+func getOutputFilename(record OutputRecord) string {
+	switch {
+	case *flagBAMOut:
+		return expandNameTemplate(record, ".bam")
+	case *flagSAMOut:
+		return expandNameTemplate(record, ".sam")
+	default:
+		return expandNameTemplate(record, ".fastq.gz")
+	}
+}
+
+// returns a new RecordWriter of the selected output format
+func newRecordWriter(filename string, record OutputRecord) RecordWriter {
+	switch {
+	case *flagBAMOut || *flagSAMOut:
+		var samples []string
+		if *flagReadGroups {
+			samples = sampleNames(patternIDs)
+			if *flagMinLen > 0 && *flagShort == "bin" {
+				samples = append(samples, shortBinName)
+			}
+		} else {
+			samples = []string{recordSample(record)}
+		}
+		if *flagBAMOut {
+			return newBAMWriter(filename, samples)
+		}
+		return newSAMWriter(filename, samples)
+	default:
+		return newFASTQWriter(filename)
+	}
+}
+
+// returns SAM header text with a read group per sample
+func samHeader(samples []string) string {
+	header := "@HD\tVN:1.6\tSO:unsorted\n"
+	for _, sample := range samples {
+		header += fmt.Sprintf("@RG\tID:%s\tSM:%s\n", sample, sample)
+	}
+	header += fmt.Sprintf("@PG\tID:%s\tPN:%s\tVN:%s\n", Cmd, Cmd, Version)
+	return header
+}
+
+// returns the SAM flag for a record; records from paired input are flagged
+// as paired with the mate unmapped
+func samFlag(record OutputRecord) uint16 {
+	flag := uint16(0x4)
+	if pairedInput {
+		switch record.Role {
+		case RoleR1:
+			flag |= bamFlagPaired | 0x8 | bamFlagRead1
+		case RoleR2:
+			flag |= bamFlagPaired | 0x8 | bamFlagRead2
+		}
+	}
+	return flag
+}
+
+// returns the aux tags for a record
+func samTags(record OutputRecord) []SAMTag {
+	tags := []SAMTag{
+		{"RG", 'Z', recordSample(record)},
+		{"BC", 'Z', record.MatchSeq},
+		{"QT", 'Z', record.MatchQual},
+	}
+	if record.UMI != "" {
+		tags = append(tags, SAMTag{"RX", 'Z', record.UMI})
+	}
+	tags = append(tags,
+		SAMTag{"XI", 'i', fmt.Sprint(record.ID)},
+		SAMTag{"XB", 'i', fmt.Sprint(record.From)},
+		SAMTag{"XE", 'i', fmt.Sprint(record.To)},
+	)
+	if record.Swapped {
+		tags = append(tags, SAMTag{"XW", 'i', "1"})
+	}
+
+	// => cell barcode, as 10x Genomics style tags
+	if record.Cell != "" {
+		tags = append(tags, SAMTag{"CB", 'Z', record.Cell})
+	} else if record.CellBarcode.Raw != "" {
+		tags = append(tags,
+			SAMTag{"CR", 'Z', record.CellBarcode.Raw},
+			SAMTag{"CY", 'Z', record.CellBarcode.RawQual},
+			SAMTag{"CB", 'Z', record.CellBarcode.Corrected},
+		)
+	}
+
+	// => captures named like a SAM tag replace or add to the tags above
+captures:
+	for _, capture := range record.Captures {
+		if !reSAMTagName.MatchString(capture.Name) {
+			continue
+		}
+		for i := range tags {
+			if tags[i].Tag == capture.Name {
+				tags[i] = SAMTag{capture.Name, 'Z', capture.Value}
+				continue captures
+			}
+		}
+		tags = append(tags, SAMTag{capture.Name, 'Z', capture.Value})
+	}
+	return tags
+}
+
+// FASTQWriter writes gzipped FASTQ; headers follow the '-H' template, and match info
+// is written on the '+' line only if requested
+type FASTQWriter struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func newFASTQWriter(filename string) *FASTQWriter {
+	fw := &FASTQWriter{file: createOutputFile(filename)}
+	fw.path = fw.file.Name()
+	fw.open()
+	return fw
+}
+
+func (fw *FASTQWriter) open() {
+	gzWriter, err := gzip.NewWriterLevel(fw.file, gzip.BestCompression)
+	checkErr(err, fmt.Sprintf("Couldn't create gzip writer! %s", err))
+	fw.gz = gzWriter
+}
+
+func (fw *FASTQWriter) Write(record OutputRecord) {
+	plus := "+"
+	if *flagPlusInfo {
+		matchSeq := ""
+		if *flagFASTQMSeq {
+			if *flagMTrim {
+				matchSeq = " "
+			} else {
+				matchSeq = " " + record.MatchSeq
+			}
+		}
+		plus = "+" + record.ReadID + " " + fmt.Sprint(record.ID) + ":" + fmt.Sprint(record.From) + "-" + fmt.Sprint(record.To) + matchSeq
+	}
+	fw.gz.Write([]byte(fmt.Sprintf("%s\n%s\n%s\n%s\n", headerTemplate.header(record), record.Seq, plus, record.Qual)))
+}
+
+// => concatenated gzip members are a valid gzip file
+func (fw *FASTQWriter) Suspend() {
+	fw.Close()
+	fw.gz = nil
+}
+
+func (fw *FASTQWriter) Resume() {
+	fw.file = reopenOutputFile(fw.path)
+	fw.open()
+}
+
+func (fw *FASTQWriter) Close() {
+	checkErr(fw.gz.Close(), fmt.Sprintf("Couldn't write FASTQ file '%s'!", fw.path))
+	fw.file.Close()
+}
+
+// SAMWriter writes plain text SAM
+type SAMWriter struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newSAMWriter(filename string, samples []string) *SAMWriter {
+	file := createOutputFile(filename)
+	sw := &SAMWriter{path: file.Name(), file: file, writer: bufio.NewWriter(file)}
+	sw.writer.WriteString(samHeader(samples))
+	return sw
+}
+
+func (sw *SAMWriter) Write(record OutputRecord) {
+	qual := record.Qual
+	if qual == "" {
+		qual = "*"
+	}
+	fields := []string{record.ReadID, fmt.Sprint(samFlag(record)), "*", "0", "0", "*", "*", "0", "0", record.Seq, qual}
+	for _, tag := range samTags(record) {
+		fields = append(fields, fmt.Sprintf("%s:%c:%s", tag.Tag, tag.Type, tag.Value))
+	}
+	sw.writer.WriteString(strings.Join(fields, "\t") + "\n")
+}
+
+func (sw *SAMWriter) Suspend() {
+	sw.Close()
+	sw.writer = nil
+}
+
+func (sw *SAMWriter) Resume() {
+	sw.file = reopenOutputFile(sw.path)
+	sw.writer = bufio.NewWriter(sw.file)
+}
+
+func (sw *SAMWriter) Close() {
+	checkErr(sw.writer.Flush(), fmt.Sprintf("Couldn't write SAM file '%s'!", sw.path))
+	sw.file.Close()
+}
+
+// BAMWriter writes BGZF-compressed unaligned BAM
+type BAMWriter struct {
+	path string
+	file *os.File
+	bgzf *BGZFWriter
+}
+
+func newBAMWriter(filename string, samples []string) *BAMWriter {
+	file := createOutputFile(filename)
+	bw := &BAMWriter{path: file.Name(), file: file, bgzf: newBGZFWriter(file)}
+	_, err := bw.bgzf.Write(encodeBAMHeader(samHeader(samples)))
+	checkErr(err, fmt.Sprintf("Couldn't write BAM file '%s'! %s", filename, err))
+	return bw
+}
+
+func (bw *BAMWriter) Write(record OutputRecord) {
+	_, err := bw.bgzf.Write(encodeBAMRecord(record.ReadID, samFlag(record), record.Seq, record.Qual, samTags(record)))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Couldn't write BAM file '%s'! %s", bw.path, err))
+	}
+}
+
+// => flushes a complete BGZF block, without the EOF marker
+func (bw *BAMWriter) Suspend() {
+	checkErr(bw.bgzf.Flush(), fmt.Sprintf("Couldn't write BAM file '%s'!", bw.path))
+	bw.file.Close()
+	bw.bgzf = nil
+}
+
+func (bw *BAMWriter) Resume() {
+	bw.file = reopenOutputFile(bw.path)
+	bw.bgzf = newBGZFWriter(bw.file)
+}
+
+func (bw *BAMWriter) Close() {
+	checkErr(bw.bgzf.Close(), fmt.Sprintf("Couldn't write BAM file '%s'!", bw.path))
+	bw.file.Close()
+}
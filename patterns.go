@@ -0,0 +1,219 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * patterns.go
+ *
+ * => pattern file parsing, independent of the matching engine; one pattern
+ *    per line as "<id>:/<expression>/<flags>{<extensions>}", eg:
+ *
+ *	10001:/ACGTACGT/L{edit_distance=1}
+ *
+ * => flags and extensions are those of Hyperscan; the pure-Go engine
+ *    supports a subset (see gomatcher.go)
+ *
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Hyperscan pattern flag characters
+const patternFlagChars = "ismH8WPLV"
+
+// deprecated Hyperscan flag characters, still accepted by gohs, and the
+// flags they stand for
+var deprecatedPatternFlags = map[rune]rune{
+	'l': 'L', 'o': 'H', 'e': 'V', 'u': '8', 'p': 'W', 'f': 'P',
+}
+
+// Pattern = a single parsed pattern file line
+type Pattern struct {
+	ID         uint
+	Expression string
+	// flag characters, eg: "iL"; deprecated flags are mapped when parsed
+	Flags string
+	// extensions; 0 if not set
+	MinOffset, MaxOffset, MinLength uint64
+	EditDistance, HammingDistance   uint32
+}
+
+// returns a pattern parsed from "/<expression>/<flags>{<extensions>}"; text
+// without slashes is taken as a bare expression
+func parsePattern(text string) (*Pattern, error) {
+	pattern := &Pattern{}
+
+	n := strings.LastIndex(text, "/")
+	if n < 1 || !strings.HasPrefix(text, "/") {
+		pattern.Expression = text
+		return pattern, nil
+	}
+	pattern.Expression = text[1:n]
+	flags := text[n+1:]
+
+	if m := strings.Index(flags, "{"); m >= 0 {
+		if !strings.HasSuffix(flags, "}") {
+			return nil, fmt.Errorf("unterminated extensions '%s'", flags[m:])
+		}
+		if err := pattern.parseExtensions(flags[m+1 : len(flags)-1]); err != nil {
+			return nil, err
+		}
+		flags = flags[:m]
+	}
+
+	// => deprecated flags are kept as the flags they stand for
+	for _, c := range flags {
+		if flag, ok := deprecatedPatternFlags[c]; ok {
+			c = flag
+		}
+		if !strings.ContainsRune(patternFlagChars, c) {
+			return nil, fmt.Errorf("unknown flag '%c'", c)
+		}
+		if !pattern.hasFlag(byte(c)) {
+			pattern.Flags += string(c)
+		}
+	}
+
+	return pattern, nil
+}
+
+// sets extensions from "<key>=<value>,..."
+func (pattern *Pattern) parseExtensions(text string) error {
+	for _, field := range strings.Split(text, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected '<key>=<value>' extension, got '%s'", field)
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad extension value '%s', %s", field, err)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "min_offset":
+			pattern.MinOffset = value
+		case "max_offset":
+			pattern.MaxOffset = value
+		case "min_length":
+			pattern.MinLength = value
+		case "edit_distance":
+			pattern.EditDistance = uint32(value)
+		case "hamming_distance":
+			pattern.HammingDistance = uint32(value)
+		default:
+			return fmt.Errorf("unknown extension '%s'", kv[0])
+		}
+	}
+	return nil
+}
+
+// returns true if the pattern has a flag
+func (pattern *Pattern) hasFlag(flag byte) bool {
+	return strings.IndexByte(pattern.Flags, flag) >= 0
+}
+
+// returns the pattern as "/<expression>/<flags>{<extensions>}", without ID
+func (pattern *Pattern) String() string {
+	var extensions []string
+	for _, ext := range []struct {
+		name  string
+		value uint64
+	}{
+		{"min_offset", pattern.MinOffset},
+		{"max_offset", pattern.MaxOffset},
+		{"min_length", pattern.MinLength},
+		{"edit_distance", uint64(pattern.EditDistance)},
+		{"hamming_distance", uint64(pattern.HammingDistance)},
+	} {
+		if ext.value > 0 {
+			extensions = append(extensions, fmt.Sprintf("%s=%d", ext.name, ext.value))
+		}
+	}
+
+	text := "/" + pattern.Expression + "/" + pattern.Flags
+	if len(extensions) > 0 {
+		text += "{" + strings.Join(extensions, ",") + "}"
+	}
+	return text
+}
+
+// returns the patterns in a pattern file
+func parseFile(filename string) (patterns []*Pattern) {
+	// open pattern file for reading
+	data, err := ioutil.ReadFile(filename)
+	checkErr(err, fmt.Sprintf("Can't read pattern file '%s'", filename))
+
+	reader := bufio.NewReader(bytes.NewBuffer(data))
+	eof := false
+	lineno := 0
+
+	for !eof {
+		line, err := reader.ReadString('\n')
+
+		switch err {
+		case nil:
+			// pass
+		case io.EOF:
+			eof = true
+		default:
+			log.Fatal(fmt.Sprintf("ERROR: Can't read pattern file %s, %s", filename, err))
+		}
+
+		line = strings.TrimSpace(line)
+		lineno++
+
+		// if line is empty, or a comment, we can skip it
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// otherwise, it should be ID:PCRE, e.g.
+		//  10001:/foobar/is
+		//  10001:/foobar/is{key1=value1,key2=value2,...}
+		strs := strings.SplitN(line, ":", 2)
+
+		// parse the pattern ID
+		id, err := strconv.ParseUint(strs[0], 10, 64)
+		checkErr(err, fmt.Sprintf("Could not parse id at line %d, %s", lineno, err))
+
+		// parse the pattern
+		if len(strs) < 2 {
+			log.Fatal(fmt.Sprintf("Expected pattern after id at line %d", lineno))
+		}
+		pattern, err := parsePattern(strs[1])
+		checkErr(err, fmt.Sprintf("Could not parse pattern at line %d, %s", lineno, err))
+
+		// set Id on the pattern
+		pattern.ID = uint(id)
+
+		// add the pattern
+		patterns = append(patterns, pattern)
+	}
+
+	return
+}
+
+// returns the distinct pattern IDs in a pattern file, in file order
+func getPatternIDs(filename string) []uint {
+	var ids []uint
+	seen := make(map[uint]bool)
+	for _, pattern := range parseFile(filename) {
+		id := pattern.ID
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,71 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		text  string
+		want  Pattern
+		flags string
+	}{
+		{"ACGT", Pattern{Expression: "ACGT"}, ""},
+		{"/AC.T/iL", Pattern{Expression: "AC.T", Flags: "iL"}, "iL"},
+		{"/A/C/sH{edit_distance=1, min_offset=4}", Pattern{Expression: "A/C", Flags: "sH", EditDistance: 1, MinOffset: 4}, "sH"},
+		// => deprecated flags, as the flags they stand for
+		{"/ACGT/l", Pattern{Expression: "ACGT", Flags: "L"}, "L"},
+		{"/ACGT/oeupf", Pattern{Expression: "ACGT", Flags: "HV8WP"}, "HV8WP"},
+		{"/ACGT/lL", Pattern{Expression: "ACGT", Flags: "L"}, "L"},
+	}
+	for _, test := range tests {
+		pattern, err := parsePattern(test.text)
+		if err != nil || !reflect.DeepEqual(*pattern, test.want) {
+			t.Errorf("parsePattern(%s) = %+v, %v, want %+v", test.text, pattern, err, test.want)
+			continue
+		}
+		for _, flag := range []byte(test.flags) {
+			if !pattern.hasFlag(flag) {
+				t.Errorf("parsePattern(%s) doesn't have flag '%c'", test.text, flag)
+			}
+		}
+	}
+
+	// => unknown flags, logical combinations and extensions
+	for _, text := range []string{"/ACGT/x", "/ACGT/C", "/ACGT/Q", "/ACGT/L{edit_distance=1", "/ACGT/{max_length=4}", "/ACGT/{edit_distance}"} {
+		if pattern, err := parsePattern(text); err == nil {
+			t.Errorf("parsePattern(%s) = %+v, want an error", text, pattern)
+		}
+	}
+}
+
+func TestParsePatternFile(t *testing.T) {
+	patterns := parseFile("data/barcodes.test.re")
+	if len(patterns) != 10 {
+		t.Fatalf("got %d patterns, want 10", len(patterns))
+	}
+	for _, pattern := range patterns {
+		if pattern.Flags != "L" {
+			t.Errorf("pattern ID %d flags = %q, want \"L\"", pattern.ID, pattern.Flags)
+		}
+	}
+	if ids := getPatternIDs("data/barcodes.test.re"); !reflect.DeepEqual(ids, []uint{1, 2, 3, 4, 5}) {
+		t.Errorf("pattern IDs = %v, want [1 2 3 4 5]", ids)
+	}
+
+	// => as scanned by the pure-Go engine, with start of match offsets
+	matcher, err := newGoMatcher(patterns)
+	if err != nil {
+		t.Fatalf("couldn't build matcher: %s", err)
+	}
+	read := "GG" + "CACCCCACCCAACCCCAAAC" + "GG\n"
+	if matches := scanAll(t, matcher, []byte(read)); len(matches) != 1 || matches[0] != (testMatch{1, 2, 22}) {
+		t.Errorf("matches = %v, want [{1 2 22}]", matches)
+	}
+}
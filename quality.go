@@ -0,0 +1,77 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * quality.go
+ *
+ * => quality-aware matching: bases called below a Phred threshold are
+ *    masked to 'N' before scanning, so tolerant patterns treat them as
+ *    wildcards; output reads keep their original bases
+ * => matches can be rejected by the minimum or mean base quality over the
+ *    matched span; rejected matches are counted in stats, but aren't hits
+ *
+ */
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Phred+33 quality encoding offset
+const phredOffset = 33
+
+// returns true if any of the match quality filters are set
+func matchQualityFiltered() bool {
+	return *flagMatchMinQual > 0 || *flagMatchMeanQual > 0
+}
+
+// checks the '-qmask' and '-match-*-qual' flags
+func checkQualityFlags() {
+	if *flagQualMask < 0 || *flagMatchMinQual < 0 || *flagMatchMeanQual < 0 {
+		log.Fatal("Quality thresholds ('-qmask', '-match-min-qual', '-match-mean-qual') can't be negative!")
+	}
+}
+
+// returns seq with the bases called below the '-qmask' Phred threshold
+// replaced with 'N'
+func qualityMaskSeq(seq, qual string) string {
+	if *flagQualMask <= 0 {
+		return seq
+	}
+
+	var masked []byte
+	for i := 0; i < len(seq) && i < len(qual); i++ {
+		if int(qual[i])-phredOffset >= *flagQualMask {
+			continue
+		}
+		if masked == nil {
+			masked = []byte(seq)
+		}
+		masked[i] = 'N'
+	}
+	if masked == nil {
+		return seq
+	}
+	return string(masked)
+}
+
+// returns true if the base qualities of a match pass the '-match-min-qual'
+// and '-match-mean-qual' filters
+func matchQualityOK(qual string) bool {
+	if !matchQualityFiltered() || len(qual) == 0 {
+		return true
+	}
+
+	sum := 0
+	for i := 0; i < len(qual); i++ {
+		q := int(qual[i]) - phredOffset
+		if q < *flagMatchMinQual {
+			return false
+		}
+		sum += q
+	}
+	return float64(sum)/float64(len(qual)) >= *flagMatchMeanQual
+}
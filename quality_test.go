@@ -0,0 +1,64 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestQualityMaskSeq(t *testing.T) {
+	qualMask := *flagQualMask
+	defer func() { *flagQualMask = qualMask }()
+
+	// => Phred+33: '#' is 2, '5' is 20, 'I' is 40
+	*flagQualMask = 0
+	if got := qualityMaskSeq("ACGT", "####"); got != "ACGT" {
+		t.Errorf("masked without a threshold: %s", got)
+	}
+
+	*flagQualMask = 20
+	tests := []struct {
+		seq, qual, want string
+	}{
+		{"ACGT", "IIII", "ACGT"},
+		{"ACGT", "#I4I", "NCNT"},
+		{"ACGT", "5555", "ACGT"},
+		// => bases without a quality are kept
+		{"ACGTA", "##", "NNGTA"},
+	}
+	for _, test := range tests {
+		if got := qualityMaskSeq(test.seq, test.qual); got != test.want {
+			t.Errorf("qualityMaskSeq(%s, %s) = %s, want %s", test.seq, test.qual, got, test.want)
+		}
+	}
+}
+
+func TestMatchQualityOK(t *testing.T) {
+	minQual, meanQual := *flagMatchMinQual, *flagMatchMeanQual
+	defer func() { *flagMatchMinQual, *flagMatchMeanQual = minQual, meanQual }()
+
+	*flagMatchMinQual, *flagMatchMeanQual = 0, 0
+	if !matchQualityOK("!!!!") {
+		t.Errorf("match rejected without quality filters")
+	}
+
+	*flagMatchMinQual = 20
+	if !matchQualityOK("5I5I") || matchQualityOK("IIII4") {
+		t.Errorf("minimum quality 20 filter: want '5I5I' passed, 'IIII4' rejected")
+	}
+
+	// => mean of "+I" is (10+40)/2 = 25
+	*flagMatchMinQual, *flagMatchMeanQual = 0, 25
+	if !matchQualityOK("+I") || matchQualityOK("+H") {
+		t.Errorf("mean quality 25 filter: want '+I' passed, '+H' rejected")
+	}
+	if !matchQualityOK("") {
+		t.Errorf("match without qualities rejected")
+	}
+
+	*flagMatchMinQual = -1
+	expectFatal(t, "a negative quality threshold", checkQualityFlags)
+}
@@ -0,0 +1,372 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * readset.go
+ *
+ * => synchronized, role-labelled read input files (R1, R2, I1, I2, UMI)
+ * => each role may be given as multiple files (eg: lanes), streamed in order
+ * => alternatively, all roles may come from unaligned BAM file(s) (see bam.go)
+ *
+ */
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/drio/drio.go/bio/fasta"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReadRole = role label of a read file in a read set
+type ReadRole string
+
+// supported read roles, in the order they are read
+const (
+	RoleR1  ReadRole = "R1"
+	RoleR2  ReadRole = "R2"
+	RoleI1  ReadRole = "I1"
+	RoleI2  ReadRole = "I2"
+	RoleUMI ReadRole = "UMI"
+)
+
+// Illumina lane tag in a file name, eg: "Sample_S1_L001_R1_001.fastq.gz"
+var reLane = regexp.MustCompile(`_(L\d{3})(_|\.|$)`)
+
+// fileListFlag = repeatable, comma-separated list of input files or glob patterns
+type fileListFlag []string
+
+// returns a pointer to a new fileListFlag registered with the flag package
+func newFileListFlag(name, usage string) *fileListFlag {
+	files := new(fileListFlag)
+	flag.Var(files, name, usage)
+	return files
+}
+
+func (files *fileListFlag) String() string {
+	return strings.Join(*files, ",")
+}
+
+func (files *fileListFlag) Set(value string) error {
+	for _, file := range strings.Split(value, ",") {
+		if file != "" {
+			*files = append(*files, file)
+		}
+	}
+	return nil
+}
+
+// returns file paths with glob patterns expanded, in the order given
+func (files fileListFlag) expand() []string {
+	var paths []string
+	for _, file := range files {
+		if isSTDINFilename(file) || !strings.ContainsAny(file, "*?[") {
+			paths = append(paths, file)
+			continue
+		}
+		matches, err := filepath.Glob(file)
+		checkErr(err, fmt.Sprintf("Bad input file pattern '%s'! %s", file, err))
+		if len(matches) == 0 {
+			log.Fatal(fmt.Sprintf("No input files match pattern '%s'!", file))
+		}
+		// => filepath.Glob returns matches in lexical order, so L001 before L002
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
+// InputFile = a single file of a (possibly multi-lane) read input
+type InputFile struct {
+	Filepath string
+	Lane     string
+	Count    int
+}
+
+// ReadInput = a single role-labelled input of a read set
+type ReadInput struct {
+	Role     ReadRole
+	Files    []*InputFile
+	Basename string
+	Reader   *fasta.FqReader
+	Matcher  Matcher
+	Count    int
+
+	fileIndex int
+	file      *os.File
+	bar       *pb.ProgressBar
+	// shared uBAM input, when not reading FASTQ
+	bam *bamInput
+}
+
+// ReadSet = 1 to N synchronized read inputs, one record from each per iteration
+type ReadSet []*ReadInput
+
+// returns a ReadSet from the input file flags; roles without a file are skipped
+func newReadSet() ReadSet {
+	var readSet ReadSet
+
+	if len(*flagUBAMFile) > 0 {
+		if len(*flagR1File)+len(*flagR2File)+len(*flagI1File)+len(*flagI2File)+len(*flagUMIFile) > 0 {
+			log.Fatal("uBAM input can't be combined with FASTQ input files!")
+		}
+		return newBAMReadSet(flagUBAMFile.expand())
+	}
+
+	roleFiles := []struct {
+		role  ReadRole
+		files *fileListFlag
+	}{
+		{RoleR1, flagR1File},
+		{RoleR2, flagR2File},
+		{RoleI1, flagI1File},
+		{RoleI2, flagI2File},
+		{RoleUMI, flagUMIFile},
+	}
+
+	for _, rf := range roleFiles {
+		paths := rf.files.expand()
+		if len(paths) == 0 {
+			continue
+		}
+		input := &ReadInput{Role: rf.role}
+		for _, path := range paths {
+			input.Files = append(input.Files, &InputFile{Filepath: path, Lane: getLane(path)})
+		}
+		readSet = append(readSet, input)
+	}
+
+	return readSet
+}
+
+// returns a ReadSet reading all roles found in the first template of the uBAM file(s)
+func newBAMReadSet(paths []string) ReadSet {
+	var readSet ReadSet
+
+	for _, path := range paths {
+		if isSTDINFilename(path) {
+			log.Fatal("uBAM input from STDIN isn't supported!")
+		}
+	}
+
+	bam := &bamInput{Files: paths}
+	for _, role := range getBAMRoles(paths[0]) {
+		input := &ReadInput{Role: role, bam: bam}
+		for _, path := range paths {
+			input.Files = append(input.Files, &InputFile{Filepath: path, Lane: getLane(path)})
+		}
+		readSet = append(readSet, input)
+	}
+	if len(readSet) == 0 {
+		log.Fatal(fmt.Sprintf("No records found in uBAM file '%s'!", paths[0]))
+	}
+
+	return readSet
+}
+
+// opens readers for all inputs and clones the matcher for each;
+// returns the progress bar attached to the first input
+func (readSet ReadSet) open(matcher Matcher) *pb.ProgressBar {
+	var bar *pb.ProgressBar
+
+	for i, input := range readSet {
+		// TODO: fix this hack
+		if input.bam == nil {
+			for _, file := range input.Files {
+				if _, ok := getGzFastqBasename(file.Filepath); !ok {
+					log.Fatal(fmt.Sprintf("%s file '%s' doesn't have '.fastq.gz' suffix as expected!", input.Role, file.Filepath))
+				}
+			}
+		}
+		input.Basename = input.outputBasename()
+
+		// progress bar covers all files of the first input
+		if i == 0 && !*flagSilent {
+			var totalBytes int64
+			for _, file := range input.Files {
+				if !isSTDINFilename(file.Filepath) {
+					totalBytes += getFileSizeInBytes(file.Filepath)
+				}
+			}
+			bar = pb.Full.Start64(totalBytes)
+			input.bar = bar
+		}
+
+		if input.bam == nil {
+			input.openFile()
+		} else if input.bam.reader == nil {
+			input.bam.bar = input.bar
+			input.bam.openFile()
+		}
+
+		// => no matcher when replaying a hit index
+		if matcher != nil {
+			var err error
+			input.Matcher, err = matcher.Clone()
+			checkErr(err)
+		}
+	}
+
+	return bar
+}
+
+// returns the basename used for output files; lane tags are dropped
+// when multiple files are merged
+func (input *ReadInput) outputBasename() string {
+	var basename string
+	if input.bam == nil {
+		basename, _ = getGzFastqBasename(input.Files[0].Filepath)
+	} else {
+		// => roles share the uBAM file, so the role is part of the name
+		basename = getBAMBasename(input.Files[0].Filepath) + "_" + string(input.Role)
+	}
+	if len(input.Files) > 1 {
+		basename = reLane.ReplaceAllString(basename, "$2")
+	}
+	return basename
+}
+
+// opens a reader on the current input file
+func (input *ReadInput) openFile() {
+	file := input.Files[input.fileIndex]
+	log.Debug(fmt.Sprintf("Reading %s file: %s", input.Role, file.Filepath))
+	input.Reader, input.file = getFQReader(file.Filepath, input.bar)
+}
+
+// reads the next record, advancing to the next input file when the current one is exhausted
+func (input *ReadInput) next() (FASTQRecord, bool) {
+	if input.bam != nil {
+		record, done := input.bam.next(input.Role)
+		if !done {
+			input.Files[input.bam.templateFileIndex].Count++
+			input.Count++
+			record.InputFileBasename = input.Basename
+		}
+		return record, done
+	}
+
+	for {
+		file := input.Files[input.fileIndex]
+		var record FASTQRecord
+		var done bool
+		if *flagStreamChunk > 0 {
+			record, done = scanStreamRecord(input.Reader.Reader, input.Matcher.(StreamMatcher), FASTQRecord{InputFileBasename: input.Basename, Role: input.Role, Lane: file.Lane}, streamSpool)
+		} else {
+			fq, fqDone := input.Reader.Iter()
+			record, done = FASTQRecord{InputFileBasename: input.Basename, Role: input.Role, Lane: file.Lane, Name: fq.Name, Seq: fq.Seq, Qual: fq.Qual}, fqDone
+		}
+		if !done {
+			file.Count++
+			input.Count++
+			return record, false
+		}
+
+		if input.file != os.Stdin {
+			input.file.Close()
+		}
+		if input.fileIndex+1 >= len(input.Files) {
+			return FASTQRecord{}, true
+		}
+		input.fileIndex++
+		input.openFile()
+	}
+}
+
+// reads the next record from every input; done is true once all inputs are exhausted,
+// and mismatched record counts or lanes between inputs are fatal
+func (readSet ReadSet) next() (records []FASTQRecord, done bool) {
+	doneCount := 0
+	for _, input := range readSet {
+		record, inputDone := input.next()
+		if inputDone {
+			doneCount++
+			continue
+		}
+		records = append(records, record)
+	}
+
+	if doneCount > 0 {
+		if doneCount < len(readSet) {
+			log.Error(readSet.counts())
+			log.Fatal("Encountered input file record mismatch!!!")
+		}
+		return nil, true
+	}
+
+	// inputs should move on to the next lane together
+	for _, record := range records[1:] {
+		if record.Lane != records[0].Lane {
+			log.Error(readSet.counts())
+			log.Fatal(fmt.Sprintf("Encountered input file lane mismatch (%s %s vs. %s %s)!!!", records[0].Role, records[0].Lane, record.Role, record.Lane))
+		}
+	}
+
+	return records, false
+}
+
+// returns true if the read set has an input for role
+func (readSet ReadSet) hasRole(role ReadRole) bool {
+	for _, input := range readSet {
+		if input.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the UMI read sequence of a set of records, or empty string
+func (readSet ReadSet) umi(records []FASTQRecord) string {
+	for _, record := range records {
+		if record.Role == RoleUMI {
+			return record.Seq
+		}
+	}
+	return ""
+}
+
+// frees cloned matchers
+func (readSet ReadSet) close() {
+	for _, input := range readSet {
+		if input.Matcher != nil {
+			input.Matcher.Close()
+		}
+	}
+}
+
+// returns a summary of record counts per read role
+func (readSet ReadSet) counts() string {
+	summary := ""
+	for i, input := range readSet {
+		if i > 0 {
+			summary += " "
+		}
+		summary += fmt.Sprintf("%s=%d", input.Role, input.Count)
+	}
+	return summary
+}
+
+// logs record counts for each input file
+func (readSet ReadSet) logLaneCounts() {
+	for _, input := range readSet {
+		for _, file := range input.Files {
+			log.Info(fmt.Sprintf("%s %s: %d records (%s)", input.Role, file.Lane, file.Count, file.Filepath))
+		}
+	}
+}
+
+// returns the Illumina lane tag of a file name (eg: "L001"), or empty string
+func getLane(filePath string) string {
+	lane := reLane.FindStringSubmatch(filepath.Base(filePath))
+	if lane == nil {
+		return ""
+	}
+	return lane[1]
+}
@@ -0,0 +1,122 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writes gzipped FASTQ files of records named "<lane>-<n>", as many as counts
+// for each file name, and returns a read input of them in order
+func fastqInput(t *testing.T, role ReadRole, counts map[string]int, names ...string) *ReadInput {
+	dir := t.TempDir()
+	input := &ReadInput{Role: role}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := gzip.NewWriter(file)
+		for n := 1; n <= counts[name]; n++ {
+			fmt.Fprintf(writer, "@%s-%d\nACGT\n+\nIIII\n", getLane(name), n)
+		}
+		writer.Close()
+		file.Close()
+		input.Files = append(input.Files, &InputFile{Filepath: path, Lane: getLane(path)})
+	}
+	input.Basename = input.outputBasename()
+	input.openFile()
+	return input
+}
+
+func TestGetLane(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"run/S1_S1_L001_R1_001.fastq.gz", "L001"},
+		{"S1_L002_R1.fastq.gz", "L002"},
+		{"L003_S1_R1.fastq.gz", ""},
+		{"S1_R1_001.fastq.gz", ""},
+	}
+	for _, test := range tests {
+		if got := getLane(test.path); got != test.want {
+			t.Errorf("getLane(%s) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestReadSetLanes(t *testing.T) {
+	counts := map[string]int{
+		"S1_L001_R1_001.fastq.gz": 2, "S1_L002_R1_001.fastq.gz": 1,
+		"S1_L001_R2_001.fastq.gz": 2, "S1_L002_R2_001.fastq.gz": 1,
+	}
+	readSet := ReadSet{
+		fastqInput(t, RoleR1, counts, "S1_L001_R1_001.fastq.gz", "S1_L002_R1_001.fastq.gz"),
+		fastqInput(t, RoleR2, counts, "S1_L001_R2_001.fastq.gz", "S1_L002_R2_001.fastq.gz"),
+	}
+	// => lanes are merged into outputs without a lane tag
+	if basename := readSet[0].Basename; basename != "S1_R1_001" {
+		t.Errorf("merged basename = %s, want S1_R1_001", basename)
+	}
+
+	// => lane files are read in order, a record of each input per read set
+	var names []string
+	for {
+		records, done := readSet.next()
+		if done {
+			break
+		}
+		for _, record := range records {
+			names = append(names, string(record.Role)+" "+record.Lane+" "+strings.TrimPrefix(record.Name, "@"))
+		}
+	}
+	want := []string{
+		"R1 L001 L001-1", "R2 L001 L001-1", "R1 L001 L001-2", "R2 L001 L001-2",
+		"R1 L002 L002-1", "R2 L002 L002-1",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("records %v, want %v", names, want)
+	}
+	for _, input := range readSet {
+		if input.Count != 3 || input.Files[0].Count != 2 || input.Files[1].Count != 1 {
+			t.Errorf("%s counts = %d (%d, %d), want 3 (2, 1)", input.Role, input.Count, input.Files[0].Count, input.Files[1].Count)
+		}
+	}
+}
+
+func TestReadSetMismatch(t *testing.T) {
+	counts := map[string]int{
+		"S1_L001_R1_001.fastq.gz": 2, "S1_L002_R1_001.fastq.gz": 1,
+		"S1_L001_R2_001.fastq.gz": 1, "S1_L002_R2_001.fastq.gz": 2,
+	}
+
+	// => inputs of different record counts
+	readSet := ReadSet{
+		fastqInput(t, RoleR1, counts, "S1_L001_R1_001.fastq.gz"),
+		fastqInput(t, RoleR2, counts, "S1_L001_R2_001.fastq.gz"),
+	}
+	readSet.next()
+	expectFatal(t, "inputs of different record counts", func() {
+		readSet.next()
+	})
+
+	// => inputs of the same record count, moving on to the next lane apart
+	readSet = ReadSet{
+		fastqInput(t, RoleR1, counts, "S1_L001_R1_001.fastq.gz", "S1_L002_R1_001.fastq.gz"),
+		fastqInput(t, RoleR2, counts, "S1_L001_R2_001.fastq.gz", "S1_L002_R2_001.fastq.gz"),
+	}
+	readSet.next()
+	expectFatal(t, "inputs of different lane record counts", func() {
+		readSet.next()
+	})
+}
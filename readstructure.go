@@ -0,0 +1,158 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * readstructure.go
+ *
+ * => Picard / fgbio style read structures for fixed-position layouts,
+ *    eg: "8B12M+T" = 8bp sample barcode, 12bp UMI, then template
+ *
+ *	B sample barcode, scanned for pattern matches in place of the whole read
+ *	M molecular barcode (UMI), added to the read set UMI
+ *	T template, written as the output read
+ *	S skipped
+ *
+ * => a length of '+' means the rest of the read, for the last segment only
+ *
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// read structure segment types
+const (
+	segmentTemplate  = 'T'
+	segmentBarcode   = 'B'
+	segmentMolecular = 'M'
+	segmentSkip      = 'S'
+)
+
+// read structure segment, eg: "8B" or "+T"
+var reReadSegment = regexp.MustCompile(`(\d+|\+)([TBMS])`)
+
+// ReadSegment = a single read structure segment; Length < 0 means the rest of the read
+type ReadSegment struct {
+	Type   byte
+	Length int
+}
+
+// ReadStructure = segments of a read, in read order
+type ReadStructure []ReadSegment
+
+// SegmentSpan = [From,To) offsets of a segment in a read
+type SegmentSpan struct {
+	Type     byte
+	From, To int
+}
+
+// readStructures from the '-rs' flag, by read role
+var readStructures = make(map[ReadRole]ReadStructure)
+
+// returns a parsed read structure, eg: "8B12M+T"
+func parseReadStructure(text string) ReadStructure {
+	var structure ReadStructure
+	matched := 0
+	for _, m := range reReadSegment.FindAllStringSubmatchIndex(text, -1) {
+		if m[0] != matched {
+			break
+		}
+		matched = m[1]
+
+		segment := ReadSegment{Type: text[m[4]], Length: -1}
+		if text[m[2]:m[3]] != "+" {
+			segment.Length, _ = strconv.Atoi(text[m[2]:m[3]])
+			if segment.Length == 0 {
+				log.Fatal(fmt.Sprintf("Zero length segment in read structure '%s'!", text))
+			}
+		}
+		if len(structure) > 0 && structure[len(structure)-1].Length < 0 {
+			log.Fatal(fmt.Sprintf("Only the last segment of read structure '%s' can have length '+'!", text))
+		}
+		structure = append(structure, segment)
+	}
+	if matched != len(text) || len(structure) == 0 {
+		log.Fatal(fmt.Sprintf("Bad read structure '%s'! Expected segments '<length|+><T|B|M|S>', eg: '8B12M+T'", text))
+	}
+	return structure
+}
+
+// returns read structures by role from a comma-separated list, eg: "R1:8B12M+T,R2:+T"
+func parseReadStructures(text string) map[ReadRole]ReadStructure {
+	structures := make(map[ReadRole]ReadStructure)
+	for _, spec := range strings.Split(text, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		fields := strings.SplitN(spec, ":", 2)
+		if len(fields) != 2 {
+			log.Fatal(fmt.Sprintf("Read structure '%s' should be '<role>:<structure>', eg: 'R1:8B12M+T'!", spec))
+		}
+		role := ReadRole(fields[0])
+		if role != RoleR1 && role != RoleR2 && role != RoleI1 && role != RoleI2 && role != RoleUMI {
+			log.Fatal(fmt.Sprintf("Unknown read role '%s' in read structure '%s'!", role, spec))
+		}
+		structures[role] = parseReadStructure(fields[1])
+	}
+	return structures
+}
+
+// returns the segment spans for a read of length n; segments past the end
+// of a short read are clipped
+func (structure ReadStructure) spans(n int) []SegmentSpan {
+	var spans []SegmentSpan
+	from := 0
+	for _, segment := range structure {
+		to := n
+		if segment.Length >= 0 && from+segment.Length < n {
+			to = from + segment.Length
+		}
+		if from > to {
+			from = to
+		}
+		spans = append(spans, SegmentSpan{segment.Type, from, to})
+		from = to
+	}
+	return spans
+}
+
+// returns the concatenated sequence and qualities of all segments of a type
+func (structure ReadStructure) extract(seq, qual string, segmentType byte) (string, string) {
+	var outSeq, outQual strings.Builder
+	for _, span := range structure.spans(len(seq)) {
+		if span.Type == segmentType {
+			outSeq.WriteString(seq[span.From:span.To])
+			outQual.WriteString(qual[span.From:span.To])
+		}
+	}
+	return outSeq.String(), outQual.String()
+}
+
+// returns the read set UMI with the molecular barcode segments of reads with
+// a structure appended, '-' separated
+func readStructureUMI(structures map[ReadRole]ReadStructure, umi string, records []FASTQRecord) string {
+	parts := []string{}
+	if umi != "" {
+		parts = append(parts, umi)
+	}
+	for _, record := range records {
+		structure, ok := structures[record.Role]
+		if !ok {
+			continue
+		}
+		if molecular, _ := structure.extract(strings.TrimSpace(record.Seq), strings.TrimSpace(record.Qual), segmentMolecular); molecular != "" {
+			parts = append(parts, molecular)
+		}
+	}
+	return strings.Join(parts, "-")
+}
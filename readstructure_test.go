@@ -0,0 +1,90 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseReadStructures(t *testing.T) {
+	structures := parseReadStructures("R1:8B12M+T, R2:4S+T,I1:8B")
+	want := map[ReadRole]ReadStructure{
+		RoleR1: {{segmentBarcode, 8}, {segmentMolecular, 12}, {segmentTemplate, -1}},
+		RoleR2: {{segmentSkip, 4}, {segmentTemplate, -1}},
+		RoleI1: {{segmentBarcode, 8}},
+	}
+	if !reflect.DeepEqual(structures, want) {
+		t.Errorf("structures = %+v, want %+v", structures, want)
+	}
+
+	for _, text := range []string{"8B12M+T", "R3:8B", "R1:", "R1:8X", "R1:8B+M4T", "R1:0B+T", "R1:8B 12M", "R1:B8"} {
+		expectFatal(t, "read structure '"+text+"'", func() {
+			parseReadStructures(text)
+		})
+	}
+}
+
+func TestReadStructureSpans(t *testing.T) {
+	structure := parseReadStructure("4B3M+T")
+	tests := []struct {
+		n    int
+		want []SegmentSpan
+	}{
+		{10, []SegmentSpan{{segmentBarcode, 0, 4}, {segmentMolecular, 4, 7}, {segmentTemplate, 7, 10}}},
+		// => short reads are clipped
+		{5, []SegmentSpan{{segmentBarcode, 0, 4}, {segmentMolecular, 4, 5}, {segmentTemplate, 5, 5}}},
+		{0, []SegmentSpan{{segmentBarcode, 0, 0}, {segmentMolecular, 0, 0}, {segmentTemplate, 0, 0}}},
+	}
+	for _, test := range tests {
+		if got := structure.spans(test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("spans(%d) = %v, want %v", test.n, got, test.want)
+		}
+	}
+
+	seq, qual := structure.extract("AAAACCCGGTT", "ABCDEFGHIJK", segmentTemplate)
+	if seq != "GGTT" || qual != "HIJK" {
+		t.Errorf("template = %s %s, want GGTT HIJK", seq, qual)
+	}
+	// => segments of a type are concatenated
+	seq, _ = parseReadStructure("2M2S2M").extract("AACCGGTT", "IIIIIIII", segmentMolecular)
+	if seq != "AAGG" {
+		t.Errorf("molecular = %s, want AAGG", seq)
+	}
+}
+
+func TestReadStructureUMI(t *testing.T) {
+	structures := parseReadStructures("R1:2B3M+T,R2:4M+T")
+	records := []FASTQRecord{
+		{Seq: "GGACGTTTT\n", Qual: "IIIIIIIII\n", Role: RoleR1},
+		{Seq: "CCCCAAAA\n", Qual: "IIIIIIII\n", Role: RoleR2},
+		{Seq: "GATTACA\n", Qual: "IIIIIII\n", Role: RoleI1},
+	}
+	if umi := readStructureUMI(structures, "TTAG", records); umi != "TTAG-ACG-CCCC" {
+		t.Errorf("UMI = %s, want TTAG-ACG-CCCC", umi)
+	}
+	if umi := readStructureUMI(structures, "", records[:1]); umi != "ACG" {
+		t.Errorf("UMI = %s, want ACG", umi)
+	}
+}
+
+func TestScanReadStructureBarcodes(t *testing.T) {
+	structures := readStructures
+	defer func() { readStructures = structures }()
+	readStructures = parseReadStructures("R1:4S8B+T")
+	matcher, err := newGoMatcher(testPatterns(t, "1:/ACGT/L"))
+	if err != nil {
+		t.Fatalf("couldn't build matcher: %s", err)
+	}
+
+	// => only the barcode segment is scanned, hits at their read offsets
+	readSetHits = readSetHits[:0]
+	scanFastqRecord(matcher, FASTQRecord{Seq: "ACGTACGTGGGGACGT\n", Qual: "IIIIIIIIIIIIIIII\n", Role: RoleR1})
+	want := []Hit{{ID: 1, Role: RoleR1, From: 4, To: 8, MatchSeq: "ACGT", MatchQual: "IIII"}}
+	if !reflect.DeepEqual(readSetHits, want) {
+		t.Errorf("hits = %+v, want %+v", readSetHits, want)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * report.go
+ *
+ * => MultiQC custom content files (*_mqc.json) and a single-file HTML
+ *    report, both built from the end-of-run stats report
+ * => HTML charts are inline SVG, so the report has no external dependencies
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MultiQCSection = a MultiQC custom content section, written as one '_mqc.json' file
+type MultiQCSection struct {
+	ID          string                 `json:"id"`
+	SectionName string                 `json:"section_name"`
+	Description string                 `json:"description"`
+	PlotType    string                 `json:"plot_type"`
+	PConfig     map[string]interface{} `json:"pconfig"`
+	Data        interface{}            `json:"data"`
+}
+
+// returns the MultiQC custom content sections for a report
+func multiQCSections(report StatsReport, runName string) map[string]MultiQCSection {
+	samples := make(map[string]map[string]int)
+	for _, sample := range report.Samples {
+		samples[sample.Name] = map[string]int{"assigned": sample.Count}
+	}
+	samples["Undetermined"] = map[string]int{"undetermined": report.Undetermined.Count}
+	samples["Ambiguous"] = map[string]int{"ambiguous": report.Ambiguous.Count}
+	if whitelist != nil {
+		samples["Rejected"] = map[string]int{"rejected": report.Rejected.Count}
+	}
+
+	offsets := make(map[string]map[string]int)
+	for _, id := range report.IDs {
+		series := make(map[string]int)
+		for offset, count := range id.Offsets {
+			series[fmt.Sprint(offset)] = count
+		}
+		offsets[fmt.Sprintf("%d (%s)", id.ID, id.Sample)] = series
+	}
+
+	undetermined := make(map[string]map[string]interface{})
+	for _, mate := range report.Mates {
+		for _, unmatched := range mate.TopUnmatched {
+			undetermined[string(mate.Role)+" "+unmatched.Name] = map[string]interface{}{
+				"mate":     string(mate.Role),
+				"sequence": unmatched.Name,
+				"count":    unmatched.Count,
+				"percent":  unmatched.Percent,
+			}
+		}
+	}
+
+	return map[string]MultiQCSection{
+		"summary": {
+			ID:          "gobcly_summary",
+			SectionName: "GoBCLy summary",
+			Description: "Read sets assigned to a sample, undetermined and ambiguous.",
+			PlotType:    "table",
+			PConfig:     map[string]interface{}{"id": "gobcly_summary_table", "title": "GoBCLy: summary"},
+			Data: map[string]map[string]interface{}{
+				runName: {
+					"read_sets":          report.ReadSets,
+					"assigned_pct":       report.Assigned.Percent,
+					"undetermined_pct":   report.Undetermined.Percent,
+					"ambiguous_pct":      report.Ambiguous.Percent,
+					"barcode_balance_cv": report.BarcodeBalanceCV,
+				},
+			},
+		},
+		"samples": {
+			ID:          "gobcly_samples",
+			SectionName: "GoBCLy sample reads",
+			Description: "Read sets per sample.",
+			PlotType:    "bargraph",
+			PConfig:     map[string]interface{}{"id": "gobcly_samples_plot", "title": "GoBCLy: read sets per sample", "ylab": "Read sets"},
+			Data:        samples,
+		},
+		"offsets": {
+			ID:          "gobcly_offsets",
+			SectionName: "GoBCLy match positions",
+			Description: "Match start offset distribution per pattern ID.",
+			PlotType:    "linegraph",
+			PConfig:     map[string]interface{}{"id": "gobcly_offsets_plot", "title": "GoBCLy: match start offsets", "xlab": "Offset", "ylab": "Hits"},
+			Data:        offsets,
+		},
+		"undetermined": {
+			ID:          "gobcly_undetermined",
+			SectionName: "GoBCLy undetermined",
+			Description: "Most frequent sequences at the expected barcode position in undetermined read sets.",
+			PlotType:    "table",
+			PConfig:     map[string]interface{}{"id": "gobcly_undetermined_table", "title": "GoBCLy: top undetermined"},
+			Data:        undetermined,
+		},
+	}
+}
+
+// writes MultiQC custom content files named from prefix, one per section
+func writeMultiQCReport(report StatsReport, prefix string) {
+	sections := multiQCSections(report, filepath.Base(prefix))
+	var names []string
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		filename := prefix + "." + name + "_mqc.json"
+		file := createOutputFile(filename)
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		checkErr(encoder.Encode(sections[name]), fmt.Sprintf("Couldn't write MultiQC file '%s'!", filename))
+		file.Close()
+	}
+
+	log.Info(fmt.Sprintf("MultiQC files: %s.*_mqc.json", prefix))
+}
+
+// chartBar = a single bar of an SVG bar chart
+type chartBar struct {
+	Label string
+	Value int
+}
+
+// returns a horizontal SVG bar chart
+func svgBarChart(bars []chartBar) template.HTML {
+	const barHeight, labelWidth, chartWidth = 18, 220, 460
+	max := 0
+	for _, bar := range bars {
+		if bar.Value > max {
+			max = bar.Value
+		}
+	}
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`,
+		labelWidth+chartWidth+80, len(bars)*(barHeight+4)+4)
+	for i, bar := range bars {
+		y := 4 + i*(barHeight+4)
+		width := 0
+		if max > 0 {
+			width = bar.Value * chartWidth / max
+		}
+		fmt.Fprintf(&svg, `<text x="%d" y="%d" text-anchor="end">%s</text>`, labelWidth-6, y+barHeight-5, html.EscapeString(bar.Label))
+		fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%d" height="%d" fill="#4a7fb5"/>`, labelWidth, y, width, barHeight)
+		fmt.Fprintf(&svg, `<text x="%d" y="%d">%d</text>`, labelWidth+width+4, y+barHeight-5, bar.Value)
+	}
+	svg.WriteString(`</svg>`)
+
+	return template.HTML(svg.String())
+}
+
+// returns the sample read distribution as chart bars, with undetermined and ambiguous
+func sampleBars(report StatsReport) []chartBar {
+	var bars []chartBar
+	for _, sample := range report.Samples {
+		bars = append(bars, chartBar{sample.Name, sample.Count})
+	}
+	return append(bars, chartBar{"Undetermined", report.Undetermined.Count}, chartBar{"Ambiguous", report.Ambiguous.Count})
+}
+
+// returns a pattern ID's match offset histogram as chart bars, in offset order
+func offsetBars(id IDReport) []chartBar {
+	var offsets []uint64
+	for offset := range id.Offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var bars []chartBar
+	for _, offset := range offsets {
+		bars = append(bars, chartBar{fmt.Sprintf("offset %d", offset), id.Offsets[offset]})
+	}
+	return bars
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"chart":      svgBarChart,
+	"sampleBars": sampleBars,
+	"offsetBars": offsetBars,
+	"pct":        func(pct float64) string { return fmt.Sprintf("%.2f%%", pct) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoBCLy report: {{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: right; }
+th:first-child, td:first-child, td.seq { text-align: left; }
+td.seq { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1>GoBCLy report: {{.Name}}</h1>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Read sets</th><td>{{.Report.ReadSets}}</td><td></td></tr>
+<tr><th>Assigned</th><td>{{.Report.Assigned.Count}}</td><td>{{pct .Report.Assigned.Percent}}</td></tr>
+<tr><th>Undetermined</th><td>{{.Report.Undetermined.Count}}</td><td>{{pct .Report.Undetermined.Percent}}</td></tr>
+<tr><th>Ambiguous</th><td>{{.Report.Ambiguous.Count}}</td><td>{{pct .Report.Ambiguous.Percent}}</td></tr>
+{{if .Report.Rejected.Count}}<tr><th>Rejected</th><td>{{.Report.Rejected.Count}}</td><td>{{pct .Report.Rejected.Percent}}</td></tr>
+{{end}}{{if .Report.TooShort.Count}}<tr><th>Too short</th><td>{{.Report.TooShort.Count}}</td><td>{{pct .Report.TooShort.Percent}}</td></tr>
+{{end}}<tr><th>Barcode balance CV</th><td>{{printf "%.4f" .Report.BarcodeBalanceCV}}</td><td></td></tr>
+</table>
+
+<h2>Sample read distribution</h2>
+{{chart (sampleBars .Report)}}
+
+<h2>Match positions</h2>
+{{range .Report.IDs}}
+<h3>{{.ID}} ({{.Sample}}): {{.Hits}} hits, mean barcode quality {{printf "%.2f" .MeanBarcodeQuality}}</h3>
+{{chart (offsetBars .)}}
+{{end}}
+
+<h2>Top undetermined</h2>
+{{range .Report.Mates}}
+<h3>{{.Role}}{{if .ExpectedWindow}}, expected barcode position {{.ExpectedWindow}}{{end}}</h3>
+{{if .TopUnmatched}}
+<table>
+<tr><th>Sequence</th><th>Count</th><th>% undetermined</th></tr>
+{{range .TopUnmatched}}<tr><td class="seq">{{.Name}}</td><td>{{.Count}}</td><td>{{pct .Percent}}</td></tr>
+{{end}}</table>
+{{else}}<p>None.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// writes a single-file HTML report named from prefix
+func writeHTMLReport(report StatsReport, prefix string) {
+	filename := prefix + ".html"
+	file := createOutputFile(filename)
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	err := htmlReportTemplate.Execute(writer, struct {
+		Name   string
+		Report StatsReport
+	}{filepath.Base(prefix), report})
+	checkErr(err, fmt.Sprintf("Couldn't write HTML report '%s'! %s", filename, err))
+	checkErr(writer.Flush(), fmt.Sprintf("Couldn't write HTML report '%s'!", filename))
+
+	log.Info(fmt.Sprintf("HTML report: %s", filename))
+}
@@ -0,0 +1,103 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// returns a report of two samples, with undetermined R1 sequences
+func sampleReport() StatsReport {
+	return StatsReport{
+		ReadSets:     10,
+		Assigned:     StatsCount{Count: 7, Percent: 70},
+		Undetermined: StatsCount{Count: 2, Percent: 20},
+		Ambiguous:    StatsCount{Count: 1, Percent: 10},
+		Samples:      []StatsCount{{Name: "S1", Count: 4, Percent: 40}, {Name: "S2", Count: 3, Percent: 30}},
+		IDs:          []IDReport{{ID: 1, Sample: "S1", Hits: 4, Offsets: map[uint64]int{12: 1, 2: 3}}},
+		Mates: []MateReport{{Role: RoleR1, Records: 10, ExpectedWindow: "2-10",
+			TopUnmatched: []StatsCount{{Name: "<ACGT&>", Count: 2, Percent: 100}}}},
+	}
+}
+
+func TestMultiQCSections(t *testing.T) {
+	sections := multiQCSections(sampleReport(), "run1")
+
+	samples := map[string]map[string]int{
+		"S1": {"assigned": 4}, "S2": {"assigned": 3},
+		"Undetermined": {"undetermined": 2}, "Ambiguous": {"ambiguous": 1},
+	}
+	if !reflect.DeepEqual(sections["samples"].Data, samples) {
+		t.Errorf("samples = %v, want %v", sections["samples"].Data, samples)
+	}
+	offsets := map[string]map[string]int{"1 (S1)": {"2": 3, "12": 1}}
+	if !reflect.DeepEqual(sections["offsets"].Data, offsets) {
+		t.Errorf("offsets = %v, want %v", sections["offsets"].Data, offsets)
+	}
+	summary := sections["summary"].Data.(map[string]map[string]interface{})
+	if row, ok := summary["run1"]; !ok || row["read_sets"] != 10 || row["assigned_pct"] != 70.0 {
+		t.Errorf("summary = %v, want run1 of 10 read sets, 70%% assigned", summary)
+	}
+	undetermined := sections["undetermined"].Data.(map[string]map[string]interface{})
+	if row := undetermined["R1 <ACGT&>"]; row["count"] != 2 || row["mate"] != "R1" {
+		t.Errorf("undetermined = %v, want R1 <ACGT&> of 2", undetermined)
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "run1")
+	writeMultiQCReport(sampleReport(), prefix)
+	writeHTMLReport(sampleReport(), prefix)
+	finalizeOutputFiles()
+
+	// => a MultiQC custom content file per section
+	for _, name := range []string{"summary", "samples", "offsets", "undetermined"} {
+		data, err := os.ReadFile(prefix + "." + name + "_mqc.json")
+		if err != nil {
+			t.Fatalf("couldn't read %s section: %s", name, err)
+		}
+		var section MultiQCSection
+		if err := json.Unmarshal(data, &section); err != nil || section.ID != "gobcly_"+name {
+			t.Errorf("%s section id = %q, %v, want gobcly_%s", name, section.ID, err, name)
+		}
+	}
+
+	// => a self-contained HTML report, with sequences escaped
+	data, err := os.ReadFile(prefix + ".html")
+	if err != nil {
+		t.Fatalf("couldn't read HTML report: %s", err)
+	}
+	report := string(data)
+	for _, want := range []string{"<title>GoBCLy report: run1</title>", "<svg", "&lt;ACGT&amp;&gt;", "expected barcode position 2-10"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("HTML report doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(report, "<ACGT&>") || strings.Contains(report, "<script") {
+		t.Errorf("HTML report has unescaped sequences or scripts")
+	}
+}
+
+func TestOffsetBars(t *testing.T) {
+	bars := offsetBars(IDReport{Offsets: map[uint64]int{12: 1, 2: 3, 0: 5}})
+	want := []chartBar{{"offset 0", 5}, {"offset 2", 3}, {"offset 12", 1}}
+	if !reflect.DeepEqual(bars, want) {
+		t.Errorf("bars = %v, want %v", bars, want)
+	}
+
+	// => bars are scaled to the largest value
+	chart := string(svgBarChart([]chartBar{{"a", 10}, {"b", 5}, {"c", 0}}))
+	for _, want := range []string{`width="460"`, `width="230"`, `width="0"`} {
+		if !strings.Contains(chart, want) {
+			t.Errorf("chart doesn't contain a bar of %s", want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * revcomp.go
+ *
+ * => byte-level reverse complement of reads, by lookup table: all IUPAC
+ *    codes in either case, and '.' / '-' gaps
+ * => other characters are handled by '-rc-policy':
+ *
+ *	N      written as 'N'
+ *	skip   the read set isn't written
+ *	abort  fatal, as before
+ *
+ */
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// complementTable = complement of each byte; 0 for unexpected characters
+var complementTable = func() (table [256]byte) {
+	for base := range iupacComplement {
+		table[base] = byte(complementBase(base))
+		table[base|0x20] = byte(complementBase(base | 0x20))
+	}
+	// => 'U' isn't in iupacComplement, see complementBase
+	table['U'], table['u'] = 'A', 'a'
+	table['.'], table['-'] = '.', '-'
+	return
+}()
+
+// readSetRevCompInvalid = unexpected characters reverse complementing the
+// current read set; reset once the read set is counted, see addReadSet
+var readSetRevCompInvalid int
+
+// checks the '-rc-policy' flag
+func checkRevCompPolicy() {
+	switch *flagRCPolicy {
+	case "N", "skip", "abort":
+	default:
+		log.Fatal(fmt.Sprintf("Unknown reverse complement policy '%s'! Supported: N, skip, abort", *flagRCPolicy))
+	}
+}
+
+// returns s reversed byte by byte, eg: base qualities
+func reverse(s string) string {
+	reversed := make([]byte, len(s))
+	for i := range reversed {
+		reversed[i] = s[len(s)-1-i]
+	}
+	return string(reversed)
+}
+
+// returns the reverse complement of a read sequence; unexpected characters
+// are handled by '-rc-policy'
+func reverseComplementDNA(s string) string {
+	rc := make([]byte, len(s))
+	for i := range rc {
+		c := complementTable[s[len(s)-1-i]]
+		if c == 0 {
+			readSetRevCompInvalid++
+			if *flagRCPolicy == "abort" {
+				log.Fatal(fmt.Sprintf("Unexpected character in:\n%s\n", s))
+			}
+			c = 'N'
+		}
+		rc[i] = c
+	}
+	return string(rc)
+}
+
+// returns the reverse complement of a sequence, keeping unexpected characters;
+// for matches and patterns, not output
+func reverseComplementSeq(s string) string {
+	rc := make([]byte, len(s))
+	for i := range rc {
+		b := s[len(s)-1-i]
+		if c := complementTable[b]; c != 0 {
+			b = c
+		}
+		rc[i] = b
+	}
+	return string(rc)
+}
+
+// returns true if the current read set is to be skipped for unexpected
+// characters, counting it
+func skipRevCompInvalid() bool {
+	if readSetRevCompInvalid == 0 || *flagRCPolicy != "skip" {
+		return false
+	}
+	runStats.RevCompSkipped++
+	return true
+}
@@ -0,0 +1,83 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestReverseComplementDNA(t *testing.T) {
+	policy := *flagRCPolicy
+	defer func() { *flagRCPolicy, readSetRevCompInvalid = policy, 0 }()
+	*flagRCPolicy, readSetRevCompInvalid = "abort", 0
+	tests := []struct {
+		seq, want string
+	}{
+		{"AACGT", "ACGTT"},
+		{"acgtN", "Nacgt"},
+		{"RYKMSW", "WSKMRY"},
+		{"BDHVN", "NBDHV"},
+		{"ryksmwbdhvn", "nbdhvwksmry"},
+		{"AU.u-", "-a.AT"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := reverseComplementDNA(test.seq); got != test.want {
+			t.Errorf("reverseComplementDNA(%s) = %s, want %s", test.seq, got, test.want)
+		}
+	}
+
+	// => complementing is its own inverse, for all but 'U'
+	for b, c := range complementTable {
+		if c != 0 && b != 'U' && b != 'u' && complementTable[c] != byte(b) {
+			t.Errorf("complement of '%c' is '%c', its complement '%c'", b, c, complementTable[c])
+		}
+	}
+	if readSetRevCompInvalid != 0 {
+		t.Errorf("%d unexpected characters counted, want none", readSetRevCompInvalid)
+	}
+}
+
+func TestRevCompPolicy(t *testing.T) {
+	policy, stats := *flagRCPolicy, runStats
+	defer func() { *flagRCPolicy, runStats, readSetRevCompInvalid = policy, stats, 0 }()
+	records := []FASTQRecord{{Name: "@read", Seq: "ACGT", Qual: "IIII", Role: RoleR1}}
+
+	// => unexpected characters are written as 'N', counted once per read set
+	*flagRCPolicy, runStats, readSetRevCompInvalid = "N", newStatsCollector(), 0
+	if got := reverseComplementDNA("AX*C"); got != "GNNT" {
+		t.Errorf("reverseComplementDNA(AX*C) = %s, want GNNT", got)
+	}
+	if skipRevCompInvalid() {
+		t.Errorf("read set skipped with policy 'N'")
+	}
+	runStats.addReadSet(records, nil, false)
+	runStats.addReadSet(records, nil, false)
+	if runStats.RevCompInvalid != 1 || runStats.RevCompSkipped != 0 {
+		t.Errorf("invalid %d, skipped %d, want 1, 0", runStats.RevCompInvalid, runStats.RevCompSkipped)
+	}
+
+	*flagRCPolicy, runStats, readSetRevCompInvalid = "skip", newStatsCollector(), 0
+	reverseComplementDNA("ACGT")
+	if skipRevCompInvalid() {
+		t.Errorf("read set of expected characters skipped")
+	}
+	reverseComplementDNA("ACGTZ")
+	if !skipRevCompInvalid() || runStats.RevCompSkipped != 1 {
+		t.Errorf("read set of unexpected characters not skipped, skipped %d", runStats.RevCompSkipped)
+	}
+
+	*flagRCPolicy = "abort"
+	expectFatal(t, "an unexpected character with policy 'abort'", func() {
+		reverseComplementDNA("ACGTZ")
+	})
+
+	// => matches and patterns keep unexpected characters, with any policy
+	readSetRevCompInvalid = 0
+	if got := reverseComplementSeq("AX*c"); got != "g*XT" || readSetRevCompInvalid != 0 {
+		t.Errorf("reverseComplementSeq(AX*c) = %s, %d unexpected characters counted", got, readSetRevCompInvalid)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * rounds.go
+ *
+ * => combinatorial split-pool barcodes (SPLiT-seq, sci-seq): several barcode
+ *    rounds, each with its own pattern file, matched in a chain where each
+ *    round has a positional relationship to the previous round's match
+ * => the round pattern IDs of a complete chain form a composite cell ID, eg:
+ *    "12_45_7", which takes the place of the sample for output routing and
+ *    counts
+ *
+ * => rounds file, whitespace-separated, one round per line in order:
+ *
+ *	<round> <pattern file> <role> <anchor> <min> <max>
+ *
+ *	anchor 'start': match start offset from the read start is in [min,max]
+ *	anchor 'prev':  match start offset from the previous round's match end
+ *	                is in [min,max]; from the read start if the previous
+ *	                round is in another read
+ *
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BarcodeRound = a single split-pool barcode round
+type BarcodeRound struct {
+	Number      int
+	PatternFile string
+	Role        ReadRole
+	// => true if offsets are relative to the previous round's match end
+	FromPrevious bool
+	Min, Max     int
+	matcher      Matcher
+}
+
+// roundScan = context for scanning a read with a round's database
+type roundScan struct {
+	hits []Hit
+	qual string
+}
+
+// barcodeRounds from the '-rounds' flag, in round order
+var barcodeRounds []*BarcodeRound
+
+// reads a rounds file
+func readRoundsFile(filename string) []*BarcodeRound {
+	var rounds []*BarcodeRound
+
+	file, err := os.Open(filename)
+	checkErr(err, fmt.Sprintf("Can't read rounds file '%s'", filename))
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			log.Fatal(fmt.Sprintf("Expected '<round> <pattern file> <role> <anchor> <min> <max>' at rounds file line %d", lineno))
+		}
+
+		round := &BarcodeRound{PatternFile: fields[1], Role: ReadRole(fields[2])}
+		round.Number, err = strconv.Atoi(fields[0])
+		if err != nil || round.Number != len(rounds)+1 {
+			log.Fatal(fmt.Sprintf("Expected round %d at rounds file line %d", len(rounds)+1, lineno))
+		}
+		switch fields[3] {
+		case "start":
+		case "prev":
+			round.FromPrevious = true
+		default:
+			log.Fatal(fmt.Sprintf("Unknown anchor '%s' at rounds file line %d! Supported: start, prev", fields[3], lineno))
+		}
+		if round.FromPrevious && round.Number == 1 {
+			log.Fatal(fmt.Sprintf("Round 1 can't be anchored to a previous round at rounds file line %d", lineno))
+		}
+		round.Min, err = strconv.Atoi(fields[4])
+		checkErr(err, fmt.Sprintf("Could not parse min offset at rounds file line %d, %s", lineno, err))
+		round.Max, err = strconv.Atoi(fields[5])
+		checkErr(err, fmt.Sprintf("Could not parse max offset at rounds file line %d, %s", lineno, err))
+		if round.Max < round.Min {
+			log.Fatal(fmt.Sprintf("Max offset is less than min offset at rounds file line %d", lineno))
+		}
+
+		rounds = append(rounds, round)
+	}
+	checkErr(scanner.Err(), fmt.Sprintf("Can't read rounds file '%s'", filename))
+
+	if len(rounds) == 0 {
+		log.Fatal(fmt.Sprintf("Rounds file '%s' has no rounds!", filename))
+	}
+	return rounds
+}
+
+// checks the patterns of each round; rounds are anchored by match start
+// offsets, so every pattern needs the 'L' flag
+func checkRoundPatterns(rounds []*BarcodeRound) {
+	for _, round := range rounds {
+		for _, pattern := range parseFile(round.PatternFile) {
+			if !pattern.hasFlag('L') {
+				log.Fatal(fmt.Sprintf("Split-pool barcode rounds ('-rounds') need match start offsets; round %d pattern ID %d doesn't have the 'L' flag!", round.Number, pattern.ID))
+			}
+		}
+	}
+}
+
+// builds the matcher of each round
+func openRoundMatchers(rounds []*BarcodeRound) {
+	for _, round := range rounds {
+		log.Info(fmt.Sprintf("Round %d pattern file: %s (%s)", round.Number, round.PatternFile, matchEngine))
+		round.matcher = newMatcherFromFile(round.PatternFile)
+	}
+}
+
+// frees the matcher of each round
+func closeRoundMatchers(rounds []*BarcodeRound) {
+	for _, round := range rounds {
+		round.matcher.Close()
+	}
+}
+
+// collects hits for a round scan
+func roundEventHandler(id uint, from, to uint64, flags uint, context interface{}) error {
+	scan := context.(*roundScan)
+	if to <= uint64(len(scan.qual)) && !matchQualityOK(scan.qual[from:to]) {
+		runStats.QualityRejected++
+		return nil
+	}
+	scan.hits = append(scan.hits, Hit{ID: id, From: from, To: to})
+	return nil
+}
+
+// returns the hits of a round in a read, by match start
+func (round *BarcodeRound) scan(record FASTQRecord) []Hit {
+	scan := &roundScan{qual: strings.TrimSpace(record.Qual)}
+	inputData := []byte(qualityMaskSeq(strings.TrimSpace(record.Seq), scan.qual) + "\n")
+	if err := round.matcher.Scan(inputData, roundEventHandler, scan); err != nil {
+		log.Fatal("ERROR: Unable to scan input buffer. Exiting.")
+	}
+	for i := range scan.hits {
+		scan.hits[i].Role = record.Role
+		scan.hits[i].Round = round.Number
+	}
+	sort.SliceStable(scan.hits, func(i, j int) bool { return scan.hits[i].From < scan.hits[j].From })
+	return scan.hits
+}
+
+// returns true if a hit is in the round's window, relative to the previous round's hit
+func (round *BarcodeRound) accepts(hit Hit, previous *Hit) bool {
+	offset := int(hit.From)
+	if round.FromPrevious && previous.Role == hit.Role {
+		offset -= int(previous.To)
+	}
+	return offset >= round.Min && offset <= round.Max
+}
+
+// returns the hits of the first complete chain of rounds in a read set, each
+// carrying the composite cell ID; nil if no chain is complete
+func chainRounds(records []FASTQRecord) []Hit {
+	recordsByRole := make(map[ReadRole]FASTQRecord)
+	for _, record := range records {
+		recordsByRole[record.Role] = record
+	}
+
+	roundHits := make([][]Hit, len(barcodeRounds))
+	for i, round := range barcodeRounds {
+		record, ok := recordsByRole[round.Role]
+		if !ok {
+			return nil
+		}
+		roundHits[i] = round.scan(record)
+		if len(roundHits[i]) == 0 {
+			return nil
+		}
+	}
+
+	return chainRoundHits(barcodeRounds, roundHits)
+}
+
+// returns the first complete chain of hits, one per round from the hits of
+// each round, each carrying the composite cell ID; nil if there is none
+func chainRoundHits(rounds []*BarcodeRound, roundHits [][]Hit) []Hit {
+	// => depth-first, taking the leftmost acceptable hit at each round
+	chain := make([]Hit, 0, len(rounds))
+	var extend func(i int) bool
+	extend = func(i int) bool {
+		if i == len(rounds) {
+			return true
+		}
+		var previous *Hit
+		if i > 0 {
+			previous = &chain[i-1]
+		}
+		for _, hit := range roundHits[i] {
+			if !rounds[i].accepts(hit, previous) {
+				continue
+			}
+			chain = append(chain, hit)
+			if extend(i + 1) {
+				return true
+			}
+			chain = chain[:i]
+		}
+		return false
+	}
+	if !extend(0) {
+		return nil
+	}
+
+	ids := make([]string, len(chain))
+	for i, hit := range chain {
+		ids[i] = fmt.Sprint(hit.ID)
+	}
+	cell := strings.Join(ids, "_")
+	for i := range chain {
+		chain[i].Cell = cell
+	}
+	return chain
+}
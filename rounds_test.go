@@ -0,0 +1,140 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// returns a round matching patterns from "<id>:<pattern>" lines
+func testRound(t *testing.T, number int, role ReadRole, fromPrevious bool, minOffset, maxOffset int, lines ...string) *BarcodeRound {
+	matcher, err := newGoMatcher(testPatterns(t, lines...))
+	if err != nil {
+		t.Fatalf("couldn't build round %d matcher: %s", number, err)
+	}
+	return &BarcodeRound{Number: number, Role: role, FromPrevious: fromPrevious, Min: minOffset, Max: maxOffset, matcher: matcher}
+}
+
+func TestReadRoundsFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rounds.txt")
+	text := "# round file role anchor min max\n1 r1.re R1 start 0 2\n\n2 r2.re R1 prev 2 4\n3 r3.re R2 prev 0 0\n"
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rounds := readRoundsFile(filename)
+	want := []*BarcodeRound{
+		{Number: 1, PatternFile: "r1.re", Role: RoleR1, Min: 0, Max: 2},
+		{Number: 2, PatternFile: "r2.re", Role: RoleR1, FromPrevious: true, Min: 2, Max: 4},
+		{Number: 3, PatternFile: "r3.re", Role: RoleR2, FromPrevious: true, Min: 0, Max: 0},
+	}
+	if !reflect.DeepEqual(rounds, want) {
+		t.Errorf("rounds = %+v, want %+v", rounds, want)
+	}
+
+	for _, bad := range []string{
+		"",
+		"1 r1.re R1 start 0\n",
+		"2 r1.re R1 start 0 2\n",
+		"1 r1.re R1 end 0 2\n",
+		"1 r1.re R1 prev 0 2\n",
+		"1 r1.re R1 start 2 0\n",
+	} {
+		if err := os.WriteFile(filename, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expectFatal(t, "rounds file "+bad, func() { readRoundsFile(filename) })
+	}
+}
+
+func TestChainRoundHits(t *testing.T) {
+	rounds := []*BarcodeRound{
+		{Number: 1, Role: RoleR1, Min: 0, Max: 2},
+		{Number: 2, Role: RoleR1, FromPrevious: true, Min: 2, Max: 2},
+		// => anchored to the read start, in another read than round 2
+		{Number: 3, Role: RoleR2, FromPrevious: true, Min: 0, Max: 0},
+	}
+	// => the leftmost round 1 hit has no round 2 hit in its window
+	roundHits := [][]Hit{
+		{{ID: 1, Role: RoleR1, Round: 1, From: 0, To: 4}, {ID: 2, Role: RoleR1, Round: 1, From: 1, To: 5}},
+		{{ID: 3, Role: RoleR1, Round: 2, From: 7, To: 11}, {ID: 4, Role: RoleR1, Round: 2, From: 11, To: 15}},
+		{{ID: 5, Role: RoleR2, Round: 3, From: 0, To: 4}},
+	}
+
+	chain := chainRoundHits(rounds, roundHits)
+	var ids []uint
+	for _, hit := range chain {
+		ids = append(ids, hit.ID)
+		if hit.Cell != "2_3_5" {
+			t.Errorf("round %d hit cell = %s, want 2_3_5", hit.Round, hit.Cell)
+		}
+	}
+	if !reflect.DeepEqual(ids, []uint{2, 3, 5}) {
+		t.Errorf("chain of IDs %v, want [2 3 5]", ids)
+	}
+	if roundHits[0][1].Cell != "" {
+		t.Errorf("round hits were changed chaining them")
+	}
+
+	// => a round hit outside its window breaks the chain
+	roundHits[2][0].From = 1
+	if chain := chainRoundHits(rounds, roundHits); chain != nil {
+		t.Errorf("chain with round 3 out of its window = %+v, want none", chain)
+	}
+}
+
+func TestChainRounds(t *testing.T) {
+	rounds := barcodeRounds
+	t.Cleanup(func() { barcodeRounds = rounds })
+	barcodeRounds = []*BarcodeRound{
+		testRound(t, 1, RoleR1, false, 0, 2, "1:/AAAA/L", "2:/CCCC/L"),
+		testRound(t, 2, RoleR1, true, 2, 2, "3:/GGGG/L", "4:/TTTT/L"),
+		// => anchored to the read start, in another read than round 2
+		testRound(t, 3, RoleR2, true, 0, 0, "5:/ACGT/L"),
+	}
+	records := func(r1, r2 string) []FASTQRecord {
+		return []FASTQRecord{{Seq: r1 + "\n", Role: RoleR1}, {Seq: r2 + "\n", Role: RoleR2}}
+	}
+
+	chain := chainRounds(records("GCCCCNNTTTTGGGG", "ACGTAAAA"))
+	var ids []uint
+	for _, hit := range chain {
+		ids = append(ids, hit.ID)
+		if hit.Cell != "2_4_5" {
+			t.Errorf("round %d hit cell = %s, want 2_4_5", hit.Round, hit.Cell)
+		}
+	}
+	if !reflect.DeepEqual(ids, []uint{2, 4, 5}) {
+		t.Errorf("chain of IDs %v, want [2 4 5]", ids)
+	}
+
+	// => a round hit outside its window, or a missing round, breaks the chain
+	for _, set := range [][]string{{"GCCCCNTTTTGGGG", "ACGTAAAA"}, {"GCCCCNNTTTT", "AACGT"}, {"NNNAAAANNGGGG", "ACGT"}} {
+		if chain := chainRounds(records(set[0], set[1])); chain != nil {
+			t.Errorf("chain of %v = %+v, want none", set, chain)
+		}
+	}
+}
+
+func TestCheckRoundPatterns(t *testing.T) {
+	dir := t.TempDir()
+	for name, text := range map[string]string{"starts.re": "0001:/AAAA/L\n0002:/CCCC/L\n", "ends.re": "0001:/GGGG/L\n0002:/TTTT/\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	round := func(number int, name string) *BarcodeRound {
+		return &BarcodeRound{Number: number, PatternFile: filepath.Join(dir, name)}
+	}
+
+	checkRoundPatterns([]*BarcodeRound{round(1, "starts.re")})
+	expectFatal(t, "a round pattern without the 'L' flag", func() {
+		checkRoundPatterns([]*BarcodeRound{round(1, "starts.re"), round(2, "ends.re")})
+	})
+}
@@ -0,0 +1,122 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * samples.go
+ *
+ * => optional sample sheet mapping pattern IDs to sample names
+ *
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SampleSheet = map of pattern ID to sample name
+type SampleSheet map[uint]string
+
+var (
+	// sampleSheet from the '-samples' flag; empty if none given
+	sampleSheet = make(SampleSheet)
+	// sampleNumbers = 1-based sample numbers by sample name, eg: for "S1" in file names
+	sampleNumbers = make(map[string]int)
+)
+
+// reads a sample sheet file; expecting "<pattern ID> <sample name>" per line,
+// blank lines and lines starting with '#' are skipped;
+// also returns distinct sample names in file order
+func readSampleSheet(filename string) (SampleSheet, []string) {
+	samples := make(SampleSheet)
+	var order []string
+	seen := make(map[string]bool)
+
+	file, err := os.Open(filename)
+	checkErr(err, fmt.Sprintf("Can't read sample sheet '%s'", filename))
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			log.Fatal(fmt.Sprintf("Expected pattern ID and sample name at sample sheet line %d", lineno))
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		checkErr(err, fmt.Sprintf("Could not parse id at sample sheet line %d, %s", lineno, err))
+
+		samples[uint(id)] = fields[1]
+		if !seen[fields[1]] {
+			seen[fields[1]] = true
+			order = append(order, fields[1])
+		}
+	}
+	checkErr(scanner.Err(), fmt.Sprintf("Can't read sample sheet '%s'", filename))
+
+	return samples, order
+}
+
+// numbers samples in sample sheet order, followed by the samples of any
+// remaining pattern IDs in pattern file order
+func assignSampleNumbers(order []string, ids []uint) {
+	for _, name := range order {
+		if _, ok := sampleNumbers[name]; !ok {
+			sampleNumbers[name] = len(sampleNumbers) + 1
+		}
+	}
+	for _, id := range ids {
+		name := sampleName(id)
+		if _, ok := sampleNumbers[name]; !ok {
+			sampleNumbers[name] = len(sampleNumbers) + 1
+		}
+	}
+}
+
+// returns the sample number of a sample name; unknown samples are numbered on first use
+func sampleNumber(name string) int {
+	if _, ok := sampleNumbers[name]; !ok {
+		sampleNumbers[name] = len(sampleNumbers) + 1
+	}
+	return sampleNumbers[name]
+}
+
+// returns the sample name for a pattern ID; the ID itself if not in the sample sheet
+func sampleName(id uint) string {
+	if name, ok := sampleSheet[id]; ok {
+		return name
+	}
+	return fmt.Sprint(id)
+}
+
+// returns sorted, distinct sample names for a set of pattern IDs
+func sampleNames(ids []uint) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, id := range ids {
+		name := sampleName(id)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,633 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * stats.go
+ *
+ * => end-of-run demultiplexing statistics, written as JSON and flat TSV
+ * => read sets are counted as assigned, undetermined or ambiguous, see assign.go
+ *
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// number of most frequent unmatched sequences to report, per read role
+const statsTopUnmatched = 20
+
+// number of distinct unmatched sequences tracked per read role; the least
+// frequent are pruned beyond it
+const statsMaxUnmatched = 100000
+
+// number of hits per read role the expected barcode position is taken from;
+// it's fixed after, so unmatched sequences are all counted at one position
+const statsWarmupHits = 1000
+
+// Hit = a single pattern match in a record of the current read set
+type Hit struct {
+	ID       uint
+	Role     ReadRole
+	From, To uint64
+	// sub-fields from the pattern ID's capture regex, if any
+	Captures      []Capture
+	CaptureFailed bool
+	// split-pool barcode round, and composite cell ID of the round chain; 0 / ""
+	// for pattern file hits, 0 / the corrected cell barcode for whitelist hits
+	Round int
+	Cell  string
+	// edits against the pattern's nominal sequence; nil if not verified
+	Edits *Edits
+	// match of the pattern's reverse complement, with '-both-strands'
+	Reverse bool
+	// matched bases and their qualities, as read; for streamed reads, which
+	// aren't kept, see hit.match
+	MatchSeq, MatchQual string
+}
+
+// matchWindow = [from,to) offsets of a match
+type matchWindow [2]uint64
+
+// IDStats = statistics for a single pattern ID
+type IDStats struct {
+	ReadSets int
+	Hits     int
+	// hits on the reverse strand
+	ReverseHits int
+	Offsets     map[uint64]int
+	qualSum     int
+	qualN       int
+	// hits with sub-fields captured, and hits the capture regex didn't match
+	Captured      int
+	CaptureFailed int
+	// matches rejected by the base quality filters
+	QualityRejected int
+	// verified hits by edit distance
+	Distances map[int]int
+}
+
+// MateStats = statistics for a single read role
+type MateStats struct {
+	Records int
+	Matched int
+	Hits    int
+	// match windows of the first hits, and the expected barcode position
+	// once fixed from them, see fixWindow
+	windows map[matchWindow]int
+	window  *matchWindow
+	// sequences at the expected barcode position in read sets without a match,
+	// and those of read sets before it's fixed; at most statsWarmupHits
+	unmatched map[string]int
+	pending   []string
+}
+
+// StatsCollector accumulates statistics over a run
+type StatsCollector struct {
+	ReadSets     int
+	Assigned     int
+	Undetermined int
+	Ambiguous    int
+	// read sets rejected by the whitelist, not counted by sample
+	Rejected int
+	// read sets dropped or binned by the minimum length filter; segments with '-split'
+	TooShort int
+	// read segments, by sample, and reads with segments of more than one sample
+	Segments       int
+	SegmentSamples map[string]int
+	Chimeras       int
+	// matches rejected by the base quality filters, not counted as hits
+	QualityRejected int
+	// read sets with unexpected characters reverse complementing, and those
+	// skipped for it by '-rc-policy'
+	RevCompInvalid, RevCompSkipped int
+	// read pairs with R1 and R2 swapped
+	MatesSwapped int
+	// whitelist lookups of read sets
+	WhitelistExact, WhitelistCorrected, WhitelistRejected int
+	Samples                                               map[string]int
+	IDs                                                   map[uint]*IDStats
+	Mates                                                 map[ReadRole]*MateStats
+	mateOrder                                             []ReadRole
+}
+
+var (
+	// runStats = statistics for the current run
+	runStats = newStatsCollector()
+	// readSetHits = hits in the read set currently being scanned
+	readSetHits []Hit
+)
+
+// returns an empty StatsCollector
+func newStatsCollector() *StatsCollector {
+	return &StatsCollector{
+		Samples:        make(map[string]int),
+		SegmentSamples: make(map[string]int),
+		IDs:            make(map[uint]*IDStats),
+		Mates:          make(map[ReadRole]*MateStats),
+	}
+}
+
+// returns the stats for a pattern ID, adding them if needed
+func (stats *StatsCollector) id(id uint) *IDStats {
+	idStats, ok := stats.IDs[id]
+	if !ok {
+		idStats = &IDStats{Offsets: make(map[uint64]int), Distances: make(map[int]int)}
+		stats.IDs[id] = idStats
+	}
+	return idStats
+}
+
+// returns the stats for a read role, adding them if needed
+func (stats *StatsCollector) mate(role ReadRole) *MateStats {
+	mateStats, ok := stats.Mates[role]
+	if !ok {
+		mateStats = &MateStats{windows: make(map[matchWindow]int), unmatched: make(map[string]int)}
+		stats.Mates[role] = mateStats
+		stats.mateOrder = append(stats.mateOrder, role)
+	}
+	return mateStats
+}
+
+// adds a scanned read set and its hits
+func (stats *StatsCollector) addReadSet(records []FASTQRecord, hits []Hit, rejected bool) {
+	stats.ReadSets++
+	if readSetRevCompInvalid > 0 {
+		stats.RevCompInvalid++
+		readSetRevCompInvalid = 0
+	}
+
+	recordsByRole := make(map[ReadRole]FASTQRecord)
+	for _, record := range records {
+		recordsByRole[record.Role] = record
+		stats.mate(record.Role).Records++
+	}
+
+	seenIDs := make(map[uint]bool)
+	matchedRoles := make(map[ReadRole]bool)
+	for _, hit := range hits {
+		// => not a match, see checkReadSet
+		if hit.whitelisted() {
+			continue
+		}
+		mateStats := stats.mate(hit.Role)
+		mateStats.Hits++
+		if mateStats.window == nil {
+			mateStats.windows[matchWindow{hit.From, hit.To}]++
+			if mateStats.Hits >= statsWarmupHits {
+				mateStats.fixWindow()
+			}
+		}
+		if !matchedRoles[hit.Role] {
+			matchedRoles[hit.Role] = true
+			mateStats.Matched++
+		}
+
+		// => round pattern IDs are only unique within a round
+		if hit.Round > 0 {
+			continue
+		}
+		idStats := stats.id(hit.ID)
+		idStats.Hits++
+		idStats.Offsets[hit.From]++
+		if hit.Reverse {
+			idStats.ReverseHits++
+		}
+		if hit.CaptureFailed {
+			idStats.CaptureFailed++
+		} else if hit.Captures != nil {
+			idStats.Captured++
+		}
+		if hit.Edits != nil {
+			idStats.Distances[hit.Edits.Distance()]++
+		}
+		_, qual := hit.match(recordsByRole[hit.Role])
+		for i := range qual {
+			idStats.qualSum += int(qual[i]) - 33
+			idStats.qualN++
+		}
+		if !seenIDs[hit.ID] {
+			seenIDs[hit.ID] = true
+			idStats.ReadSets++
+		}
+	}
+
+	if *flagSplit {
+		stats.addSegments(records, hits)
+	}
+
+	switch assignment, sample := readSetAssignment(hits, rejected); assignment {
+	case AssignUndetermined:
+		stats.Undetermined++
+		stats.addUnmatched(records)
+	case AssignSample:
+		stats.Assigned++
+		stats.Samples[sample]++
+	case AssignAmbiguous:
+		stats.Ambiguous++
+	case AssignRejected:
+		stats.Rejected++
+	}
+}
+
+// counts sequences at the expected barcode position of each read role; kept
+// until the position is fixed
+func (stats *StatsCollector) addUnmatched(records []FASTQRecord) {
+	for _, record := range records {
+		mateStats := stats.mate(record.Role)
+		if mateStats.window == nil {
+			if len(mateStats.pending) < statsWarmupHits {
+				mateStats.pending = append(mateStats.pending, record.Seq)
+			}
+			continue
+		}
+		mateStats.countUnmatched(record.Seq)
+	}
+}
+
+// counts the sequence at the expected barcode position of a read
+func (mateStats *MateStats) countUnmatched(seq string) {
+	window := *mateStats.window
+	if window[1] > uint64(len(seq)) {
+		return
+	}
+	mateStats.unmatched[seq[window[0]:window[1]]]++
+	if len(mateStats.unmatched) > statsMaxUnmatched {
+		mateStats.pruneUnmatched()
+	}
+}
+
+// fixes the expected barcode position of a read role from the match windows
+// so far, and counts the reads kept until then; no-op without matches
+func (mateStats *MateStats) fixWindow() {
+	window, ok := mateStats.expectedWindow()
+	if !ok {
+		return
+	}
+	mateStats.window = &window
+	for _, seq := range mateStats.pending {
+		mateStats.countUnmatched(seq)
+	}
+	mateStats.pending = nil
+}
+
+// returns the expected barcode position of a read role: the most frequent
+// match window, of the first hits once fixed
+func (mateStats *MateStats) expectedWindow() (matchWindow, bool) {
+	if mateStats.window != nil {
+		return *mateStats.window, true
+	}
+	var best matchWindow
+	bestCount := 0
+	for window, count := range mateStats.windows {
+		if count > bestCount || (count == bestCount && (window[0] < best[0] || (window[0] == best[0] && window[1] < best[1]))) {
+			best, bestCount = window, count
+		}
+	}
+	return best, bestCount > 0
+}
+
+// drops the least frequent unmatched sequences, keeping half of
+// statsMaxUnmatched, to bound memory use; dropped sequences seen again are
+// counted from 1
+func (mateStats *MateStats) pruneUnmatched() {
+	seqs := make([]string, 0, len(mateStats.unmatched))
+	for seq := range mateStats.unmatched {
+		seqs = append(seqs, seq)
+	}
+	// => ties are broken by sequence, so sequences seen as often as the
+	// least frequent one kept aren't all dropped
+	sort.Slice(seqs, func(i, j int) bool {
+		if count, other := mateStats.unmatched[seqs[i]], mateStats.unmatched[seqs[j]]; count != other {
+			return count > other
+		}
+		return seqs[i] < seqs[j]
+	})
+	for _, seq := range seqs[statsMaxUnmatched/2:] {
+		delete(mateStats.unmatched, seq)
+	}
+}
+
+// StatsCount = a named count with its percentage of all read sets
+type StatsCount struct {
+	Name    string  `json:"name"`
+	Count   int     `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// IDReport = report section for a single pattern ID
+type IDReport struct {
+	ID                 uint    `json:"id"`
+	Sample             string  `json:"sample"`
+	ReadSets           int     `json:"read_sets"`
+	Percent            float64 `json:"percent"`
+	Hits               int     `json:"hits"`
+	ReverseHits        int     `json:"reverse_hits"`
+	MeanBarcodeQuality float64 `json:"mean_barcode_quality"`
+	Captured           int     `json:"captured"`
+	CaptureFailed      int     `json:"capture_failed"`
+	QualityRejected    int     `json:"quality_rejected"`
+	// => hits by edit distance, for patterns with a nominal sequence
+	EditDistances map[int]int    `json:"edit_distances,omitempty"`
+	Offsets       map[uint64]int `json:"offsets"`
+}
+
+// MateReport = report section for a single read role
+type MateReport struct {
+	Role           ReadRole       `json:"role"`
+	Records        int            `json:"records"`
+	Matched        int            `json:"matched"`
+	Percent        float64        `json:"percent"`
+	Hits           int            `json:"hits"`
+	ExpectedWindow string         `json:"expected_window,omitempty"`
+	TopUnmatched   []StatsCount   `json:"top_unmatched"`
+	Lanes          map[string]int `json:"lanes"`
+}
+
+// StatsReport = end-of-run report
+type StatsReport struct {
+	ReadSets     int        `json:"read_sets"`
+	Assigned     StatsCount `json:"assigned"`
+	Undetermined StatsCount `json:"undetermined"`
+	Ambiguous    StatsCount `json:"ambiguous"`
+	Rejected     StatsCount `json:"rejected"`
+	TooShort     StatsCount `json:"too_short"`
+	// => matches, not read sets
+	QualityRejected int `json:"quality_rejected_matches"`
+	// => read sets with characters other than IUPAC codes reverse complementing
+	RevCompInvalid StatsCount `json:"revcomp_invalid"`
+	RevCompSkipped StatsCount `json:"revcomp_skipped"`
+	MatesSwapped   StatsCount `json:"mates_swapped"`
+	// => read segments and chimeric reads, with '-split'
+	Segments       int          `json:"segments,omitempty"`
+	Chimeras       StatsCount   `json:"chimeras"`
+	SegmentSamples []StatsCount `json:"segment_samples,omitempty"`
+	// => nil without a whitelist
+	Whitelist []StatsCount `json:"whitelist,omitempty"`
+	Samples   []StatsCount `json:"samples"`
+	// coefficient of variation of per-sample read set counts
+	BarcodeBalanceCV float64      `json:"barcode_balance_cv"`
+	IDs              []IDReport   `json:"ids"`
+	Mates            []MateReport `json:"mates"`
+}
+
+// returns count as a percentage of total
+func percent(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(count) / float64(total)
+}
+
+// returns the coefficient of variation (stddev / mean) of counts; 0 if mean is 0
+func coefficientOfVariation(counts []StatsCount) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, count := range counts {
+		sum += float64(count.Count)
+	}
+	mean := sum / float64(len(counts))
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, count := range counts {
+		variance += (float64(count.Count) - mean) * (float64(count.Count) - mean)
+	}
+	return math.Sqrt(variance/float64(len(counts))) / mean
+}
+
+// returns the end-of-run report; readSet provides per-lane record counts
+func (stats *StatsCollector) report(readSet ReadSet) StatsReport {
+	report := StatsReport{
+		ReadSets:     stats.ReadSets,
+		Assigned:     StatsCount{"assigned", stats.Assigned, percent(stats.Assigned, stats.ReadSets)},
+		Undetermined: StatsCount{"undetermined", stats.Undetermined, percent(stats.Undetermined, stats.ReadSets)},
+		Ambiguous:    StatsCount{"ambiguous", stats.Ambiguous, percent(stats.Ambiguous, stats.ReadSets)},
+		Rejected:     StatsCount{"rejected", stats.Rejected, percent(stats.Rejected, stats.ReadSets)},
+		TooShort:     StatsCount{"too_short", stats.TooShort, percent(stats.TooShort, stats.ReadSets)},
+
+		QualityRejected: stats.QualityRejected,
+		RevCompInvalid:  StatsCount{"revcomp_invalid", stats.RevCompInvalid, percent(stats.RevCompInvalid, stats.ReadSets)},
+		RevCompSkipped:  StatsCount{"revcomp_skipped", stats.RevCompSkipped, percent(stats.RevCompSkipped, stats.ReadSets)},
+		MatesSwapped:    StatsCount{"mates_swapped", stats.MatesSwapped, percent(stats.MatesSwapped, stats.ReadSets)},
+
+		Segments: stats.Segments,
+		Chimeras: StatsCount{"chimeras", stats.Chimeras, percent(stats.Chimeras, stats.ReadSets)},
+	}
+	for sample, count := range stats.SegmentSamples {
+		report.SegmentSamples = append(report.SegmentSamples, StatsCount{sample, count, percent(count, stats.Segments)})
+	}
+	sort.Slice(report.SegmentSamples, func(i, j int) bool { return report.SegmentSamples[i].Name < report.SegmentSamples[j].Name })
+
+	if whitelist != nil {
+		checked := stats.WhitelistExact + stats.WhitelistCorrected + stats.WhitelistRejected
+		report.Whitelist = []StatsCount{
+			{"exact", stats.WhitelistExact, percent(stats.WhitelistExact, checked)},
+			{"corrected", stats.WhitelistCorrected, percent(stats.WhitelistCorrected, checked)},
+			{"rejected", stats.WhitelistRejected, percent(stats.WhitelistRejected, checked)},
+		}
+	}
+
+	// => samples without any reads are listed too, they count towards barcode balance
+	samples := make(map[string]int)
+	for _, sample := range sampleNames(patternIDs) {
+		samples[sample] = 0
+	}
+	for sample, count := range stats.Samples {
+		samples[sample] = count
+	}
+	for sample, count := range samples {
+		report.Samples = append(report.Samples, StatsCount{sample, count, percent(count, stats.ReadSets)})
+	}
+	sort.Slice(report.Samples, func(i, j int) bool { return report.Samples[i].Name < report.Samples[j].Name })
+	report.BarcodeBalanceCV = coefficientOfVariation(report.Samples)
+
+	for id, idStats := range stats.IDs {
+		idReport := IDReport{
+			ID:       id,
+			Sample:   sampleName(id),
+			ReadSets: idStats.ReadSets,
+			Percent:  percent(idStats.ReadSets, stats.ReadSets),
+			Hits:     idStats.Hits,
+			Offsets:  idStats.Offsets,
+
+			ReverseHits: idStats.ReverseHits,
+
+			Captured:      idStats.Captured,
+			CaptureFailed: idStats.CaptureFailed,
+
+			QualityRejected: idStats.QualityRejected,
+		}
+		if len(idStats.Distances) > 0 {
+			idReport.EditDistances = idStats.Distances
+		}
+		if idStats.qualN > 0 {
+			idReport.MeanBarcodeQuality = float64(idStats.qualSum) / float64(idStats.qualN)
+		}
+		report.IDs = append(report.IDs, idReport)
+	}
+	sort.Slice(report.IDs, func(i, j int) bool { return report.IDs[i].ID < report.IDs[j].ID })
+
+	for _, role := range stats.mateOrder {
+		mateStats := stats.Mates[role]
+		// => runs with fewer hits than the warm-up
+		if mateStats.window == nil {
+			mateStats.fixWindow()
+		}
+		mateReport := MateReport{
+			Role:    role,
+			Records: mateStats.Records,
+			Matched: mateStats.Matched,
+			Percent: percent(mateStats.Matched, mateStats.Records),
+			Hits:    mateStats.Hits,
+			Lanes:   make(map[string]int),
+		}
+		if window, ok := mateStats.expectedWindow(); ok {
+			mateReport.ExpectedWindow = fmt.Sprintf("%d-%d", window[0], window[1])
+		}
+		for seq, count := range mateStats.unmatched {
+			mateReport.TopUnmatched = append(mateReport.TopUnmatched, StatsCount{seq, count, percent(count, stats.Undetermined)})
+		}
+		sort.Slice(mateReport.TopUnmatched, func(i, j int) bool {
+			a, b := mateReport.TopUnmatched[i], mateReport.TopUnmatched[j]
+			return a.Count > b.Count || (a.Count == b.Count && a.Name < b.Name)
+		})
+		if len(mateReport.TopUnmatched) > statsTopUnmatched {
+			mateReport.TopUnmatched = mateReport.TopUnmatched[:statsTopUnmatched]
+		}
+		for _, input := range readSet {
+			if input.Role != role {
+				continue
+			}
+			for _, file := range input.Files {
+				mateReport.Lanes[file.Lane] += file.Count
+			}
+		}
+		report.Mates = append(report.Mates, mateReport)
+	}
+
+	return report
+}
+
+// writes the report as JSON and TSV files named from prefix
+func writeStatsReport(report StatsReport, prefix string) {
+	jsonFile := createOutputFile(prefix + ".json")
+	defer jsonFile.Close()
+	encoder := json.NewEncoder(jsonFile)
+	encoder.SetIndent("", "  ")
+	checkErr(encoder.Encode(report), fmt.Sprintf("Couldn't write stats report '%s.json'!", prefix))
+
+	tsvFile := createOutputFile(prefix + ".tsv")
+	defer tsvFile.Close()
+	writer := bufio.NewWriter(tsvFile)
+	writeStatsTSV(writer, report)
+	checkErr(writer.Flush(), fmt.Sprintf("Couldn't write stats report '%s.tsv'!", prefix))
+
+	log.Info(fmt.Sprintf("Stats report: %s.json, %s.tsv", prefix, prefix))
+}
+
+// writes the report as flat "section / key / value / percent" rows
+func writeStatsTSV(writer *bufio.Writer, report StatsReport) {
+	// => pct < 0 leaves the percent column empty
+	row := func(section, key string, value interface{}, pct float64) {
+		if pct < 0 {
+			fmt.Fprintf(writer, "%s\t%s\t%v\t\n", section, key, value)
+			return
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%v\t%.2f\n", section, key, value, pct)
+	}
+
+	fmt.Fprintln(writer, "section\tkey\tvalue\tpercent")
+	row("total", "read_sets", report.ReadSets, percent(report.ReadSets, report.ReadSets))
+	for _, count := range []StatsCount{report.Assigned, report.Undetermined, report.Ambiguous, report.TooShort} {
+		row("total", count.Name, count.Count, count.Percent)
+	}
+	if whitelist != nil {
+		row("total", report.Rejected.Name, report.Rejected.Count, report.Rejected.Percent)
+	}
+	if matchQualityFiltered() {
+		row("total", "quality_rejected_matches", report.QualityRejected, -1)
+	}
+	row("total", report.RevCompInvalid.Name, report.RevCompInvalid.Count, report.RevCompInvalid.Percent)
+	if *flagRCPolicy == "skip" {
+		row("total", report.RevCompSkipped.Name, report.RevCompSkipped.Count, report.RevCompSkipped.Percent)
+	}
+	if *flagSwapMates {
+		row("total", report.MatesSwapped.Name, report.MatesSwapped.Count, report.MatesSwapped.Percent)
+	}
+	if *flagSplit {
+		row("total", "segments", report.Segments, -1)
+		row("total", report.Chimeras.Name, report.Chimeras.Count, report.Chimeras.Percent)
+		for _, sample := range report.SegmentSamples {
+			row("segment_sample", sample.Name, sample.Count, sample.Percent)
+		}
+	}
+	for _, sample := range report.Samples {
+		row("sample", sample.Name, sample.Count, sample.Percent)
+	}
+	row("sample_balance", "cv", fmt.Sprintf("%.4f", report.BarcodeBalanceCV), -1)
+	for _, count := range report.Whitelist {
+		row("whitelist", count.Name, count.Count, count.Percent)
+	}
+	for _, id := range report.IDs {
+		key := fmt.Sprint(id.ID)
+		row("id_read_sets", key, id.ReadSets, id.Percent)
+		row("id_hits", key, id.Hits, -1)
+		if *flagBothStrands {
+			row("id_reverse_hits", key, id.ReverseHits, percent(id.ReverseHits, id.Hits))
+		}
+		if _, ok := captureRegexes[id.ID]; ok {
+			row("id_captured", key, id.Captured, percent(id.Captured, id.Hits))
+			row("id_capture_failed", key, id.CaptureFailed, percent(id.CaptureFailed, id.Hits))
+		}
+		if matchQualityFiltered() {
+			row("id_quality_rejected", key, id.QualityRejected, -1)
+		}
+		row("id_mean_barcode_quality", key, fmt.Sprintf("%.2f", id.MeanBarcodeQuality), -1)
+		var distances []int
+		for distance := range id.EditDistances {
+			distances = append(distances, distance)
+		}
+		sort.Ints(distances)
+		for _, distance := range distances {
+			row("id_edit_distance", fmt.Sprintf("%s:%d", key, distance), id.EditDistances[distance], percent(id.EditDistances[distance], id.Hits))
+		}
+		var offsets []uint64
+		for offset := range id.Offsets {
+			offsets = append(offsets, offset)
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		for _, offset := range offsets {
+			row("id_offset", fmt.Sprintf("%s:%d", key, offset), id.Offsets[offset], percent(id.Offsets[offset], id.Hits))
+		}
+	}
+	for _, mate := range report.Mates {
+		role := string(mate.Role)
+		row("mate_records", role, mate.Records, -1)
+		row("mate_matched", role, mate.Matched, mate.Percent)
+		row("mate_hits", role, mate.Hits, -1)
+		var lanes []string
+		for lane := range mate.Lanes {
+			lanes = append(lanes, lane)
+		}
+		sort.Strings(lanes)
+		for _, lane := range lanes {
+			row("mate_lane_records", role+":"+lane, mate.Lanes[lane], percent(mate.Lanes[lane], mate.Records))
+		}
+		for _, unmatched := range mate.TopUnmatched {
+			row("mate_top_unmatched", role+":"+unmatched.Name, unmatched.Count, unmatched.Percent)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// returns a read set of a single R1 read
+func testRecords(seq string) []FASTQRecord {
+	qual := make([]byte, len(seq))
+	for i := range qual {
+		qual[i] = 'I'
+	}
+	return []FASTQRecord{{Name: "@read", Seq: seq, Qual: string(qual), Role: RoleR1}}
+}
+
+func TestExpectedWindowFixed(t *testing.T) {
+	stats := newStatsCollector()
+	read := "AAAACCCCGGGGTTTT"
+
+	// => read sets without a match before the window is fixed are kept
+	stats.addReadSet(testRecords("ACGTACGTACGTACGT"), nil, false)
+	for i := 0; i < statsWarmupHits; i++ {
+		stats.addReadSet(testRecords(read), []Hit{{ID: 1, Role: RoleR1, From: 4, To: 8}}, false)
+	}
+	// => later hits elsewhere don't move the window
+	for i := 0; i < 2*statsWarmupHits; i++ {
+		stats.addReadSet(testRecords(read), []Hit{{ID: 1, Role: RoleR1, From: 8, To: 12}}, false)
+	}
+	stats.addReadSet(testRecords("ACGTTTTTACGTACGT"), nil, false)
+
+	mateStats := stats.mate(RoleR1)
+	if window, ok := mateStats.expectedWindow(); !ok || window != (matchWindow{4, 8}) {
+		t.Errorf("expected window = %v, want [4 8]", window)
+	}
+	want := map[string]int{"ACGT": 1, "TTTT": 1}
+	if fmt.Sprint(mateStats.unmatched) != fmt.Sprint(want) {
+		t.Errorf("unmatched = %v, want %v", mateStats.unmatched, want)
+	}
+}
+
+func TestExpectedWindowFewHits(t *testing.T) {
+	stats := newStatsCollector()
+	stats.addReadSet(testRecords("ACGTACGTACGTACGT"), nil, false)
+	stats.addReadSet(testRecords("AAAACCCCGGGGTTTT"), []Hit{{ID: 1, Role: RoleR1, From: 0, To: 4}}, false)
+
+	// => fixed by the report, for runs shorter than the warm-up
+	report := stats.report(nil)
+	if mate := report.Mates[0]; mate.ExpectedWindow != "0-4" || len(mate.TopUnmatched) != 1 || mate.TopUnmatched[0].Name != "ACGT" {
+		t.Errorf("report = window %s, top unmatched %v, want 0-4, [ACGT]", mate.ExpectedWindow, mate.TopUnmatched)
+	}
+}
+
+func TestPruneUnmatched(t *testing.T) {
+	mateStats := &MateStats{unmatched: make(map[string]int), window: &matchWindow{0, 8}}
+	mateStats.unmatched["AAAAAAAA"] = 10
+
+	// => distinct sequences never seen twice
+	for i := 0; i < 3*statsMaxUnmatched; i++ {
+		mateStats.countUnmatched(fmt.Sprintf("%08d", i))
+		if len(mateStats.unmatched) > statsMaxUnmatched {
+			t.Fatalf("%d unmatched sequences tracked, want at most %d", len(mateStats.unmatched), statsMaxUnmatched)
+		}
+	}
+	if mateStats.unmatched["AAAAAAAA"] != 10 {
+		t.Errorf("frequent sequence count = %d, want 10", mateStats.unmatched["AAAAAAAA"])
+	}
+	// => half are kept when all counts tie
+	if len(mateStats.unmatched) < statsMaxUnmatched/2 {
+		t.Errorf("%d unmatched sequences tracked, want at least %d", len(mateStats.unmatched), statsMaxUnmatched/2)
+	}
+}
+
+func TestStatsMatchAtReadEnd(t *testing.T) {
+	stats := newStatsCollector()
+	// => a match running past the end of the read
+	stats.addReadSet(testRecords("GGAAA"), []Hit{{ID: 1, Role: RoleR1, From: 2, To: 6}}, false)
+	if idStats := stats.id(1); idStats.qualN != 3 {
+		t.Errorf("%d match qualities counted, want 3", idStats.qualN)
+	}
+}
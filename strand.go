@@ -0,0 +1,306 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * strand.go
+ *
+ * => both-strand scanning ('-both-strands'): each pattern is also compiled
+ *    reverse complemented, as a sibling ID that's mapped back to the
+ *    pattern's ID, and so its sample, when matched
+ * => with '-orient', reads matched on the reverse strand are written
+ *    reverse complemented, so the barcode reads 5'->3'
+ *
+ */
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reverseStrandID = set in the IDs of reverse complemented sibling patterns;
+// => pattern IDs must be below it
+const reverseStrandID uint = 1 << 30
+
+// IUPAC complements of upper case bases; other characters are their own
+// complement; => 'U' is left out so complementing character classes is one-to-one
+var iupacComplement = map[rune]rune{
+	'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A',
+	'R': 'Y', 'Y': 'R', 'K': 'M', 'M': 'K', 'S': 'S', 'W': 'W',
+	'B': 'V', 'V': 'B', 'D': 'H', 'H': 'D', 'N': 'N',
+}
+
+// returns the complement of an IUPAC base, keeping case
+func complementBase(r rune) rune {
+	if c, ok := iupacComplement[unicode.ToUpper(r)]; ok {
+		if unicode.IsLower(r) {
+			return unicode.ToLower(c)
+		}
+		return c
+	}
+	return r
+}
+
+// returns the pattern ID of a matcher ID, and true if it's a reverse strand sibling
+func strandID(id uint) (uint, bool) {
+	return id &^ reverseStrandID, id&reverseStrandID != 0
+}
+
+// returns the matcher ID of a hit: the sibling ID for the reverse strand
+func (hit Hit) matcherID() uint {
+	if hit.Reverse {
+		return hit.ID | reverseStrandID
+	}
+	return hit.ID
+}
+
+// returns the strand of a hit, "+" or "-"
+func (hit Hit) strand() string {
+	if hit.Reverse {
+		return "-"
+	}
+	return "+"
+}
+
+// returns true if the output of a read of role is reverse complemented, for
+// a hit: with '-r', or with '-orient' for reverse strand hits in the read
+func outputReversed(hit Hit, role ReadRole) bool {
+	return *flagRevComp || (*flagOrient && hit.Reverse && hit.Role == role)
+}
+
+// returns the patterns to scan for in a pattern file; with '-both-strands',
+// each pattern is followed by its reverse complement sibling
+func scanPatterns(filename string) []*Pattern {
+	patterns := parseFile(filename)
+	if !*flagBothStrands {
+		return patterns
+	}
+
+	var both []*Pattern
+	warned := false
+	for _, pattern := range patterns {
+		if pattern.ID >= reverseStrandID {
+			log.Fatal(fmt.Sprintf("Pattern ID %d is too large for both-strand scanning ('-both-strands'), must be below %d!", pattern.ID, reverseStrandID))
+		}
+		expression, err := reverseComplementExpression(pattern.Expression)
+		checkErr(err, fmt.Sprintf("Couldn't reverse complement pattern %d, %s", pattern.ID, err))
+
+		sibling := *pattern
+		sibling.ID |= reverseStrandID
+		sibling.Expression = expression
+		// => offsets on the reverse strand depend on the read length
+		if sibling.MinOffset > 0 || sibling.MaxOffset > 0 {
+			sibling.MinOffset, sibling.MaxOffset = 0, 0
+			if !warned {
+				log.Warn("Reverse strand patterns ('-both-strands') don't have min_offset / max_offset extensions!")
+				warned = true
+			}
+		}
+		both = append(both, pattern, &sibling)
+	}
+	return both
+}
+
+// returns the reverse complement of a regular expression, in Hyperscan
+// syntax: concatenations are reversed, bases complemented, and '^' and '$'
+// swapped; constructs that can't be reversed are an error
+func reverseComplementExpression(expression string) (string, error) {
+	parsed, err := syntax.Parse(expression, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := writeHyperscanSyntax(&b, reverseComplementRegexp(parsed)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// reverse complements a parsed expression in place, and returns it
+func reverseComplementRegexp(re *syntax.Regexp) *syntax.Regexp {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for i, j := 0, len(re.Rune)-1; i <= j; i, j = i+1, j-1 {
+			re.Rune[i], re.Rune[j] = complementBase(re.Rune[j]), complementBase(re.Rune[i])
+		}
+	case syntax.OpCharClass:
+		re.Rune = complementClass(re.Rune)
+	case syntax.OpConcat:
+		for i, j := 0, len(re.Sub)-1; i < j; i, j = i+1, j-1 {
+			re.Sub[i], re.Sub[j] = re.Sub[j], re.Sub[i]
+		}
+	// => '^' at the start of a read is '$' before its final newline
+	case syntax.OpBeginText:
+		re.Op = syntax.OpEndText
+		re.Flags |= syntax.WasDollar
+	case syntax.OpEndText:
+		re.Op = syntax.OpBeginText
+		re.Flags &^= syntax.WasDollar
+	}
+	for _, sub := range re.Sub {
+		reverseComplementRegexp(sub)
+	}
+	return re
+}
+
+// returns a character class, as [lo, hi] rune pairs, with letters complemented
+func complementClass(ranges []rune) []rune {
+	var pairs [][2]rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		// => characters other than letters are kept as ranges
+		for _, block := range [][2]rune{{0, 'A' - 1}, {'Z' + 1, 'a' - 1}, {'z' + 1, unicode.MaxRune}} {
+			if from, to := max(lo, block[0]), min(hi, block[1]); from <= to {
+				pairs = append(pairs, [2]rune{from, to})
+			}
+		}
+		for r := max(lo, 'A'); r <= min(hi, 'z'); r++ {
+			if unicode.IsLetter(r) {
+				c := complementBase(r)
+				pairs = append(pairs, [2]rune{c, c})
+			}
+		}
+	}
+
+	// => sorted and merged, as the parser makes them
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	var class []rune
+	for _, pair := range pairs {
+		if n := len(class); n > 0 && pair[0] <= class[n-1]+1 {
+			class[n-1] = max(class[n-1], pair[1])
+			continue
+		}
+		class = append(class, pair[0], pair[1])
+	}
+	return class
+}
+
+// writes a parsed expression in Hyperscan syntax, matching bytes: characters
+// other than letters and digits are escaped, case folded letters written as
+// classes, and classes limited to bytes; regexp.String() output, eg: '(?i:',
+// '(?-s:.)' and '\x{10FFFF}', isn't Hyperscan syntax
+func writeHyperscanSyntax(b *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r > unicode.MaxASCII {
+				return fmt.Errorf("non-ASCII character '%c' can't be reverse complemented", r)
+			}
+			if re.Flags&syntax.FoldCase != 0 && unicode.IsLetter(r) {
+				fmt.Fprintf(b, "[%c%c]", unicode.ToUpper(r), unicode.ToLower(r))
+				continue
+			}
+			writeHyperscanByte(b, byte(r))
+		}
+	case syntax.OpCharClass:
+		b.WriteByte('[')
+		written := false
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], min(re.Rune[i+1], 0xff)
+			if lo > hi {
+				continue
+			}
+			writeHyperscanByte(b, byte(lo))
+			if hi > lo {
+				b.WriteByte('-')
+				writeHyperscanByte(b, byte(hi))
+			}
+			written = true
+		}
+		if !written {
+			return fmt.Errorf("character class '%s' has no ASCII characters", re)
+		}
+		b.WriteByte(']')
+	case syntax.OpAnyCharNotNL:
+		b.WriteByte('.')
+	case syntax.OpAnyChar:
+		b.WriteString(`[\x00-\xff]`)
+	case syntax.OpBeginText:
+		b.WriteByte('^')
+	case syntax.OpEndText:
+		b.WriteByte('$')
+	case syntax.OpCapture:
+		return writeHyperscanGroup(b, re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		sub := re.Sub[0]
+		var err error
+		// => single characters and groups are repeated as they are
+		switch {
+		case sub.Op == syntax.OpLiteral && len(sub.Rune) == 1 && sub.Flags&syntax.FoldCase == 0,
+			sub.Op == syntax.OpCharClass, sub.Op == syntax.OpAnyCharNotNL, sub.Op == syntax.OpAnyChar, sub.Op == syntax.OpCapture:
+			err = writeHyperscanSyntax(b, sub)
+		default:
+			err = writeHyperscanGroup(b, sub)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case re.Op == syntax.OpStar:
+			b.WriteByte('*')
+		case re.Op == syntax.OpPlus:
+			b.WriteByte('+')
+		case re.Op == syntax.OpQuest:
+			b.WriteByte('?')
+		case re.Max == re.Min:
+			fmt.Fprintf(b, "{%d}", re.Min)
+		case re.Max < 0:
+			fmt.Fprintf(b, "{%d,}", re.Min)
+		default:
+			fmt.Fprintf(b, "{%d,%d}", re.Min, re.Max)
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			var err error
+			if sub.Op == syntax.OpAlternate {
+				err = writeHyperscanGroup(b, sub)
+			} else {
+				err = writeHyperscanSyntax(b, sub)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		for i, sub := range re.Sub {
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			if err := writeHyperscanSyntax(b, sub); err != nil {
+				return err
+			}
+		}
+	default:
+		// => eg: word boundaries, multi-line anchors
+		return fmt.Errorf("'%s' can't be reverse complemented", re)
+	}
+	return nil
+}
+
+// writes a parsed expression as a non-capturing group, in Hyperscan syntax
+func writeHyperscanGroup(b *strings.Builder, re *syntax.Regexp) error {
+	b.WriteString("(?:")
+	if err := writeHyperscanSyntax(b, re); err != nil {
+		return err
+	}
+	b.WriteByte(')')
+	return nil
+}
+
+// writes a byte, escaped unless a letter or digit
+func writeHyperscanByte(b *strings.Builder, c byte) {
+	if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+		b.WriteByte(c)
+		return
+	}
+	fmt.Fprintf(b, `\x%02x`, c)
+}
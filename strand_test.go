@@ -0,0 +1,113 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"regexp"
+	"testing"
+)
+
+// expressions for reverse complement round trips: literals, classes,
+// anchors, repeats and case folding
+var revCompTestExpressions = []string{
+	"ACGT",
+	"AACGN",
+	"^ACG",
+	"ACG$",
+	"^AC$",
+	"AC[GT]A",
+	"A[^C]T",
+	"[RY]CG[a-c]",
+	"A{2,3}C",
+	"(AC){2}G",
+	"(AC|GGT)T",
+	"GA+C?T*",
+	"(?i)acgT",
+	"(?i)a[cg]t",
+	"A.C",
+	"(?s)A.C",
+}
+
+// returns a random read of bases, some lower case, some 'N'
+func revCompTestRead(rng *rand.Rand) string {
+	read := make([]byte, 4+rng.Intn(12))
+	for i := range read {
+		read[i] = "ACGTACGTACGTNacgt"[rng.Intn(17)]
+	}
+	return string(read)
+}
+
+func TestReverseComplementExpression(t *testing.T) {
+	tests := []struct {
+		expression, want string
+	}{
+		{"ACGT", "ACGT"},
+		{"AACG", "CGTT"},
+		{"^ACG", "CGT$"},
+		{"ACG$", "^CGT"},
+		{"AC[GT]", "[AC]GT"},
+		{"A[^C]T", `A[\x00-FH-\xff]T`},
+		{"[RY]CG", "CG[RY]"},
+		{"A{2,3}C", "GT{2,3}"},
+		{"(AC){2}G", "C(?:GT){2}"},
+		{"(AC|GGT)T", "A(?:GT|ACC)"},
+		{"GA+C?", "G?T+C"},
+		{"(?i)acg", "[Cc][Gg][Tt]"},
+		{"A.C", "G.T"},
+		{"(?s)A.C", `G[\x00-\xff]T`},
+		{"A-C", `G\x2dT`},
+	}
+	for _, test := range tests {
+		got, err := reverseComplementExpression(test.expression)
+		if err != nil || got != test.want {
+			t.Errorf("reverseComplementExpression(%s) = %q, %v, want %q", test.expression, got, err, test.want)
+		}
+	}
+
+	// => constructs that can't be reversed
+	for _, expression := range []string{`\bACGT`, `(?m)^ACGT`, "ACGTé", `A\x{100}C`} {
+		if got, err := reverseComplementExpression(expression); err == nil {
+			t.Errorf("reverseComplementExpression(%s) = %q, want an error", expression, got)
+		}
+	}
+}
+
+// => an expression matches a read if and only if its reverse complement
+// matches the read's reverse complement; with Go regexps, and the pure-Go engine
+func TestReverseComplementExpressionRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	for _, expression := range revCompTestExpressions {
+		reversed, err := reverseComplementExpression(expression)
+		if err != nil {
+			t.Fatalf("reverseComplementExpression(%s): %s", expression, err)
+		}
+		forward, backward := regexp.MustCompile(expression), regexp.MustCompile(reversed)
+		matcher, err := newGoMatcher(testPatterns(t, "1:/"+expression+"/", "2:/"+reversed+"/"))
+		if err != nil {
+			t.Fatalf("couldn't build pure-Go matcher for %s / %s: %s", expression, reversed, err)
+		}
+
+		for i := 0; i < 500; i++ {
+			read := revCompTestRead(rng)
+			rc := reverseComplementSeq(read)
+			if forward.MatchString(read) != backward.MatchString(rc) {
+				t.Fatalf("%s on %s = %t, %s on %s = %t", expression, read, forward.MatchString(read), reversed, rc, backward.MatchString(rc))
+			}
+			matched := func(id uint, data string) bool {
+				for _, match := range scanAll(t, matcher, []byte(data+"\n")) {
+					if match.ID == id {
+						return true
+					}
+				}
+				return false
+			}
+			if matched(1, read) != matched(2, rc) {
+				t.Fatalf("pure-Go: %s on %s = %t, %s on %s = %t", expression, read, matched(1, read), reversed, rc, matched(2, rc))
+			}
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * stream.go
+ *
+ * => with '-stream', FASTQ reads are scanned as they're read, in chunks of at
+ *    most '-stream' bases, so long reads and live basecaller output are
+ *    scanned in bounded memory: reads aren't kept, only their last bases, as
+ *    many as the longest match of the patterns, to take matches from
+ * => match qualities are taken as the quality line is read; hits are then
+ *    quality filtered, captured and verified, as when scanning whole reads
+ * => hits are reported by the hit table ('-hits'), the hit index ('-index')
+ *    and stats; with read output ('-q', '-bam', '-sam'), reads are spooled as
+ *    they're scanned and written once their read set is assigned, so memory
+ *    is then bounded by the longest read set instead
+ *
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// streamMatchWidth = the longest match of the patterns, set by checkStreamFlags
+var streamMatchWidth int
+
+// streamSpool = whether streamed reads are kept to be written, set by
+// checkStreamFlags
+var streamSpool bool
+
+// StreamScan = a read being scanned as it's read
+type StreamScan struct {
+	// the last bases of the read scanned, from offset on; as many as the
+	// longest match, and the chunk being scanned
+	window []byte
+	offset uint64
+	width  int
+	hits   []StreamHit
+}
+
+// StreamHit = a match in a streamed read, with its bases as read; resolved
+// into a hit once its qualities are read
+type StreamHit struct {
+	ID        uint
+	From, To  uint64
+	Seq, Qual string
+}
+
+// checks '-stream' against other flags and the patterns, and sets the
+// longest match of the patterns; match start offsets are needed to take
+// matches from the window
+func checkStreamFlags(patternFile string) {
+	switch {
+	case emitCommand:
+		log.Fatal("Streaming ('-stream') can't replay a hit index with 'emit'!")
+	case len(*flagUBAMFile) > 0:
+		log.Fatal("Streaming ('-stream') requires FASTQ input, not uBAM ('-ubam')!")
+	case *flagRounds != "":
+		log.Fatal("Streaming ('-stream') can't be used with split-pool barcode rounds ('-rounds')!")
+	case *flagReadStructure != "":
+		log.Fatal("Streaming ('-stream') can't be used with read structures ('-rs')!")
+	case *flagWhitelist != "":
+		log.Fatal("Streaming ('-stream') can't be used with a cell barcode whitelist ('-whitelist')!")
+	case *flagQualMask > 0:
+		log.Fatal("Streaming ('-stream') can't mask bases by quality ('-qmask'), qualities are read after the sequence!")
+	}
+
+	for _, pattern := range scanPatterns(patternFile) {
+		if !pattern.hasFlag('L') {
+			log.Fatal(fmt.Sprintf("Streaming ('-stream') needs match start offsets; pattern ID %d doesn't have the 'L' flag!", pattern.ID&^reverseStrandID))
+		}
+		width, err := patternMaxWidth(pattern)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Streaming ('-stream') needs patterns of bounded length; pattern ID %d %s!", pattern.ID&^reverseStrandID, err))
+		}
+		streamMatchWidth = max(streamMatchWidth, width)
+	}
+	streamSpool = *flagFASTQOut || *flagBAMOut || *flagSAMOut
+}
+
+// returns the longest match of a pattern, with insertions for its edit distance
+func patternMaxWidth(pattern *Pattern) (int, error) {
+	parsed, err := syntax.Parse(pattern.Expression, syntax.Perl)
+	if err != nil {
+		return 0, err
+	}
+	width := regexpMaxWidth(parsed)
+	if width < 0 {
+		return 0, fmt.Errorf("has no maximum length")
+	}
+	return width + int(pattern.EditDistance), nil
+}
+
+// returns the longest match of a parsed expression, in bytes; -1 if unbounded
+func regexpMaxWidth(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return len(string(re.Rune))
+	case syntax.OpCharClass:
+		return utf8.RuneLen(re.Rune[len(re.Rune)-1])
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return utf8.UTFMax
+	case syntax.OpCapture, syntax.OpQuest:
+		return regexpMaxWidth(re.Sub[0])
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpRepeat:
+		sub := regexpMaxWidth(re.Sub[0])
+		if re.Max < 0 || sub < 0 {
+			return -1
+		}
+		return re.Max * sub
+	case syntax.OpConcat:
+		width := 0
+		for _, sub := range re.Sub {
+			w := regexpMaxWidth(sub)
+			if w < 0 {
+				return -1
+			}
+			width += w
+		}
+		return width
+	case syntax.OpAlternate:
+		width := 0
+		for _, sub := range re.Sub {
+			w := regexpMaxWidth(sub)
+			if w < 0 {
+				return -1
+			}
+			width = max(width, w)
+		}
+		return width
+	}
+	// => empty matches and assertions
+	return 0
+}
+
+// collects matches for a stream scan, taking their bases from the window
+func (scan *StreamScan) handle(id uint, from, to uint64, flags uint, context interface{}) error {
+	// => can't happen for patterns of bounded length, see checkStreamFlags
+	if from < scan.offset || to > scan.offset+uint64(len(scan.window)) {
+		log.Fatal(fmt.Sprintf("Match %d-%d of pattern ID %d is longer than the longest match of the patterns, %d!", from, to, id&^reverseStrandID, scan.width))
+	}
+	scan.hits = append(scan.hits, StreamHit{ID: id, From: from, To: to, Seq: string(scan.window[from-scan.offset : to-scan.offset])})
+	return nil
+}
+
+// scans the next chunk of a read; the window drops bases no match can start at
+func (scan *StreamScan) scanChunk(stream MatchStream, chunk []byte) {
+	if drop := len(scan.window) - scan.width; drop > 0 {
+		scan.window = scan.window[:copy(scan.window, scan.window[drop:])]
+		scan.offset += uint64(drop)
+	}
+	scan.window = append(scan.window, chunk...)
+	if err := stream.Scan(chunk); err != nil {
+		log.Fatal(fmt.Sprintf("ERROR: Unable to scan input stream, %s. Exiting.", err))
+	}
+}
+
+// adds qualities read from offset on to the matches they cover
+func (scan *StreamScan) addQuals(qual []byte, offset uint64) {
+	end := offset + uint64(len(qual))
+	for i := range scan.hits {
+		hit := &scan.hits[i]
+		if from, to := max(hit.From, offset), min(hit.To, end); from < to {
+			hit.Qual += string(qual[from-offset : to-offset])
+		}
+	}
+}
+
+// reads the rest of a line, passing it to fn in pieces of at most n bytes,
+// without the line end; returns the line length, and false at the end of the
+// input
+func readLinePieces(reader *bufio.Reader, n int, fn func(piece []byte)) (int, bool) {
+	length := 0
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			log.Fatal(fmt.Sprintf("ERROR: Unable to read input, %s. Exiting.", err))
+		}
+		if err == nil {
+			line = line[:len(line)-1]
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+		}
+		for len(line) > 0 {
+			piece := line[:min(n, len(line))]
+			fn(piece)
+			length += len(piece)
+			line = line[len(piece):]
+		}
+		if err != bufio.ErrBufferFull {
+			return length, err != io.EOF
+		}
+	}
+}
+
+// reads the next FASTQ record from reader, scanning its sequence with matcher
+// as it's read; hits are added to the read set's hits, and the record has
+// no sequence or qualities unless spool is set. done is true at the end of
+// the input
+func scanStreamRecord(reader *bufio.Reader, matcher StreamMatcher, record FASTQRecord, spool bool) (FASTQRecord, bool) {
+	// => header line, skipping blank lines
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(fmt.Sprintf("ERROR: Unable to read input, %s. Exiting.", err))
+		}
+		line = trimLineEnd(line)
+		if line == "" {
+			if err == io.EOF {
+				return FASTQRecord{}, true
+			}
+			continue
+		}
+		if line[0] != '@' {
+			log.Fatal(fmt.Sprintf("Expected a FASTQ record, got '%s'!", line))
+		}
+		record.Name = line
+		break
+	}
+
+	scan := &StreamScan{width: streamMatchWidth}
+	stream, err := matcher.Open(scan.handle, nil)
+	checkErr(err, fmt.Sprintf("ERROR: Unable to open stream, %s. Exiting.", err))
+	var seq, qual strings.Builder
+	length, ok := readLinePieces(reader, *flagStreamChunk, func(chunk []byte) {
+		scan.scanChunk(stream, chunk)
+		if spool {
+			seq.Write(chunk)
+		}
+	})
+	// => matches are reported as if the read was a line terminated with "\n"
+	scan.scanChunk(stream, []byte{'\n'})
+	if err := stream.Close(); err != nil {
+		log.Fatal(fmt.Sprintf("ERROR: Unable to close stream, %s. Exiting.", err))
+	}
+
+	// => separator and quality lines
+	if ok {
+		_, ok = readLinePieces(reader, math.MaxInt, func([]byte) {})
+	}
+	var qualLength int
+	if ok {
+		var offset uint64
+		qualLength, _ = readLinePieces(reader, math.MaxInt, func(piece []byte) {
+			scan.addQuals(piece, offset)
+			offset += uint64(len(piece))
+			if spool {
+				qual.Write(piece)
+			}
+		})
+	}
+	if qualLength != length {
+		log.Fatal(fmt.Sprintf("FASTQ record '%s' has %d bases and %d qualities!", record.Name, length, qualLength))
+	}
+
+	for _, hit := range scan.hits {
+		addHit(hit.ID, record.Role, hit.From, hit.To, hit.Seq, hit.Qual)
+	}
+	// => spooled records are line terminated, as records read whole
+	if spool {
+		record.Seq, record.Qual = seq.String()+"\n", qual.String()+"\n"
+	}
+	return record, false
+}
+
+// returns a line without its line end
+func trimLineEnd(line string) string {
+	for len(line) > 0 && (line[len(line)-1] == '\n' || line[len(line)-1] == '\r') {
+		line = line[:len(line)-1]
+	}
+	return line
+}
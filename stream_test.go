@@ -0,0 +1,213 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStreamMatcher = a StreamMatcher for literal patterns; streams only keep
+// the last bases scanned, so matches across chunks are found as by Hyperscan
+type testStreamMatcher struct {
+	ids      []uint
+	literals []string
+}
+
+// testMatchStream = an open stream of a testStreamMatcher
+type testMatchStream struct {
+	matcher *testStreamMatcher
+	handler MatchHandler
+	tail    []byte
+	end     uint64
+}
+
+func (matcher *testStreamMatcher) Open(handler MatchHandler, context interface{}) (MatchStream, error) {
+	return &testMatchStream{matcher: matcher, handler: handler}, nil
+}
+
+func (matcher *testStreamMatcher) Scan(data []byte, handler MatchHandler, context interface{}) error {
+	stream, _ := matcher.Open(handler, context)
+	if err := stream.Scan(data); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+func (matcher *testStreamMatcher) Clone() (Matcher, error) { return matcher, nil }
+
+func (matcher *testStreamMatcher) Close() {}
+
+func (stream *testMatchStream) Scan(chunk []byte) error {
+	for _, b := range chunk {
+		stream.tail = append(stream.tail, b)
+		stream.end++
+		for i, literal := range stream.matcher.literals {
+			if bytes.HasSuffix(stream.tail, []byte(literal)) {
+				if err := stream.handler(stream.matcher.ids[i], stream.end-uint64(len(literal)), stream.end, 0, nil); err != nil {
+					return err
+				}
+			}
+		}
+		if len(stream.tail) > 64 {
+			stream.tail = stream.tail[len(stream.tail)-64:]
+		}
+	}
+	return nil
+}
+
+func (stream *testMatchStream) Close() error { return nil }
+
+// sets the stream chunk size and longest match for a test
+func withStreaming(t *testing.T, chunk, width int) {
+	oldChunk, oldWidth := *flagStreamChunk, streamMatchWidth
+	*flagStreamChunk, streamMatchWidth = chunk, width
+	t.Cleanup(func() { *flagStreamChunk, streamMatchWidth = oldChunk, oldWidth })
+}
+
+func TestScanStreamRecord(t *testing.T) {
+	withStreaming(t, 4, 6)
+	matcher := &testStreamMatcher{ids: []uint{1, 2}, literals: []string{"ACGTAC", "TTT"}}
+	// => "ACGTAC" spans the chunks "GGGA" "CGTA" "CGGG", and the bufio buffer
+	input := "@read1 1:N:0\nGGGACGTACGGG\n+\n!!!#$%&'(!!!\n" +
+		"\n@read2\nTTTT\n+read2\nIIII\n"
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	readSetHits = readSetHits[:0]
+	record, done := scanStreamRecord(reader, matcher, FASTQRecord{Role: RoleR1}, false)
+	if done || record.Name != "@read1 1:N:0" || record.Seq != "" || record.Qual != "" {
+		t.Fatalf("first record = %+v, done %t", record, done)
+	}
+	want := []Hit{{ID: 1, Role: RoleR1, From: 3, To: 9, MatchSeq: "ACGTAC", MatchQual: "#$%&'("}}
+	if !reflect.DeepEqual(readSetHits, want) {
+		t.Errorf("first record hits = %+v, want %+v", readSetHits, want)
+	}
+
+	readSetHits = readSetHits[:0]
+	record, done = scanStreamRecord(reader, matcher, FASTQRecord{Role: RoleR1}, false)
+	if done || record.Name != "@read2" {
+		t.Fatalf("second record = %+v, done %t", record, done)
+	}
+	want = []Hit{
+		{ID: 2, Role: RoleR1, From: 0, To: 3, MatchSeq: "TTT", MatchQual: "III"},
+		{ID: 2, Role: RoleR1, From: 1, To: 4, MatchSeq: "TTT", MatchQual: "III"},
+	}
+	if !reflect.DeepEqual(readSetHits, want) {
+		t.Errorf("second record hits = %+v, want %+v", readSetHits, want)
+	}
+
+	if _, done = scanStreamRecord(reader, matcher, FASTQRecord{Role: RoleR1}, false); !done {
+		t.Errorf("no end of input after the last record")
+	}
+}
+
+func TestScanStreamRecordSpool(t *testing.T) {
+	withStreaming(t, 4, 6)
+	matcher := &testStreamMatcher{ids: []uint{1}, literals: []string{"ACGTAC"}}
+	input := "@read1\nGGGACGTACGGG\n+\n!!!#$%&'(!!!\n"
+	readSetHits = readSetHits[:0]
+	record, _ := scanStreamRecord(bufio.NewReaderSize(strings.NewReader(input), 16), matcher, FASTQRecord{Role: RoleR1}, true)
+	if record.Seq != "GGGACGTACGGG\n" || record.Qual != "!!!#$%&'(!!!\n" {
+		t.Fatalf("spooled record = %q %q", record.Seq, record.Qual)
+	}
+
+	// => spooled records are written as records read whole
+	output := hitOutput(readSetHits[0], record, fullWindow).Record
+	if output.Seq != "GGGACGTACGGG" || output.MatchSeq != "ACGTAC" || output.MatchQual != "#$%&'(" {
+		t.Errorf("output = %s, match %s %s, want GGGACGTACGGG, match ACGTAC #$%%&'(", output.Seq, output.MatchSeq, output.MatchQual)
+	}
+}
+
+func TestScanStreamRecordQualityFilter(t *testing.T) {
+	withStreaming(t, 4, 6)
+	minQual := *flagMatchMinQual
+	*flagMatchMinQual = 20
+	t.Cleanup(func() { *flagMatchMinQual = minQual })
+
+	matcher := &testStreamMatcher{ids: []uint{1}, literals: []string{"ACGTAC"}}
+	input := "@read1\nACGTACACGTAC\n+\nIIII#IIIIIII\n"
+	readSetHits = readSetHits[:0]
+	scanStreamRecord(bufio.NewReader(strings.NewReader(input)), matcher, FASTQRecord{Role: RoleR1}, false)
+	if len(readSetHits) != 1 || readSetHits[0].From != 6 {
+		t.Errorf("hits = %+v, want the second match only", readSetHits)
+	}
+}
+
+func TestStreamScanWindow(t *testing.T) {
+	matcher := &testStreamMatcher{ids: []uint{1}, literals: []string{"ACGTAC"}}
+	scan := &StreamScan{width: 6}
+	stream, _ := matcher.Open(scan.handle, nil)
+
+	// => a long read, with a match across each chunk boundary
+	read := strings.Repeat("GGACGTACGG", 1000)
+	for from := 0; from < len(read); from += 7 {
+		scan.scanChunk(stream, []byte(read[from:min(from+7, len(read))]))
+		if len(scan.window) > 6+7 {
+			t.Fatalf("window of %d bases at %d, want at most 13", len(scan.window), from)
+		}
+	}
+	if len(scan.hits) != 1000 {
+		t.Fatalf("got %d matches, want 1000", len(scan.hits))
+	}
+	for i, hit := range scan.hits {
+		if hit.From != uint64(10*i+2) || hit.Seq != "ACGTAC" {
+			t.Fatalf("match %d = %+v, want 'ACGTAC' at %d", i, hit, 10*i+2)
+		}
+	}
+}
+
+func TestReadLinePieces(t *testing.T) {
+	line := strings.Repeat("ACGT", 25)
+	reader := bufio.NewReaderSize(strings.NewReader(line+"\r\nnext\n"), 16)
+
+	var pieces []string
+	length, ok := readLinePieces(reader, 10, func(piece []byte) {
+		if len(piece) > 10 {
+			t.Errorf("piece of %d bytes, want at most 10", len(piece))
+		}
+		pieces = append(pieces, string(piece))
+	})
+	if got := strings.Join(pieces, ""); !ok || length != len(line) || got != line {
+		t.Errorf("read %q (%d), %t, want %q", got, length, ok, line)
+	}
+	if next, _ := reader.ReadString('\n'); next != "next\n" {
+		t.Errorf("next line = %q, want \"next\\n\"", next)
+	}
+}
+
+func TestPatternMaxWidth(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{"/ACGTACGT/L", 8},
+		{"/AC[GT]{2,4}T/L", 7},
+		{"/(ACGT|TTA)?GG/L", 6},
+		{"/^ACGT$/L", 4},
+		{"/ACGTACGT/L{edit_distance=2}", 10},
+		{"/ACGT.*TT/L", -1},
+		{"/ACGT{3,}/L", -1},
+	}
+	for _, test := range tests {
+		pattern, err := parsePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("couldn't parse pattern '%s': %s", test.pattern, err)
+		}
+		width, err := patternMaxWidth(pattern)
+		if test.want < 0 {
+			if err == nil {
+				t.Errorf("patternMaxWidth(%s) = %d, want unbounded", test.pattern, width)
+			}
+			continue
+		}
+		if err != nil || width != test.want {
+			t.Errorf("patternMaxWidth(%s) = %d, %v, want %d", test.pattern, width, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * swap.go
+ *
+ * => mate swapping ('-swap-mates'), for libraries where the barcoded end
+ *    lands in R1 or R2 at random: read pairs assigned by a hit in R2 have
+ *    their R1 and R2 outputs swapped, so the barcoded mate is written as R1
+ * => decided per read pair, once all its reads are scanned; both mates of
+ *    every assigned pair are written, so R1 and R2 outputs stay in step
+ * => swapped records have the read number of Illumina comments set for the
+ *    role they're written as, and are marked 'swapped' in FASTQ headers and
+ *    with an 'XW:i:1' tag in BAM/SAM
+ *
+ */
+
+import (
+	"strings"
+)
+
+// FASTQ header comment marker of swapped records
+const swappedMarker = "swapped"
+
+// returns true if the mates of an assigned read pair are to be swapped:
+// assigned by a hit in R2
+func swapMates(hits []Hit) bool {
+	winner := winningHit(hits)
+	return winner >= 0 && hits[winner].Role == RoleR2
+}
+
+// returns the outputs for the mates of an assigned read pair that don't have
+// one, so both mates are written; for the hit the pair is assigned by,
+// without trimming around it
+func pairPartners(hits []Hit, records []FASTQRecord, outputs []HitOutput, keeps map[ReadRole]KeepWindow) []HitOutput {
+	written := make(map[ReadRole]bool)
+	for _, output := range outputs {
+		written[output.Record.Role] = true
+	}
+	hit := hits[winningHit(hits)]
+	var source FASTQRecord
+	for _, record := range records {
+		if record.Role == hit.Role {
+			source = record
+		}
+	}
+
+	var partners []HitOutput
+	for _, record := range records {
+		if (record.Role != RoleR1 && record.Role != RoleR2) || written[record.Role] {
+			continue
+		}
+		keep, ok := keeps[record.Role]
+		if !ok {
+			keep = fullWindow
+		}
+		partners = append(partners, mateOutput(hit, source, record, keep))
+	}
+	return partners
+}
+
+// swaps the R1 and R2 roles of the outputs of a read set, along with the
+// input file basenames output files are named from, and the read numbers
+// of their headers
+func swapOutputRoles(outputs []HitOutput, records []FASTQRecord) {
+	basenames := make(map[ReadRole]string)
+	for _, record := range records {
+		basenames[record.Role] = record.InputFileBasename
+	}
+	for i := range outputs {
+		record := &outputs[i].Record
+		switch record.Role {
+		case RoleR1:
+			record.Role = RoleR2
+		case RoleR2:
+			record.Role = RoleR1
+		default:
+			continue
+		}
+		record.InputFileBasename = basenames[record.Role]
+		record.Name = setReadNumber(record.Name, record.Role)
+		record.Swapped = true
+	}
+}
+
+// returns a FASTQ header line with the read number of its Illumina comment
+// set for role, eg: "@read1 2:N:0:ACGT" as R1 = "@read1 1:N:0:ACGT"; other
+// headers are returned as-is
+func setReadNumber(name string, role ReadRole) string {
+	i := strings.IndexAny(name, " \t")
+	if i < 0 || !reIlluminaComment.MatchString(name[i+1:]) {
+		return name
+	}
+	number := "1"
+	if role == RoleR2 {
+		number = "2"
+	}
+	return name[:i+1] + number + name[i+2:]
+}
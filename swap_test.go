@@ -0,0 +1,112 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// returns the header and sequence lines of a gzipped FASTQ file
+func readFASTQLines(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("couldn't open %s: %s", filename, err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("couldn't read %s: %s", filename, err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for i := 0; scanner.Scan(); i++ {
+		if i%4 < 2 {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	return lines
+}
+
+func TestSwapMates(t *testing.T) {
+	tests := []struct {
+		hits []Hit
+		want bool
+	}{
+		{[]Hit{{ID: 1, Role: RoleR1, From: 0, To: 4}}, false},
+		{[]Hit{{ID: 1, Role: RoleR2, From: 0, To: 4}}, true},
+		{[]Hit{{ID: 1, Role: RoleR1, From: 0, To: 4}, {ID: 2, Role: RoleR2, From: 0, To: 4}}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := swapMates(test.hits); got != test.want {
+			t.Errorf("swapMates(%+v) = %t, want %t", test.hits, got, test.want)
+		}
+	}
+}
+
+func TestSetReadNumber(t *testing.T) {
+	tests := []struct {
+		name string
+		role ReadRole
+		want string
+	}{
+		{"@read1 2:N:0:ACGT", RoleR1, "@read1 1:N:0:ACGT"},
+		{"@read1 1:Y:18:ACGT+TTGA", RoleR2, "@read1 2:Y:18:ACGT+TTGA"},
+		{"@read1\t1:N:0:1", RoleR2, "@read1\t2:N:0:1"},
+		{"@read1 2:N:0:ACGT", RoleR2, "@read1 2:N:0:ACGT"},
+		{"@read1/2", RoleR1, "@read1/2"},
+		{"@read1 2 x", RoleR1, "@read1 2 x"},
+	}
+	for _, test := range tests {
+		if got := setReadNumber(test.name, test.role); got != test.want {
+			t.Errorf("setReadNumber(%q, %s) = %q, want %q", test.name, test.role, got, test.want)
+		}
+	}
+}
+
+// => pairs with the barcode in R1 and R2, written through emitReadSet
+func TestEmitSwappedPairs(t *testing.T) {
+	outDir, fastqOut, swap, paired := *flagOutDir, *flagFASTQOut, *flagSwapMates, pairedInput
+	template, header, writers, stats := nameTemplate, headerTemplate, fileWriters, runStats
+	t.Cleanup(func() {
+		*flagOutDir, *flagFASTQOut, *flagSwapMates, pairedInput = outDir, fastqOut, swap, paired
+		nameTemplate, headerTemplate, fileWriters, runStats = template, header, writers, stats
+	})
+	*flagOutDir, *flagFASTQOut, *flagSwapMates, pairedInput = t.TempDir(), true, true, true
+	nameTemplate, headerTemplate = "{basename}.{id}", parseHeaderTemplate("{comment}")
+	fileWriters, runStats = newWriterPool(8), newStatsCollector()
+
+	pair := func(name, r1, r2 string) []FASTQRecord {
+		return []FASTQRecord{
+			{InputFileBasename: "S1_R1", Name: "@" + name + " 1:N:0:1", Seq: r1 + "\n", Qual: "IIIIIIII\n", Role: RoleR1},
+			{InputFileBasename: "S1_R2", Name: "@" + name + " 2:N:0:1", Seq: r2 + "\n", Qual: "IIIIIIII\n", Role: RoleR2},
+		}
+	}
+	emitReadSet(pair("a", "ACGTAAAA", "TTTTCCCC"), []Hit{{ID: 1, Role: RoleR1, From: 0, To: 4}})
+	emitReadSet(pair("b", "GGGGCCCC", "ACGTTTTT"), []Hit{{ID: 1, Role: RoleR2, From: 0, To: 4}})
+	// => pairs that aren't assigned aren't written
+	emitReadSet(pair("c", "GGGGCCCC", "AAAATTTT"), nil)
+	closeOutputWriters()
+	finalizeOutputFiles()
+
+	want := map[string][]string{
+		"S1_R1.1.fastq.gz": {"@a 1:N:0:1", "ACGTAAAA", "@b 1:N:0:1 swapped", "ACGTTTTT"},
+		"S1_R2.1.fastq.gz": {"@a 2:N:0:1", "TTTTCCCC", "@b 2:N:0:1 swapped", "GGGGCCCC"},
+	}
+	for filename, lines := range want {
+		if got := readFASTQLines(t, filepath.Join(*flagOutDir, filename)); !reflect.DeepEqual(got, lines) {
+			t.Errorf("%s = %q, want %q", filename, got, lines)
+		}
+	}
+	if runStats.MatesSwapped != 1 {
+		t.Errorf("swapped pairs = %d, want 1", runStats.MatesSwapped)
+	}
+}
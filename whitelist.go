@@ -0,0 +1,273 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * whitelist.go
+ *
+ * => cell barcode whitelist matching with single-mismatch correction, for
+ *    single-cell libraries; whitelists of millions of barcodes are looked up
+ *    by hashing, not compiled into the pattern database
+ *
+ * => observed barcodes are taken from a read position, eg: "R1:0-16", or
+ *    from a capture group of the matched pattern, eg: "cap:CB"
+ * => barcodes within one mismatch of a single whitelist entry are corrected;
+ *    with quality weighting, 10x style, several candidates are weighed by
+ *    their exact match counts so far and the error probability of the
+ *    mismatched base, and the best is taken if its posterior is high enough
+ * => read sets with barcodes that can't be corrected are rejected, ie: not
+ *    written, and counted as rejected rather than by sample
+ * => read sets without hits are assigned to their cell barcode, when it's
+ *    taken from a read position; written as if the barcode was a match
+ *
+ */
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minimum posterior probability of a quality weighted correction
+const whitelistMinPosterior = 0.975
+
+// WhitelistStatus = outcome of looking up an observed barcode
+type WhitelistStatus int
+
+const (
+	// WhitelistExact = observed barcode is in the whitelist
+	WhitelistExact WhitelistStatus = iota
+	// WhitelistCorrected = observed barcode was corrected to a whitelist entry
+	WhitelistCorrected
+	// WhitelistRejected = no whitelist entry, or no confident correction
+	WhitelistRejected
+)
+
+// CellBarcode = raw and corrected cell barcode of a read set
+type CellBarcode struct {
+	Raw, RawQual string
+	// => empty if rejected
+	Corrected string
+}
+
+// Whitelist = barcodes with their exact match counts, as correction priors
+type Whitelist struct {
+	barcodes map[string]int
+	length   int
+	// => weigh corrections by base quality
+	qualWeighted bool
+	// barcode source: a capture name, or a read role and region
+	capture  string
+	role     ReadRole
+	from, to int
+}
+
+// whitelist from the '-whitelist' flag; nil if none given
+var whitelist *Whitelist
+
+// returns a whitelist read from a file, one barcode per line, optionally
+// gzipped; source is "cap:<name>" or "<role>:<from>-<to>"
+func loadWhitelist(filename, source string, qualWeighted bool) *Whitelist {
+	wl := &Whitelist{barcodes: make(map[string]int), qualWeighted: qualWeighted}
+	wl.parseSource(source)
+
+	file, err := os.Open(filename)
+	checkErr(err, fmt.Sprintf("Can't read whitelist '%s'", filename))
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		checkErr(err, fmt.Sprintf("Can't read gzipped whitelist '%s'", filename))
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	lineno := 0
+	for scanner.Scan() {
+		barcode := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		lineno++
+
+		if len(barcode) == 0 || barcode[0] == '#' {
+			continue
+		}
+		if wl.length == 0 {
+			wl.length = len(barcode)
+		} else if len(barcode) != wl.length {
+			log.Fatal(fmt.Sprintf("Whitelist barcode at line %d has length %d, expected %d", lineno, len(barcode), wl.length))
+		}
+		wl.barcodes[barcode] = 0
+	}
+	checkErr(scanner.Err(), fmt.Sprintf("Can't read whitelist '%s'", filename))
+
+	if len(wl.barcodes) == 0 {
+		log.Fatal(fmt.Sprintf("Whitelist '%s' is empty!", filename))
+	}
+	if wl.capture == "" && wl.to-wl.from != wl.length {
+		log.Fatal(fmt.Sprintf("Whitelist barcode source '%s' has length %d, whitelist barcodes have length %d!", source, wl.to-wl.from, wl.length))
+	}
+	log.Info(fmt.Sprintf("Whitelist: %d barcodes of length %d", len(wl.barcodes), wl.length))
+
+	return wl
+}
+
+// sets the barcode source from "cap:<name>" or "<role>:<from>-<to>"
+func (wl *Whitelist) parseSource(source string) {
+	fields := strings.SplitN(source, ":", 2)
+	if len(fields) == 2 && fields[0] == "cap" && fields[1] != "" {
+		wl.capture = fields[1]
+		return
+	}
+
+	if len(fields) == 2 {
+		wl.role = ReadRole(fields[0])
+		span := strings.SplitN(fields[1], "-", 2)
+		if len(span) == 2 {
+			from, errFrom := strconv.Atoi(span[0])
+			to, errTo := strconv.Atoi(span[1])
+			if errFrom == nil && errTo == nil && from >= 0 && to > from {
+				wl.from, wl.to = from, to
+				return
+			}
+		}
+	}
+	log.Fatal(fmt.Sprintf("Bad whitelist barcode source '%s'! Expected 'cap:<name>' or '<role>:<from>-<to>', eg: 'R1:0-16'", source))
+}
+
+// returns the observed barcode and qualities of a read set; ok is false if
+// the read set doesn't have one
+func (wl *Whitelist) observed(records []FASTQRecord, hits []Hit) (seq, qual string, ok bool) {
+	if wl.capture != "" {
+		for _, hit := range hits {
+			for _, capture := range hit.Captures {
+				if capture.Name != wl.capture || capture.From < 0 {
+					continue
+				}
+				for _, record := range records {
+					if record.Role == hit.Role {
+						qual := strings.TrimSpace(record.Qual)[capture.From : capture.From+len(capture.Value)]
+						// => qualities in the order of the reverse complemented value
+						if hit.Reverse {
+							qual = reverse(qual)
+						}
+						return capture.Value, qual, true
+					}
+				}
+			}
+		}
+		return "", "", false
+	}
+
+	for _, record := range records {
+		seq, qual := strings.TrimSpace(record.Seq), strings.TrimSpace(record.Qual)
+		if record.Role == wl.role && wl.to <= len(seq) {
+			return seq[wl.from:wl.to], qual[wl.from:wl.to], true
+		}
+	}
+	return "", "", false
+}
+
+// returns the whitelist entry for an observed barcode, and the lookup outcome
+func (wl *Whitelist) match(observed, qual string) (string, WhitelistStatus) {
+	observed = strings.ToUpper(observed)
+	if len(observed) != wl.length {
+		return "", WhitelistRejected
+	}
+	if _, ok := wl.barcodes[observed]; ok {
+		wl.barcodes[observed]++
+		return observed, WhitelistExact
+	}
+
+	// => all whitelist entries one mismatch away, with the error
+	// probability of the mismatched base
+	var candidates []string
+	var errorProbs []float64
+	variant := []byte(observed)
+	for i := range variant {
+		for _, base := range []byte("ACGT") {
+			if base == observed[i] {
+				continue
+			}
+			variant[i] = base
+			if _, ok := wl.barcodes[string(variant)]; ok {
+				candidates = append(candidates, string(variant))
+				errorProbs = append(errorProbs, math.Pow(10, -float64(int(qual[i])-33)/10))
+			}
+		}
+		variant[i] = observed[i]
+	}
+
+	switch {
+	case len(candidates) == 0:
+		return "", WhitelistRejected
+	case !wl.qualWeighted && len(candidates) == 1:
+		return candidates[0], WhitelistCorrected
+	case !wl.qualWeighted:
+		return "", WhitelistRejected
+	}
+
+	best, bestLikelihood, total := -1, 0.0, 0.0
+	for i, candidate := range candidates {
+		likelihood := float64(wl.barcodes[candidate]+1) * errorProbs[i]
+		total += likelihood
+		if likelihood > bestLikelihood {
+			best, bestLikelihood = i, likelihood
+		}
+	}
+	if bestLikelihood/total < whitelistMinPosterior {
+		return "", WhitelistRejected
+	}
+	return candidates[best], WhitelistCorrected
+}
+
+// looks up the cell barcode of a read set, setting it on its records;
+// returns the hits of the read set, with a cell barcode hit added if it has
+// none, and false if the read set is rejected
+func (wl *Whitelist) checkReadSet(records []FASTQRecord, hits []Hit) ([]Hit, bool) {
+	// => without hits, there's no capture to take a barcode from
+	if len(hits) == 0 && wl.capture != "" {
+		return hits, true
+	}
+
+	seq, qual, ok := wl.observed(records, hits)
+	status := WhitelistRejected
+	barcode := CellBarcode{Raw: seq, RawQual: qual}
+	if ok {
+		barcode.Corrected, status = wl.match(seq, qual)
+	}
+
+	switch status {
+	case WhitelistExact:
+		runStats.WhitelistExact++
+	case WhitelistCorrected:
+		runStats.WhitelistCorrected++
+	default:
+		runStats.WhitelistRejected++
+		return hits, false
+	}
+
+	for i := range records {
+		records[i].CellBarcode = barcode
+	}
+	if len(hits) == 0 {
+		hits = append(hits, Hit{Role: wl.role, From: uint64(wl.from), To: uint64(wl.to), Cell: barcode.Corrected})
+	}
+	return hits, true
+}
+
+// returns true for the cell barcode hit of a read set without hits of its
+// own, see checkReadSet
+func (hit Hit) whitelisted() bool {
+	return hit.Round == 0 && hit.Cell != ""
+}
@@ -0,0 +1,114 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+// returns a whitelist of barcodes, taken from the start of R1
+func testWhitelist(qualWeighted bool, barcodes ...string) *Whitelist {
+	wl := &Whitelist{barcodes: make(map[string]int), qualWeighted: qualWeighted, role: RoleR1}
+	for _, barcode := range barcodes {
+		wl.barcodes[barcode] = 0
+	}
+	wl.length = len(barcodes[0])
+	wl.to = wl.length
+	return wl
+}
+
+func TestWhitelistMatch(t *testing.T) {
+	wl := testWhitelist(false, "AAAACCCC", "AAAAGGGG", "TTTTCCCC", "TTTTCCCG")
+	qual := "IIIIIIII"
+
+	tests := []struct {
+		observed, want string
+		status         WhitelistStatus
+	}{
+		{"AAAACCCC", "AAAACCCC", WhitelistExact},
+		{"aaaacccc", "AAAACCCC", WhitelistExact},
+		// => one mismatch from a single entry
+		{"AAAACCCA", "AAAACCCC", WhitelistCorrected},
+		{"CAAAGGGG", "AAAAGGGG", WhitelistCorrected},
+		{"AAAANCCC", "AAAACCCC", WhitelistCorrected},
+		// => one mismatch from two entries
+		{"TTTTCCCA", "", WhitelistRejected},
+		// => two mismatches
+		{"AAAACCGG", "", WhitelistRejected},
+		{"AAAACCC", "", WhitelistRejected},
+	}
+	for _, test := range tests {
+		got, status := wl.match(test.observed, qual[:len(test.observed)])
+		if got != test.want || status != test.status {
+			t.Errorf("match(%s) = %q, %d, want %q, %d", test.observed, got, status, test.want, test.status)
+		}
+	}
+}
+
+func TestWhitelistMatchQualWeighted(t *testing.T) {
+	wl := testWhitelist(true, "TTTTCCCC", "TTTTCCCG")
+	for i := 0; i < 100; i++ {
+		wl.match("TTTTCCCC", "IIIIIIII")
+	}
+
+	// => the frequent entry wins a mismatch at a low quality base
+	if got, status := wl.match("TTTTCCCA", "IIIIIII#"); got != "TTTTCCCC" || status != WhitelistCorrected {
+		t.Errorf("match(TTTTCCCA) = %q, %d, want \"TTTTCCCC\", corrected", got, status)
+	}
+	// => equally likely entries aren't corrected to
+	wl.barcodes["TTTTCCCG"] = wl.barcodes["TTTTCCCC"]
+	if got, status := wl.match("TTTTCCCA", "IIIIIII#"); status != WhitelistRejected {
+		t.Errorf("match(TTTTCCCA) = %q, %d, want rejected", got, status)
+	}
+}
+
+func TestWhitelistCheckReadSet(t *testing.T) {
+	wl := testWhitelist(false, "AAAACCCC")
+	records := func(seq string) []FASTQRecord {
+		return []FASTQRecord{{Name: "@read1", Seq: seq + "\n", Qual: "IIIIIIIIIIII\n", Role: RoleR1}}
+	}
+
+	// => read sets with hits keep them, with the cell barcode on their records
+	hits := []Hit{{ID: 1, Role: RoleR1, From: 8, To: 12}}
+	set := records("AAAACCCATTTT")
+	checked, ok := wl.checkReadSet(set, hits)
+	if !ok || len(checked) != 1 || checked[0].ID != 1 {
+		t.Fatalf("read set with hits: got %v, %t", checked, ok)
+	}
+	if set[0].CellBarcode != (CellBarcode{Raw: "AAAACCCA", RawQual: "IIIIIIII", Corrected: "AAAACCCC"}) {
+		t.Errorf("cell barcode = %+v", set[0].CellBarcode)
+	}
+
+	// => read sets without hits are assigned by their cell barcode
+	checked, ok = wl.checkReadSet(records("AAAACCCCTTTT"), nil)
+	if !ok || len(checked) != 1 || !checked[0].whitelisted() {
+		t.Fatalf("read set without hits: got %v, %t", checked, ok)
+	}
+	if assignment, sample := readSetAssignment(checked, false); assignment != AssignSample || sample != "AAAACCCC" {
+		t.Errorf("read set without hits assigned %s to %q, want assigned to \"AAAACCCC\"", assignment, sample)
+	}
+
+	// => rejected read sets aren't assigned, with or without hits
+	for _, hits := range [][]Hit{hits, nil} {
+		if _, ok := wl.checkReadSet(records("GGGGCCCCTTTT"), hits); ok {
+			t.Errorf("read set with %d hits wasn't rejected", len(hits))
+		}
+		if assignment, _ := readSetAssignment(hits, true); assignment != AssignRejected {
+			t.Errorf("rejected read set with %d hits assigned %s", len(hits), assignment)
+		}
+	}
+}
+
+func TestRejectedReadSetStats(t *testing.T) {
+	stats := newStatsCollector()
+	records := []FASTQRecord{{Name: "@read1", Seq: "AAAACCCCTTTT\n", Qual: "IIIIIIIIIIII\n", Role: RoleR1}}
+	hits := []Hit{{ID: 1, Role: RoleR1, From: 8, To: 12}}
+
+	stats.addReadSet(records, hits, true)
+	if stats.Rejected != 1 || stats.Assigned != 0 || len(stats.Samples) != 0 {
+		t.Errorf("rejected read set counted as rejected %d, assigned %d, in samples %v", stats.Rejected, stats.Assigned, stats.Samples)
+	}
+}
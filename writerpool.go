@@ -0,0 +1,98 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+/*
+ * writerpool.go
+ *
+ * => bounded pool of open output writers, for large barcode sets
+ * => least recently used writers are suspended (flushed and closed as
+ *    complete gzip / BGZF members) and resumed in append mode on next use
+ *
+ */
+
+import (
+	"container/list"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WriterPool = RecordWriters by output file name, with at most maxOpen
+// writers holding an open file handle at once
+type WriterPool struct {
+	maxOpen int
+	writers map[string]RecordWriter
+	// open writers, most recently used at the front
+	lru      *list.List
+	elements map[string]*list.Element
+	// number of times writers were suspended, for logging
+	suspends int
+}
+
+// returns an empty WriterPool; maxOpen < 1 means no limit
+func newWriterPool(maxOpen int) *WriterPool {
+	return &WriterPool{
+		maxOpen:  maxOpen,
+		writers:  make(map[string]RecordWriter),
+		lru:      list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// returns the open writer for filename, creating it with newWriter if needed
+func (pool *WriterPool) get(filename string, newWriter func() RecordWriter) RecordWriter {
+	// fast path: already open
+	if element, ok := pool.elements[filename]; ok {
+		pool.lru.MoveToFront(element)
+		return pool.writers[filename]
+	}
+
+	pool.makeRoom()
+
+	writer, exists := pool.writers[filename]
+	if exists {
+		writer.Resume()
+	} else {
+		writer = newWriter()
+		pool.writers[filename] = writer
+	}
+	pool.elements[filename] = pool.lru.PushFront(filename)
+
+	return writer
+}
+
+// suspends least recently used writers until there is room to open one more
+func (pool *WriterPool) makeRoom() {
+	if pool.maxOpen < 1 {
+		return
+	}
+	for pool.lru.Len() >= pool.maxOpen {
+		element := pool.lru.Back()
+		filename := element.Value.(string)
+		pool.writers[filename].Suspend()
+		pool.lru.Remove(element)
+		delete(pool.elements, filename)
+		pool.suspends++
+	}
+}
+
+// closes all writers; suspended writers are resumed first so that each
+// writes its final trailer (eg: BGZF EOF marker)
+func (pool *WriterPool) closeAll() {
+	for filename, writer := range pool.writers {
+		if _, open := pool.elements[filename]; !open {
+			writer.Resume()
+		}
+		writer.Close()
+	}
+	if pool.suspends > 0 {
+		log.Debug(fmt.Sprintf("Output writers suspended %d times (max open: %d)", pool.suspends, pool.maxOpen))
+	}
+	pool.writers = make(map[string]RecordWriter)
+	pool.lru.Init()
+	pool.elements = make(map[string]*list.Element)
+}
@@ -0,0 +1,120 @@
+/*
+ *   Copyright (c) 2020
+ *   All rights reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// poolEventWriter = a RecordWriter logging the calls made to it
+type poolEventWriter struct {
+	name   string
+	events *[]string
+}
+
+func (w poolEventWriter) Write(record OutputRecord) { *w.events = append(*w.events, "write "+w.name) }
+func (w poolEventWriter) Suspend()                  { *w.events = append(*w.events, "suspend "+w.name) }
+func (w poolEventWriter) Resume()                   { *w.events = append(*w.events, "resume "+w.name) }
+func (w poolEventWriter) Close()                    { *w.events = append(*w.events, "close "+w.name) }
+
+// returns the lines of a gzipped file, read through all of its members
+func readGzipLines(t *testing.T, filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("couldn't open %s: %s", filename, err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("couldn't read %s: %s", filename, err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("couldn't read %s: %s", filename, err)
+	}
+	return lines
+}
+
+func TestWriterPoolEviction(t *testing.T) {
+	var events []string
+	pool := newWriterPool(2)
+	get := func(name string) {
+		pool.get(name, func() RecordWriter {
+			events = append(events, "open "+name)
+			return poolEventWriter{name, &events}
+		}).Write(OutputRecord{})
+	}
+
+	// => "b" is least recently used when "c" is opened, then resumed
+	get("a")
+	get("b")
+	get("a")
+	get("c")
+	get("b")
+	pool.closeAll()
+
+	want := []string{
+		"open a", "write a", "open b", "write b", "write a",
+		"suspend b", "open c", "write c",
+		"suspend a", "resume b", "write b",
+	}
+	if !reflect.DeepEqual(events[:len(want)], want) {
+		t.Fatalf("events = %v, want %v", events[:len(want)], want)
+	}
+	// => suspended writers are resumed to be closed, in any order
+	closed := map[string]bool{}
+	for _, event := range events[len(want):] {
+		closed[event] = true
+	}
+	if len(events)-len(want) != 4 || !closed["resume a"] || !closed["close a"] || !closed["close b"] || !closed["close c"] {
+		t.Errorf("close events = %v, want resume a, close a, b, c", events[len(want):])
+	}
+	if pool.suspends != 2 || len(pool.writers) != 0 || pool.lru.Len() != 0 {
+		t.Errorf("pool after closeAll = %d suspends, %d writers, %d open", pool.suspends, len(pool.writers), pool.lru.Len())
+	}
+}
+
+func TestWriterPoolReopenAppend(t *testing.T) {
+	dir := t.TempDir()
+	pool := newWriterPool(1)
+	write := func(name, readID string) {
+		filename := filepath.Join(dir, name)
+		pool.get(filename, func() RecordWriter {
+			return newFASTQWriter(filename)
+		}).Write(OutputRecord{ReadID: readID, Seq: "ACGT", Qual: "IIII"})
+	}
+
+	// => each file is suspended between its writes, as a gzip member each
+	write("a.fastq.gz", "read1")
+	write("b.fastq.gz", "read2")
+	write("a.fastq.gz", "read3")
+	write("b.fastq.gz", "read4")
+	write("a.fastq.gz", "read5")
+	pool.closeAll()
+	finalizeOutputFiles()
+
+	want := map[string][]string{
+		"a.fastq.gz": {"@read1", "ACGT", "+", "IIII", "@read3", "ACGT", "+", "IIII", "@read5", "ACGT", "+", "IIII"},
+		"b.fastq.gz": {"@read2", "ACGT", "+", "IIII", "@read4", "ACGT", "+", "IIII"},
+	}
+	for name, lines := range want {
+		if got := readGzipLines(t, filepath.Join(dir, name)); !reflect.DeepEqual(got, lines) {
+			t.Errorf("%s = %q, want %q", name, got, lines)
+		}
+	}
+	if pool.suspends != 4 {
+		t.Errorf("%d suspends, want 4", pool.suspends)
+	}
+}